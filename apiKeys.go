@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shaj13/go-guardian/auth"
+)
+
+// Header carrying an API key
+const apiKeyHeader = "X-API-Key"
+
+// Identifier of the API key strategy in the go-guardian authenticator
+const apiKeyStrategyKey = auth.StrategyKey("APIKey.Strategy")
+
+// Prefix of every API key, so a leaked key is easy to recognize
+const apiKeyPrefix = "pas_"
+
+// API key scopes, each names what a key may do
+const (
+	scopeMenuRead     = "menu:read"
+	scopeOrdersCreate = "orders:create"
+	scopeOrdersRead   = "orders:read"
+	scopeOrdersCancel = "orders:cancel"
+)
+
+// Every known scope
+var apiKeyScopes = []string{scopeMenuRead, scopeOrdersCreate, scopeOrdersRead, scopeOrdersCancel}
+
+// Generates a new API key: the prefix, a random key id used to look the key up, and a random secret
+// Returns the key handed to the client, and its id
+func newAPIKey() (string, string, error) {
+	keyID, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := newSecretToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	return apiKeyPrefix + keyID + "_" + secret, keyID, nil
+}
+
+// Extracts the key id from an API key
+func parseAPIKeyID(key string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// Validation rule that accepts the known scopes
+func isAPIKeyScope(value interface{}) error {
+	scopes, _ := value.([]string)
+	for _, scope := range scopes {
+		known := false
+		for _, s := range apiKeyScopes {
+			known = known || scope == s
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Reports whether the user was authenticated with an API key that holds the scope
+func hasScope(user auth.Info, scope string) bool {
+	for _, s := range user.Extensions()["scope"] {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyAPIKeyHandler - Handler to verify the given API key
+// The key acts on behalf of the account it was issued for, limited to its scopes.
+func (a *App) VerifyAPIKeyHandler(ctx context.Context, r *http.Request, key string) (auth.Info, error) {
+	keyID, ok := parseAPIKeyID(key)
+	if !ok {
+		return nil, fmt.Errorf("Invalid API key")
+	}
+
+	// Fetch the key from the DB given the key id, and compare the stored hash with the hash of the received key
+	k, err := a.Store.GetAPIKey(keyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("Invalid API key")
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(hashSecretToken(key))) != 1 {
+		return nil, fmt.Errorf("Invalid API key")
+	}
+
+	now := a.Clock()
+	if k.RevokedAt != nil {
+		return nil, fmt.Errorf("API key has been revoked")
+	}
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return nil, fmt.Errorf("API key has expired")
+	}
+
+	// Track when the key was last used, a failure does not reject the request
+	if err := a.Store.TouchAPIKey(keyID, now); err != nil {
+		log.Println(err)
+	}
+
+	user := auth.NewDefaultUser("apikey:"+k.Name, strconv.Itoa(k.CustomerID), nil, map[string][]string{
+		"apikey": {k.KeyID},
+		"scope":  k.Scopes,
+	})
+	return user, nil
+}
+
+// Handler to create an API key (Used by admins)
+// The key is only returned in this response, the DB only holds its hash.
+func (a *App) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate the request
+	if err := validateAPIKeyRequest(req); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// The key acts on behalf of an existing account (e.g. the partner or the kiosk account)
+	creds, err := a.Store.GetCustomerCredentials(req.Username)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	key, keyID, err := newAPIKey()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	k := apiKey{
+		KeyID:      keyID,
+		KeyHash:    hashSecretToken(key),
+		Name:       req.Name,
+		CustomerID: creds.CustomerID,
+		Username:   req.Username,
+		Scopes:     req.Scopes,
+		CreatedBy:  authenticatedUserName(r),
+		CreatedAt:  a.Clock(),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := k.CreatedAt.Add(time.Hour * 24 * time.Duration(req.ExpiresInDays))
+		k.ExpiresAt = &expiresAt
+	}
+
+	// Write the key to DB
+	if err := a.Store.CreateAPIKey(k); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s created the API key %s (%s) for %s\n", k.CreatedBy, k.KeyID, k.Name, k.Username)
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"key":    key,
+		"apiKey": k,
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusCreated, payload)
+}
+
+// Handler to retrieve the list of API keys (Used by admins)
+func (a *App) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.Store.GetAPIKeys()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, keys)
+}
+
+// Handler to revoke an API key (Used by admins)
+func (a *App) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'keyId' from a Request URL
+	keyID := mux.Vars(r)["keyId"]
+
+	if err := a.Store.RevokeAPIKey(keyID, a.Clock()); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "API key not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+	log.Printf("User %s revoked the API key %s\n", authenticatedUserName(r), keyID)
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"keyId":   keyID,
+		"message": "API key revoked",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Creates an API key acting on behalf of a new customer and returns the key and its id
+func createTestAPIKey(t *testing.T, admin string, scopes string) (string, string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"name":"kiosk","username":"%s","scopes":%s}`, newTestCustomer(t, roleCustomer), scopes)
+	res, b := testRequest(t, "POST", "/apikey/add", admin, body)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating the API key: %d %s", res.StatusCode, b)
+	}
+	var payload struct {
+		Key    string `json:"key"`
+		APIKey apiKey `json:"apiKey"`
+	}
+	decodeTestJSON(t, b, &payload)
+	return payload.Key, payload.APIKey.KeyID
+}
+
+func TestAPIKeyIsLimitedToItsScopes(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	key, _ := createTestAPIKey(t, admin, fmt.Sprintf(`["%s"]`, scopeMenuRead))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"scope held", "GET", "/v1/pizzas", http.StatusOK},
+		{"deprecated route of the scope held", "GET", "/pizza/show", http.StatusOK},
+		{"scope not held", "GET", "/v1/orders?customerPhoneNumber=8125984475", http.StatusForbidden},
+		{"scope not held to create", "POST", "/v1/orders", http.StatusForbidden},
+		{"route without a scope", "GET", "/v1/customers/me", http.StatusForbidden},
+		{"admin route", "GET", "/apikey/show", http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		if res, b := testRequest(t, tc.method, tc.path, "", "", apiKeyHeader, key); res.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, tc.status, res.StatusCode, b)
+		}
+	}
+}
+
+func TestRevokedAPIKeyIsRejected(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	key, keyID := createTestAPIKey(t, admin, fmt.Sprintf(`["%s"]`, scopeMenuRead))
+	other, _ := createTestAPIKey(t, admin, fmt.Sprintf(`["%s"]`, scopeMenuRead))
+
+	if res, b := testRequest(t, "GET", "/v1/pizzas", "", "", apiKeyHeader, key); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "DELETE", "/apikey/"+keyID, admin, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	// The key is rejected on its next request, the other keys keep working
+	if res, b := testRequest(t, "GET", "/v1/pizzas", "", "", apiKeyHeader, key); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the revoked key, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/pizzas", "", "", apiKeyHeader, other); res.StatusCode != http.StatusOK {
+		t.Errorf("expected another key to keep working, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/pizzas", "", "", apiKeyHeader, key+"0"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong secret, got %d %s", res.StatusCode, b)
+	}
+
+	// Revoking an unknown key is not found
+	if res, b := testRequest(t, "DELETE", "/apikey/0123abcd", admin, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d %s", res.StatusCode, b)
+	}
+}
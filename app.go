@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,6 +15,7 @@ import (
 	"github.com/shaj13/go-guardian/auth"
 	"github.com/shaj13/go-guardian/auth/strategies/basic"
 	"github.com/shaj13/go-guardian/auth/strategies/bearer"
+	"github.com/shaj13/go-guardian/auth/strategies/token"
 	"github.com/shaj13/go-guardian/store"
 )
 
@@ -21,18 +24,69 @@ var cache store.Cache
 
 type App struct {
 	Router *mux.Router
-	DB     *sql.DB
+	Store  Store
+	Sender Sender
+	Clock  Clock
+	Events *orderBroker
 }
 
 // Initialize a DB connection and initialize the router
+// A Store, Sender, Clock, or broker that was set before calling Initialize (e.g. an in-memory store) is used as is
 func (a *App) Initialize() {
-	a.initDB()
+	if a.Store == nil {
+		a.initDB()
+	}
+	if a.Sender == nil {
+		a.Sender = newSender()
+	}
+	if a.Clock == nil {
+		a.Clock = time.Now
+	}
+	if a.Events == nil {
+		a.Events = newOrderBroker()
+	}
+
+	// The signing keys are stored encrypted in DB, the configured private key becomes the current key when it is new
+	aead, err := loadKeyEncryptionKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := loadKeyring(a.Store, loadSigningKey(), aead)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokenKeys = keys
+
+	// Phone numbers without a calling code are read in the default region
+	if err := validateDefaultPhoneRegion(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Responses of the requests sent with an 'Idempotency-Key' header are replayed within the retention window
+	if err := loadIdempotencyRetention(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Init GoGuardian
 	a.setupGoGuardian()
 
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
+	a.initializeV1Routes()
+
+	// Warn about a route that the OpenAPI document does not describe, the tests fail on it
+	if err := checkOpenAPICoverage(a.Router); err != nil {
+		log.Println(err)
+	}
+
+	// Every response carries a request ID, errors are returned as problem details
+	a.Router.Use(requestIDMiddleware)
+	a.Router.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responseErrorHandler(w, http.StatusNotFound, "Resource not found")
+	}))
+	a.Router.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responseErrorHandler(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}))
 }
 
 // Run the application
@@ -43,58 +97,203 @@ func (a *App) Run(addr string) {
 
 // Get the connection string from Heroku
 // If above operation fails, set connection string manually for local
+// Setting STORE_BACKEND to 'memory' runs the application without a DB
+// The schema version is compared against the migrations compiled into the binary
 func (a *App) initDB() {
+	if os.Getenv("STORE_BACKEND") == "memory" {
+		log.Println("Using in-memory store")
+		a.Store = newMemoryStore()
+		return
+	}
+
+	db := openDB()
+
+	// Refuse to start against an outdated schema when SCHEMA_CHECK is 'strict'
+	if err := checkSchemaVersion(db); err != nil {
+		if os.Getenv("SCHEMA_CHECK") == "strict" {
+			log.Fatal(err)
+		}
+		log.Println(err)
+	}
+
+	a.Store = newPostgresStore(db)
+}
+
+// Open a Postgres connection using DATABASE_URL or the local connection string file
+func openDB() *sql.DB {
 	connString := os.Getenv("DATABASE_URL")
 	if connString == "" {
 		connString = getConnString()
 		log.Println("Using local connection")
 	}
 
-	var err error
-	a.DB, err = sql.Open("postgres", connString)
+	db, err := sql.Open("postgres", connString)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	return db
 }
 
 // Initialize routes
+// The routes that have a '/v1' counterpart are deprecated aliases, see 'initializeV1Routes'
 func (a *App) initializeRoutes() {
+	// Routes for the OpenAPI document and the documentation page
+	a.Router.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+	a.Router.HandleFunc("/docs", docsHandler).Methods("GET")
+
 	// Route for creating a new customer
-	a.Router.HandleFunc("/customer/add", a.createCustomerHandler).Methods("POST")
+	a.Router.HandleFunc("/customer/add", deprecated("/v1/customers", a.idempotent(a.createCustomerHandler))).Methods("POST")
+
+	// Route for publishing the public keys that verify the bearer tokens (JWKS)
+	a.Router.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
 
 	// Route for obtaining a bearer token given the username and password
-	a.Router.HandleFunc("/auth/token", middleware(createTokenHandler))
-	http.Handle("/auth/token", a.Router)
+	// Accounts with two-factor authentication send a one-time password along with them
+	a.Router.HandleFunc("/auth/token", passwordMiddleware(a.createTokenHandler))
+
+	// Route for obtaining a new bearer token given a refresh token
+	a.Router.HandleFunc("/auth/refresh", a.refreshTokenHandler).Methods("POST")
+
+	// Route for logging out, revokes the session of the bearer token
+	a.Router.HandleFunc("/auth/logout", middleware(a.logoutHandler)).Methods("POST")
+
+	// Route for revoking every session of the authenticated user
+	a.Router.HandleFunc("/auth/sessions/revoke", middleware(a.revokeSessionsHandler)).Methods("POST")
+
+	// Route for requesting a password reset token
+	a.Router.HandleFunc("/auth/password/forgot", a.forgotPasswordHandler).Methods("POST")
+
+	// Route for resetting the password given a reset token
+	a.Router.HandleFunc("/auth/password/reset", a.resetPasswordHandler).Methods("POST")
+
+	// Routes for enrolling in two-factor authentication, the password is enough until the enrollment is confirmed
+	a.Router.HandleFunc("/customer/totp/enroll", passwordMiddleware(a.enrollTwoFactorHandler)).Methods("POST")
+	a.Router.HandleFunc("/customer/totp/confirm", passwordMiddleware(a.confirmTwoFactorHandler)).Methods("POST")
+
+	// Route for disabling two-factor authentication
+	a.Router.HandleFunc("/customer/totp", middleware(a.disableTwoFactorHandler)).Methods("DELETE")
+
+	// Route for changing the password of the authenticated user
+	a.Router.HandleFunc("/customer/password", deprecated("/v1/customers/me/password", middleware(a.changePasswordHandler))).Methods("PUT")
+
+	// Routes for viewing, updating, and closing the account of the authenticated user
+	a.Router.HandleFunc("/customer/me", deprecated("/v1/customers/me", middleware(a.getProfileHandler))).Methods("GET")
+	a.Router.HandleFunc("/customer/me", deprecated("/v1/customers/me", middleware(a.updateProfileHandler))).Methods("PATCH")
+	a.Router.HandleFunc("/customer/me", deprecated("/v1/customers/me", middleware(a.closeAccountHandler))).Methods("DELETE")
+
+	// Route for exporting the personal data of the authenticated user
+	a.Router.HandleFunc("/customer/me/export", deprecated("/v1/customers/me/export", middleware(a.exportMyDataHandler))).Methods("GET")
+
+	// Route for rotating the key that signs the tokens (Admin only)
+	a.Router.HandleFunc("/auth/keys/rotate", middleware(rotateSigningKeyHandler, roleAdmin)).Methods("POST")
 
 	// *** Wrap below functions with middleware to authenticate the request before they reach to the final route ***
 
 	// Route for creating a new order
-	a.Router.HandleFunc("/order/add", middleware(a.createOrderHandler)).Methods("POST")
-	http.Handle("/order/add", a.Router)
+	a.Router.HandleFunc("/order/add", deprecated("/v1/orders", scopedMiddleware(scopeOrdersCreate, a.idempotent(a.createOrderHandler)))).Methods("POST")
 
 	// Route for retrieving status of the order
-	a.Router.HandleFunc("/order/show/{orderId:[0-9]+}", middleware(a.getStatusHandler)).Methods("GET")
-	http.Handle("/order/show/{orderId:[0-9]+}", a.Router)
+	a.Router.HandleFunc("/order/show/{orderId:[0-9]+}", deprecated("/v1/orders/{orderId}", scopedMiddleware(scopeOrdersRead, a.getStatusHandler))).Methods("GET")
+
+	// Route for retrieving the status history of the order
+	a.Router.HandleFunc("/order/{orderId:[0-9]+}/timeline", deprecated("/v1/orders/{orderId}/timeline", scopedMiddleware(scopeOrdersRead, a.getOrderTimelineHandler))).Methods("GET")
+
+	// Stream the status changes of an order as Server-Sent Events
+	a.Router.HandleFunc("/order/{orderId:[0-9]+}/events", deprecated("/v1/orders/{orderId}/events", scopedMiddleware(scopeOrdersRead, a.orderEventsHandler))).Methods("GET")
 
 	// Route for canceling an order
-	a.Router.HandleFunc("/order/update/{orderId:[0-9]+}", middleware(a.cancelOrderHandler)).Methods("PUT")
-	http.Handle("/order/update/{orderId:[0-9]+}", a.Router)
+	a.Router.HandleFunc("/order/update/{orderId:[0-9]+}", deprecated("/v1/orders/{orderId}/cancel", scopedMiddleware(scopeOrdersCancel, a.cancelOrderHandler))).Methods("PUT")
 
 	// Route for retrieving list of orders by specific phone number
-	a.Router.HandleFunc("/order/show", middleware(a.getOrdersHandler)).Methods("GET")
-	http.Handle("/order/show", a.Router)
+	a.Router.HandleFunc("/order/show", deprecated("/v1/orders", scopedMiddleware(scopeOrdersRead, a.getOrdersHandler))).Methods("GET")
 
 	// Route for retrieving the list of available pizzas
-	a.Router.HandleFunc("/pizza/show", middleware(a.getAvailablePizzasHandler)).Methods("GET")
-	http.Handle("/pizza/show", a.Router)
+	a.Router.HandleFunc("/pizza/show", deprecated("/v1/pizzas", scopedMiddleware(scopeMenuRead, a.getAvailablePizzasHandler))).Methods("GET")
 
 	// Route for retrieving the list of order status
-	a.Router.HandleFunc("/status_code/show", middleware(a.getStatusCodeHandler)).Methods("GET")
-	http.Handle("/status_code/show", a.Router)
+	a.Router.HandleFunc("/status_code/show", middleware(a.getStatusCodeHandler, storeRoles...)).Methods("GET")
 
 	// Route for updating the order status
-	a.Router.HandleFunc("/order/update", middleware(a.updateOrderStatusHandler)).Methods("PUT")
-	http.Handle("/order/update", a.Router)
+	a.Router.HandleFunc("/order/update", deprecated("/v1/orders/{orderId}", middleware(a.updateOrderStatusHandler, storeRoles...))).Methods("PUT")
+
+	// Route for changing the role of an account (Admin only)
+	a.Router.HandleFunc("/customer/role", middleware(a.updateCustomerRoleHandler, roleAdmin)).Methods("PUT")
+
+	// Routes for handling the personal data requests of a customer (Admin only)
+	a.Router.HandleFunc("/customer/{customerId:[0-9]+}/export", deprecated("/v1/customers/{customerId}/export", middleware(a.exportCustomerDataHandler, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/customer/{customerId:[0-9]+}/erase", deprecated("/v1/customers/{customerId}/erase", middleware(a.eraseCustomerDataHandler, roleAdmin))).Methods("POST")
+
+	// Routes for managing the API keys of partner and kiosk integrations (Admin only)
+	a.Router.HandleFunc("/apikey/add", middleware(a.createAPIKeyHandler, roleAdmin)).Methods("POST")
+	a.Router.HandleFunc("/apikey/show", middleware(a.getAPIKeysHandler, roleAdmin)).Methods("GET")
+	a.Router.HandleFunc("/apikey/{keyId:[0-9a-f]+}", middleware(a.revokeAPIKeyHandler, roleAdmin)).Methods("DELETE")
+
+	// Route for retrieving the account lockouts (Managers and admins only)
+	a.Router.HandleFunc("/customer/lockouts", middleware(a.getAccountLockoutsHandler, supportRoles...)).Methods("GET")
+
+	// Route for requiring an account to use two-factor authentication (Managers and admins only)
+	a.Router.HandleFunc("/customer/totp/require", middleware(a.requireTwoFactorHandler, supportRoles...)).Methods("PUT")
+
+	// Route for unlocking an account (Managers and admins only)
+	a.Router.HandleFunc("/customer/unlock", middleware(a.unlockAccountHandler, supportRoles...)).Methods("PUT")
+}
+
+// Initialize the resource-oriented routes of the '/v1' API
+// Reads take their parameters from the query string, never from a request body.
+func (a *App) initializeV1Routes() {
+	v1 := a.Router.PathPrefix("/v1").Subrouter()
+
+	// Routes for creating a customer, and for viewing, updating, and closing the account of the authenticated user
+	v1.HandleFunc("/customers", a.idempotent(a.createCustomerHandler)).Methods("POST")
+	v1.HandleFunc("/customers/me", middleware(a.getProfileHandler)).Methods("GET")
+	v1.HandleFunc("/customers/me", middleware(a.updateProfileHandler)).Methods("PATCH")
+	v1.HandleFunc("/customers/me", middleware(a.closeAccountHandler)).Methods("DELETE")
+
+	// Routes for changing the password and exporting the personal data of the authenticated user
+	v1.HandleFunc("/customers/me/password", middleware(a.changePasswordHandler)).Methods("PUT")
+	v1.HandleFunc("/customers/me/export", middleware(a.exportMyDataHandler)).Methods("GET")
+
+	// Routes for handling the personal data requests of a customer (Admin only)
+	v1.HandleFunc("/customers/{customerId:[0-9]+}/export", middleware(a.exportCustomerDataHandler, roleAdmin)).Methods("GET")
+	v1.HandleFunc("/customers/{customerId:[0-9]+}/erase", middleware(a.eraseCustomerDataHandler, roleAdmin)).Methods("POST")
+
+	// Routes for creating an order, and listing the orders given the 'customerPhoneNumber' query parameter
+	v1.HandleFunc("/orders", scopedMiddleware(scopeOrdersCreate, a.idempotent(a.createOrderHandler))).Methods("POST")
+	v1.HandleFunc("/orders", scopedMiddleware(scopeOrdersRead, a.listOrdersHandler)).Methods("GET")
+
+	// Routes for retrieving an order, and updating its status (Store employees only)
+	v1.HandleFunc("/orders/{orderId:[0-9]+}", scopedMiddleware(scopeOrdersRead, a.getStatusHandler)).Methods("GET")
+	v1.HandleFunc("/orders/{orderId:[0-9]+}", middleware(a.updateOrderHandler, storeRoles...)).Methods("PATCH")
+
+	// Routes for retrieving the status history of an order, and canceling an order
+	v1.HandleFunc("/orders/{orderId:[0-9]+}/timeline", scopedMiddleware(scopeOrdersRead, a.getOrderTimelineHandler)).Methods("GET")
+	v1.HandleFunc("/orders/{orderId:[0-9]+}/events", scopedMiddleware(scopeOrdersRead, a.orderEventsHandler)).Methods("GET")
+	v1.HandleFunc("/orders/{orderId:[0-9]+}/cancel", scopedMiddleware(scopeOrdersCancel, a.cancelOrderHandler)).Methods("POST")
+
+	// Route for retrieving the list of available pizzas
+	v1.HandleFunc("/pizzas", scopedMiddleware(scopeMenuRead, a.getAvailablePizzasHandler)).Methods("GET")
+
+	// Route for the WebSocket feed of the kitchen displays (Store employees only)
+	v1.HandleFunc("/kitchen/feed", middleware(a.kitchenFeedHandler, storeRoles...)).Methods("GET")
+}
+
+// HTTP middleware that marks a legacy route as deprecated in favor of its '/v1' successor
+// Responses carry the 'Deprecation' header, and a 'Link' header to the successor when its route variables are known.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.Replace(link, "{"+name+"}", value, -1)
+		}
+		if !strings.Contains(link, "{") {
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		}
+
+		next(w, r)
+	}
 }
 
 // Setup Go-Guardian
@@ -105,25 +304,88 @@ func (a *App) setupGoGuardian() {
 
 	// Dispatch the authenticator to strategies
 	basicStrategy := basic.New(a.ValidateUserHandler, cache)
-	tokenStrategy := bearer.New(VerifyTokenHandler, cache)
-	authenticator.EnableStrategy(basic.StrategyKey, basicStrategy)
+	tokenStrategy := bearer.New(a.VerifyTokenHandler, cache)
+
+	// API keys are verified on every request and not cached, so last-used tracking and revocation apply right away
+	apiKeyStrategy := token.New(a.VerifyAPIKeyHandler, store.NoCache{}, token.SetType(token.APIKey), token.SetParser(token.XHeaderParser(apiKeyHeader)))
+
+	// Track the failed basic authentication attempts to slow down and lock out password guessing
+	authenticator.EnableStrategy(basic.StrategyKey, &throttledBasicStrategy{app: a, next: basicStrategy})
 
 	// Cache the authentication decision to improve server performance
 	authenticator.EnableStrategy(bearer.CachedStrategyKey, tokenStrategy)
+
+	// Authenticate partner and kiosk integrations with API keys
+	authenticator.EnableStrategy(apiKeyStrategyKey, apiKeyStrategy)
 }
 
 // HTTP middleware to intercept the request and authenticate users before it reaches the final route
 // Checks if an access token exista and is valid. If it passes the checks, the request will proceed.
-func middleware(next http.HandlerFunc) http.HandlerFunc {
+// When roles are given, the user must hold one of them, otherwise the request is rejected with status code 403.
+// Too many failed attempts with the same username or from the same IP address are rejected with status code 429.
+// Accounts with two-factor authentication must use a bearer token, their username and password are rejected with status code 401.
+// The authenticated user is available to the handlers through 'auth.User'.
+// API keys are rejected with status code 403, unless the route is wrapped with 'scopedMiddleware'.
+func middleware(next http.HandlerFunc, allowedRoles ...string) http.HandlerFunc {
+	return authMiddleware(next, routeAuth{}, allowedRoles...)
+}
+
+// HTTP middleware that accepts the username and password of the accounts with two-factor authentication
+// Used by the routes the second factor is checked by, or that are needed to enroll
+func passwordMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(next, routeAuth{passwordOnly: true})
+}
+
+// HTTP middleware that also accepts the API keys holding the scope
+func scopedMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(next, routeAuth{scope: scope})
+}
+
+// Create a struct that holds what a route accepts besides the users holding its roles
+type routeAuth struct {
+	passwordOnly bool
+	scope        string
+}
+
+// HTTP middleware shared by 'middleware', 'passwordMiddleware', and 'scopedMiddleware'
+func authMiddleware(next http.HandlerFunc, accepts routeAuth, allowedRoles ...string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Executing Auth Middleware")
 		user, err := authenticator.Authenticate(r)
 		if err != nil {
-			code := http.StatusUnauthorized
-			http.Error(w, http.StatusText(code), code)
+			if retryAfter, ok := loginRetryAfter(err); ok {
+				setRetryAfter(w, retryAfter)
+				responseErrorHandler(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+				return
+			}
+			responseErrorHandler(w, http.StatusUnauthorized, "Invalid credentials")
 			return
 		}
 		log.Printf("User %s Authenticated\n", user.UserName())
-		next.ServeHTTP(w, r)
+
+		if userExtension(user, "apikey") != "" && (accepts.scope == "" || !hasScope(user, accepts.scope)) {
+			log.Printf("API key %s is not allowed to access %s\n", userExtension(user, "apikey"), r.URL.Path)
+			responseErrorHandler(w, http.StatusForbidden, "API key is not allowed to access this resource")
+			return
+		}
+
+		if !accepts.passwordOnly && userExtension(user, "2fa") != "" {
+			log.Printf("User %s must use a bearer token to access %s\n", user.UserName(), r.URL.Path)
+			writeProblem(w, &appError{
+				Status: http.StatusUnauthorized,
+				Code:   codeTwoFactorRequired,
+				Detail: "Two-factor authentication required, obtain a bearer token",
+			})
+			return
+		}
+
+		if len(allowedRoles) > 0 && !hasRole(user, allowedRoles...) {
+			log.Printf("User %s is not allowed to access %s\n", user.UserName(), r.URL.Path)
+			responseErrorHandler(w, http.StatusForbidden, "Not allowed to access this resource")
+			return
+		}
+
+		// Pass the authenticated user to the final route through the request context
+		next.ServeHTTP(w, auth.RequestWithUser(user, r))
 	})
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/lib/pq"
+)
+
+// Header carrying the request ID, taken from the request when the client (or a proxy) sent one
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs sent by clients are only used when they are short and plain
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Stable, machine-readable error codes
+// Clients should branch on the code, the detail is meant for humans and may change.
+const (
+	codeBadRequest              = "bad_request"
+	codeUnauthorized            = "unauthorized"
+	codeForbidden               = "forbidden"
+	codeNotFound                = "not_found"
+	codeMethodNotAllowed        = "method_not_allowed"
+	codeConflict                = "conflict"
+	codeUpgradeRequired         = "upgrade_required"
+	codeValidationFailed        = "validation_failed"
+	codeTooManyRequests         = "too_many_requests"
+	codeInternalError           = "internal_error"
+	codeUsernameTaken           = "username_taken"
+	codePizzaNotAvailable       = "pizza_not_available"
+	codeInvalidStatusTransition = "invalid_status_transition"
+	codeUnknownStatus           = "unknown_status"
+	codeTwoFactorRequired       = "two_factor_required"
+	codeIdempotencyKeyReused    = "idempotency_key_reused"
+	codeIdempotencyKeyInUse     = "idempotency_key_in_use"
+)
+
+// Default error code of each HTTP status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          codeBadRequest,
+	http.StatusUnauthorized:        codeUnauthorized,
+	http.StatusForbidden:           codeForbidden,
+	http.StatusNotFound:            codeNotFound,
+	http.StatusMethodNotAllowed:    codeMethodNotAllowed,
+	http.StatusConflict:            codeConflict,
+	http.StatusUpgradeRequired:     codeUpgradeRequired,
+	http.StatusUnprocessableEntity: codeValidationFailed,
+	http.StatusTooManyRequests:     codeTooManyRequests,
+}
+
+// Error returned by the store when an order refers to a pizza that does not exist or is no longer available
+var errPizzaNotAvailable = errors.New("Pizza is not available")
+
+// Create a struct that holds an application error, and the HTTP status it maps to
+type appError struct {
+	Status int
+	Code   string
+	Detail string
+
+	// Additional members of the problem details (e.g. the field errors of a validation failure)
+	Extensions map[string]interface{}
+}
+
+func (e *appError) Error() string {
+	return e.Detail
+}
+
+// Maps an error to an application error
+// Errors that are not known are internal errors, their details are logged and never returned.
+func toAppError(err error) *appError {
+	var ae *appError
+	var transitionErr *statusTransitionError
+	var pqErr *pq.Error
+
+	switch {
+	case errors.As(err, &ae):
+		return ae
+	case err == sql.ErrNoRows:
+		return &appError{Status: http.StatusNotFound, Code: codeNotFound, Detail: "Not found"}
+	case err == errUsernameTaken:
+		return &appError{Status: http.StatusConflict, Code: codeUsernameTaken, Detail: err.Error()}
+	case errors.Is(err, errPizzaNotAvailable):
+		return &appError{Status: http.StatusUnprocessableEntity, Code: codePizzaNotAvailable, Detail: errPizzaNotAvailable.Error()}
+	case err == errUnknownStatus:
+		return &appError{Status: http.StatusBadRequest, Code: codeUnknownStatus, Detail: err.Error()}
+	case errors.As(err, &transitionErr):
+		return &appError{
+			Status: http.StatusConflict,
+			Code:   codeInvalidStatusTransition,
+			Detail: transitionErr.Error(),
+			Extensions: map[string]interface{}{
+				"currentStatus":   transitionErr.CurrentStatus,
+				"requestedStatus": transitionErr.RequestedStatus,
+			},
+		}
+	case errors.As(err, &pqErr):
+		return pqAppError(pqErr)
+	}
+
+	if errs, ok := err.(validation.Errors); ok {
+		return &appError{
+			Status:     http.StatusUnprocessableEntity,
+			Code:       codeValidationFailed,
+			Detail:     "Validation failed",
+			Extensions: map[string]interface{}{"errors": errs},
+		}
+	}
+
+	return &appError{Status: http.StatusInternalServerError, Code: codeInternalError, Detail: err.Error()}
+}
+
+// Maps the constraint violations reported by Postgres, anything else is an internal error
+func pqAppError(err *pq.Error) *appError {
+	switch err.Code.Name() {
+	case "unique_violation":
+		if strings.Contains(strings.ToLower(err.Constraint+err.Message), "username") {
+			return &appError{Status: http.StatusConflict, Code: codeUsernameTaken, Detail: errUsernameTaken.Error()}
+		}
+		return &appError{Status: http.StatusConflict, Code: codeConflict, Detail: "Resource already exists"}
+	case "foreign_key_violation":
+		if strings.Contains(strings.ToLower(err.Constraint+err.Message), "pizza") {
+			return &appError{Status: http.StatusUnprocessableEntity, Code: codePizzaNotAvailable, Detail: errPizzaNotAvailable.Error()}
+		}
+		return &appError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Detail: "Referenced resource does not exist"}
+	}
+
+	return &appError{Status: http.StatusInternalServerError, Code: codeInternalError, Detail: err.Error()}
+}
+
+// Writes an application error as problem details (RFC 7807) in the 'application/problem+json' format
+func writeProblem(w http.ResponseWriter, e *appError) {
+	// Create a HTTP Response payload
+	payload := problemPayload(e, w.Header().Get(requestIDHeader))
+
+	// Write HTTP response
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(e.Status)
+	w.Write(response)
+}
+
+// Returns the problem details of an application error
+// Internal errors are logged along with the request ID, the client only gets the request ID to report.
+func problemPayload(e *appError, requestID string) map[string]interface{} {
+	detail := e.Detail
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("Request %s failed: %s\n", requestID, e.Detail)
+		detail = "An internal error occurred, report the request ID if the problem persists"
+	}
+
+	code := e.Code
+	if code == "" {
+		code = statusCodes[e.Status]
+	}
+	if code == "" {
+		code = codeInternalError
+	}
+
+	payload := map[string]interface{}{}
+	for k, v := range e.Extensions {
+		payload[k] = v
+	}
+	payload["type"] = "about:blank"
+	payload["title"] = http.StatusText(e.Status)
+	payload["status"] = e.Status
+	payload["detail"] = detail
+	payload["code"] = code
+	if requestID != "" {
+		payload["requestId"] = requestID
+	}
+
+	return payload
+}
+
+// HTTP middleware that assigns a request ID to every request
+// The ID is echoed in the 'X-Request-ID' response header and in the problem details of an error.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
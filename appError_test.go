@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/lib/pq"
+)
+
+func TestToAppError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, codeNotFound},
+		{"username taken", errUsernameTaken, http.StatusConflict, codeUsernameTaken},
+		{"pizza not available", fmt.Errorf("item 2: %w", errPizzaNotAvailable), http.StatusUnprocessableEntity, codePizzaNotAvailable},
+		{"unknown status", errUnknownStatus, http.StatusBadRequest, codeUnknownStatus},
+		{"status transition", &statusTransitionError{CurrentStatus: statusPickedUp, RequestedStatus: statusCanceled}, http.StatusConflict, codeInvalidStatusTransition},
+		{"wrapped status transition", fmt.Errorf("order 1: %w", &statusTransitionError{CurrentStatus: statusPickedUp, RequestedStatus: statusCanceled}), http.StatusConflict, codeInvalidStatusTransition},
+		{"validation", validation.Errors{"username": errors.New("cannot be blank")}, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"foreign key violation", &pq.Error{Code: "23503", Constraint: "orders_customerid_fkey"}, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"pizza foreign key violation", &pq.Error{Code: "23503", Constraint: "order_items_pizzaid_fkey"}, http.StatusUnprocessableEntity, codePizzaNotAvailable},
+		{"username unique violation", &pq.Error{Code: "23505", Constraint: "customers_username_key"}, http.StatusConflict, codeUsernameTaken},
+		{"unique violation", &pq.Error{Code: "23505", Constraint: "idempotency_keys_pkey"}, http.StatusConflict, codeConflict},
+		{"other Postgres error", &pq.Error{Code: "42P01", Message: `relation "ORDERS" does not exist`}, http.StatusInternalServerError, codeInternalError},
+		{"application error", &appError{Status: http.StatusForbidden, Code: codeForbidden, Detail: "Forbidden"}, http.StatusForbidden, codeForbidden},
+		{"unknown", errors.New("dial tcp 10.0.0.5:5432: connection refused"), http.StatusInternalServerError, codeInternalError},
+	}
+
+	for _, tc := range tests {
+		ae := toAppError(tc.err)
+		if ae.Status != tc.status || ae.Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tc.name, tc.status, tc.code, ae.Status, ae.Code)
+		}
+	}
+}
+
+func TestStatusTransitionErrorCarriesTheStatuses(t *testing.T) {
+	ae := toAppError(&statusTransitionError{CurrentStatus: statusPickedUp, RequestedStatus: statusCanceled})
+
+	payload := problemPayload(ae, "")
+	if payload["currentStatus"] != statusPickedUp || payload["requestedStatus"] != statusCanceled {
+		t.Errorf("expected the current and requested status, got %v", payload)
+	}
+}
+
+func TestValidationErrorCarriesTheFieldErrors(t *testing.T) {
+	err := validation.Errors{
+		"username": errors.New("cannot be blank"),
+		"items":    validation.Errors{"0": validation.Errors{"quantity": errors.New("must be no greater than 50")}},
+	}
+
+	rec := httptest.NewRecorder()
+	errorHandler(rec, err)
+
+	var problem struct {
+		Status int                    `json:"status"`
+		Errors map[string]interface{} `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	errs := flattenTestErrors("", problem.Errors, map[string]string{})
+	if problem.Status != http.StatusUnprocessableEntity || errs["username"] != "cannot be blank" || errs["items.0.quantity"] != "must be no greater than 50" {
+		t.Errorf("expected the field errors, got %s", rec.Body.Bytes())
+	}
+}
+
+func TestInternalErrorDoesNotLeakTheError(t *testing.T) {
+	for _, err := range []error{
+		errors.New("dial tcp 10.0.0.5:5432: connection refused"),
+		&pq.Error{Code: "42P01", Message: `relation "ORDERS" does not exist`},
+	} {
+		rec := httptest.NewRecorder()
+		rec.Header().Set(requestIDHeader, "test-request")
+		errorHandler(rec, err)
+
+		body := rec.Body.String()
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %d %s", rec.Code, body)
+		}
+		if strings.Contains(body, "10.0.0.5") || strings.Contains(body, "ORDERS") || strings.Contains(body, "dial tcp") {
+			t.Errorf("expected the error text to stay out of the response, got %s", body)
+		}
+		if !strings.Contains(body, `"requestId":"test-request"`) || !strings.Contains(body, codeInternalError) {
+			t.Errorf("expected the request ID and the internal error code, got %s", body)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The tests run the application on the in-memory store, signing the tokens with a generated key
+// The caches, keys, and login attempts are package variables, so every test shares the same application and test server.
+var testApp *App
+var testServer *httptest.Server
+
+// Password of the accounts created by 'newTestCustomer'
+const testPassword = "Passw0rd1"
+
+// Number of the accounts created so far, appended to the usernames so every test has its own accounts
+var testCustomers int
+
+func TestMain(m *testing.M) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+
+	// Keep the output of the tests readable
+	log.SetOutput(ioutil.Discard)
+
+	testApp = &App{Store: newMemoryStore()}
+	testApp.Initialize()
+	testServer = httptest.NewServer(testApp.Router)
+
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// Creates an account with the given role and returns its username
+func newTestCustomer(t *testing.T, role string) string {
+	t.Helper()
+
+	testCustomers++
+	userName := fmt.Sprintf("tester%d", testCustomers)
+	body := fmt.Sprintf(`{"firstName":"Test","lastName":"Customer","customerPhoneNumber":"8125984475","username":"%s","password":"%s"}`, userName, testPassword)
+	if res, b := testRequest(t, "POST", "/customer/add", "", body); res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating %s: %d %s", userName, res.StatusCode, b)
+	}
+
+	if role != roleCustomer {
+		if err := testApp.Store.SetCustomerRole(userName, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return userName
+}
+
+// Sends a request to the test server and returns the response along with its body
+// 'auth' is either a username, sent with basic authentication, or a bearer token ("Bearer ...").
+// 'header' holds pairs of header names and values.
+func testRequest(t *testing.T, method, path, auth, body string, header ...string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, testServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(auth, "Bearer ") {
+		req.Header.Set("Authorization", auth)
+	} else if auth != "" {
+		req.SetBasicAuth(auth, testPassword)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b
+}
+
+// Obtains an access token for an account and returns it as an 'Authorization' header value
+func testToken(t *testing.T, userName string) string {
+	t.Helper()
+
+	res, b := testRequest(t, "POST", "/auth/token", userName, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("token of %s: %d %s", userName, res.StatusCode, b)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+	}
+	decodeTestJSON(t, b, &payload)
+	return "Bearer " + payload.AccessToken
+}
+
+// Decodes a JSON response body
+func decodeTestJSON(t *testing.T, b []byte, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+}
+
+func TestCreateCustomerAndShowProfile(t *testing.T) {
+	userName := newTestCustomer(t, roleCustomer)
+
+	res, b := testRequest(t, "GET", "/customer/me", testToken(t, userName), "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	var c customer
+	decodeTestJSON(t, b, &c)
+	if c.Username != userName || c.CustomerPhoneNumber != "+18125984475" {
+		t.Errorf("unexpected profile %s", b)
+	}
+	if res.Header.Get(requestIDHeader) == "" {
+		t.Error("expected a request ID header")
+	}
+}
+
+func TestUnauthenticatedRequestIsRejected(t *testing.T) {
+	res, b := testRequest(t, "GET", "/customer/me", "", "")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d %s", res.StatusCode, b)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected problem details, got %q", ct)
+	}
+}
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	bearer := testToken(t, newTestCustomer(t, roleCustomer))
+	orderID := createTestOrder(t, bearer)
+
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		link   string
+	}{
+		{"GET", "/customer/me", bearer, "</v1/customers/me>"},
+		{"GET", "/pizza/show", bearer, "</v1/pizzas>"},
+		{"GET", fmt.Sprintf("/order/show/%d", orderID), bearer, fmt.Sprintf("</v1/orders/%d>", orderID)},
+		{"GET", fmt.Sprintf("/order/%d/timeline", orderID), bearer, fmt.Sprintf("</v1/orders/%d/timeline>", orderID)},
+		// A rejected request is marked too
+		{"GET", "/customer/me", "", "</v1/customers/me>"},
+	}
+
+	for _, tc := range tests {
+		res, b := testRequest(t, tc.method, tc.path, tc.auth, "")
+		if tc.auth != "" && res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: expected 200, got %d %s", tc.method, tc.path, res.StatusCode, b)
+		}
+		if res.Header.Get("Deprecation") != "true" {
+			t.Errorf("%s %s: expected the Deprecation header, got %q", tc.method, tc.path, res.Header.Get("Deprecation"))
+		}
+		if link := tc.link + `; rel="successor-version"`; res.Header.Get("Link") != link {
+			t.Errorf("%s %s: expected the Link header %s, got %q", tc.method, tc.path, link, res.Header.Get("Link"))
+		}
+	}
+
+	// The successors are not deprecated
+	res, b := testRequest(t, "GET", fmt.Sprintf("/v1/orders/%d", orderID), bearer, "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Deprecation") != "" || res.Header.Get("Link") != "" {
+		t.Errorf("expected no deprecation headers, got %d %v %s", res.StatusCode, res.Header, b)
+	}
+}
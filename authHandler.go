@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -14,73 +21,190 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Setup global RSA private key
-var privKey = rsaKeySetup()
+// Setup global keyring, loaded from DB at startup (see 'loadKeyring')
+var tokenKeys *keyring
+
+// Setup global token issuer and audience
+var tokenIssuer = getEnv("JWT_ISSUER", "auth-app")
+var tokenAudience = getEnv("JWT_AUDIENCE", "pizza-api-service")
+
+// Lifetime of an access token, a refresh token is used to obtain a new one
+const tokenLifetime = time.Minute * 15
+
+// Create a struct that holds the claims of an access token
+// The subject is the username, the id (jti) is unique per token, and the session id (sid) names
+// the login session the token was issued for
+type tokenClaims struct {
+	CustomerID string   `json:"customerId"`
+	Roles      []string `json:"roles"`
+	SessionID  string   `json:"sid,omitempty"`
+	jwt.StandardClaims
+}
 
 // CreateTokenHandler - Handler for creating a bearer token
-// Token is valid for 24 hours.
-func createTokenHandler(w http.ResponseWriter, r *http.Request) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"iss": "auth-app",
-		"sub": "medium",
-		"aud": "any",
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
+// Accounts with two-factor authentication send a one-time password, or a recovery code, in the 'X-TOTP-Code' header.
+// Starts a new login session and issues an access token along with a refresh token.
+// The access token is valid for 15 minutes and carries the username, customerId, and roles of the authenticated user.
+func (a *App) createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := auth.User(r)
+	if user == nil {
+		responseErrorHandler(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	customerID, err := strconv.Atoi(user.ID())
+	if err != nil {
+		responseErrorHandler(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	// Accounts with two-factor authentication must send a one-time password or a recovery code
+	if code, err := a.checkTwoFactor(r, user, customerID); err != nil {
+		responseErrorHandler(w, code, err.Error())
+		return
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	session := authSession{SessionID: sessionID, CustomerID: customerID, Username: user.UserName()}
+
+	// Write the session and its first refresh token to DB
+	refresh, t, err := newRefreshToken(sessionID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.Store.CreateSession(session, t); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	issueTokens(w, session, user.Groups(), refresh)
+}
+
+// Signs an access token for the session and writes it, along with the refresh token, as the HTTP response
+func issueTokens(w http.ResponseWriter, session authSession, roles []string, refresh string) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	now := time.Now()
+	key := tokenKeys.Current()
+	token := jwt.NewWithClaims(key.Method, tokenClaims{
+		CustomerID: strconv.Itoa(session.CustomerID),
+		Roles:      roles,
+		SessionID:  session.SessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			Issuer:    tokenIssuer,
+			Subject:   session.Username,
+			Audience:  tokenAudience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(tokenLifetime).Unix(),
+		},
 	})
 
-	// Sign the token with private key
-	jwtToken, _ := token.SignedString(privKey)
+	// Sign the token with private key, the key id lets verifiers pick the matching public key
+	token.Header["kid"] = key.ID
+	jwtToken, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"access_token":  jwtToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(tokenLifetime.Seconds()),
+		"refresh_token": refresh,
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Generates a random, unique token id (jti)
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
 
-	// Write to the HTTP Response
-	w.Write([]byte(jwtToken))
+	return hex.EncodeToString(b), nil
 }
 
+// Error returned for an unknown username as well as a wrong password, so the two cannot be told apart
+var errInvalidCredentials = errors.New("Invalid username or password")
+
+// Hash compared against when the username does not exist, so an unknown username takes as long as a wrong password
+var unknownUserPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
 // ValidateUserHandler - Validate user credential
 // Handler to authenticate a user given his username and password
 func (a *App) ValidateUserHandler(ctx context.Context, r *http.Request, userName, password string) (auth.Info, error) {
-	var err error
-
-	if userName == "" {
-		log.Println("Username cannot be empty")
-		return nil, fmt.Errorf("Username cannot be empty")
-	}
-	if password == "" {
-		log.Println("Password cannot be empty")
-		return nil, fmt.Errorf("Password cannot be empty")
+	if userName == "" || password == "" {
+		log.Println("Username and password cannot be empty")
+		return nil, errInvalidCredentials
 	}
 
-	// Retrieves the hashed password from the DB given the username
-	var c customer
-	c.Username = userName
-
-	// Fetch hashed password from the DB
-	if err := c.getCustomerPassword(a.DB); err != nil {
-		if err == sql.ErrNoRows {
-			log.Println("Provided username does not exist")
-			return nil, fmt.Errorf("Provided username does not exist")
-		}
+	// Fetch hashed password and role from the DB given the username
+	creds, err := a.Store.GetCustomerCredentials(userName)
+	if err != nil && err != sql.ErrNoRows {
 		log.Println(err)
 		log.Println("Issue with the DB")
 		return nil, fmt.Errorf("Issue with the DB")
 	}
+	if err == sql.ErrNoRows {
+		log.Println("Provided username does not exist")
+		bcrypt.CompareHashAndPassword(unknownUserPasswordHash, []byte(password))
+		return nil, errInvalidCredentials
+	}
 
 	// Compare the stored hashed password, with the hashed version of the password that was received
-	if err = bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(password)); err != nil {
+	if err = bcrypt.CompareHashAndPassword([]byte(creds.Password), []byte(password)); err != nil {
 		log.Println("Provided password does not match")
-		return nil, fmt.Errorf("Provided password does not match")
+		return nil, errInvalidCredentials
+	}
+
+	// Accounts with two-factor authentication are flagged, their username and password alone only obtain a token
+	var extensions map[string][]string
+	tf, err := a.Store.GetTwoFactor(creds.CustomerID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		return nil, fmt.Errorf("Issue with the DB")
+	}
+	if tf.Confirmed || tf.Required {
+		extensions = map[string][]string{"2fa": {"1"}}
 	}
 
-	return auth.NewDefaultUser(userName, "1", nil, nil), nil
+	// The role is carried as the group of the authenticated user
+	return auth.NewDefaultUser(userName, strconv.Itoa(creds.CustomerID), []string{creds.Role}, extensions), nil
 }
 
 // VerifyTokenHandler - Handler to verify the given token
-func VerifyTokenHandler(ctx context.Context, r *http.Request, tokenString string) (auth.Info, error) {
+// A token on the denylist, or issued for a session that was revoked, is rejected
+func (a *App) VerifyTokenHandler(ctx context.Context, r *http.Request, tokenString string) (auth.Info, error) {
 
-	// Parse the token string and verify the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	// Parse the token string and verify the token with the key named by its 'kid' header
+	// Expiry, issued at, and not before are checked while parsing
+	claims := &tokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := tokenKeys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("Unknown signing key: %v", token.Header["kid"])
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return privKey, nil
+		return key.PublicKey, nil
 
 	})
 
@@ -88,11 +212,76 @@ func VerifyTokenHandler(ctx context.Context, r *http.Request, tokenString string
 		return nil, err
 	}
 
-	// Authenticate the token
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		user := auth.NewDefaultUser(claims["sub"].(string), "", nil, nil)
-		return user, nil
+	// Authenticate the token, it must be issued by and for this service
+	if !token.Valid || claims.Subject == "" {
+		return nil, fmt.Errorf("Invaled token")
+	}
+	if !claims.VerifyIssuer(tokenIssuer, true) {
+		return nil, fmt.Errorf("Unexpected token issuer: %v", claims.Issuer)
+	}
+	if !claims.VerifyAudience(tokenAudience, true) {
+		return nil, fmt.Errorf("Unexpected token audience: %v", claims.Audience)
+	}
+
+	// Check that the token has not been revoked
+	if err := a.checkTokenRevocation(claims); err != nil {
+		return nil, err
+	}
+
+	// The token id, session id, and expiry are kept as extensions of the authenticated user
+	user := auth.NewDefaultUser(claims.Subject, claims.CustomerID, claims.Roles, map[string][]string{
+		"jti": {claims.Id},
+		"sid": {claims.SessionID},
+		"exp": {strconv.FormatInt(claims.ExpiresAt, 10)},
+	})
+	return user, nil
+}
+
+// Handler to rotate the key that signs the tokens (Used by admins)
+// Takes a PEM encoded private key as the request body, or generates a key of the same type when the body is empty.
+// The previous key keeps verifying the tokens it signed until they have expired.
+func rotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	var next *signingKey
+	if len(bytes.TrimSpace(body)) == 0 {
+		next, err = generateSigningKey(tokenKeys.Current())
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+	} else {
+		next, err = parseSigningKey(body)
+		if err != nil {
+			responseErrorHandler(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	previous, err := tokenKeys.Rotate(next)
+	if err == errKeyAlreadyCurrent {
+		responseErrorHandler(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s rotated the signing key %s to %s\n", authenticatedUserName(r), previous.key.ID, next.ID)
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"kid":          next.ID,
+		"alg":          next.Method.Alg(),
+		"retiredKid":   previous.key.ID,
+		"retiredUntil": previous.expiresAt(),
 	}
 
-	return nil, fmt.Errorf("Invaled token")
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
 }
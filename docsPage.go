@@ -0,0 +1,109 @@
+package main
+
+// Documentation page served at '/docs'
+// It renders the OpenAPI document at '/openapi.json' in the browser and loads nothing else, so it works offline.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Pizza API Service</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0 auto; max-width: 960px; padding: 1em; color: #222; }
+h2 { border-bottom: 1px solid #ddd; padding-bottom: .2em; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: .4em 0; }
+summary { cursor: pointer; padding: .5em; font-family: monospace; font-size: 1.05em; }
+.method { display: inline-block; width: 5em; font-weight: bold; }
+.get { color: #1f6feb; } .post { color: #1a7f37; } .put { color: #9a6700; } .patch { color: #8250df; } .delete { color: #cf222e; }
+.deprecated summary { text-decoration: line-through; color: #888; }
+.body { padding: 0 1em 1em; }
+pre { background: #f6f8fa; padding: .6em; overflow-x: auto; }
+table { border-collapse: collapse; } td, th { border: 1px solid #ddd; padding: .2em .5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1 id="title">Pizza API Service</h1>
+<p id="description"></p>
+<p><a href="/openapi.json">openapi.json</a></p>
+<div id="operations">Loading…</div>
+<script>
+(function () {
+  function el(tag, attrs, children) {
+    var e = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) { e.setAttribute(k, attrs[k]); });
+    (children || []).forEach(function (c) { e.appendChild(typeof c === "string" ? document.createTextNode(c) : c); });
+    return e;
+  }
+
+  // Inline the referenced schemas, a schema that is already being expanded is left as a reference
+  function expand(spec, schema, seen) {
+    if (!schema || typeof schema !== "object") { return schema; }
+    if (schema.$ref) {
+      var name = schema.$ref.split("/").pop();
+      if (seen.indexOf(name) >= 0) { return schema; }
+      return expand(spec, spec.components.schemas[name], seen.concat(name));
+    }
+    var out = Array.isArray(schema) ? [] : {};
+    Object.keys(schema).forEach(function (k) { out[k] = expand(spec, schema[k], seen); });
+    return out;
+  }
+
+  function schemaBlock(spec, title, schema) {
+    return el("div", {}, [el("h4", {}, [title]), el("pre", {}, [JSON.stringify(expand(spec, schema, []), null, 2)])]);
+  }
+
+  function render(spec) {
+    document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+    document.getElementById("description").textContent = spec.info.description || "";
+    var root = document.getElementById("operations");
+    root.textContent = "";
+
+    spec.tags.forEach(function (tag) {
+      root.appendChild(el("h2", {}, [tag.name]));
+      Object.keys(spec.paths).sort().forEach(function (path) {
+        Object.keys(spec.paths[path]).forEach(function (method) {
+          var op = spec.paths[path][method];
+          if (op.tags.indexOf(tag.name) < 0) { return; }
+
+          var body = el("div", { "class": "body" }, []);
+          if (op.description) { body.appendChild(el("p", {}, [op.description])); }
+          var schemes = (op.security || []).map(function (s) { return Object.keys(s)[0]; });
+          body.appendChild(el("p", {}, ["Authentication: " + (schemes.length ? schemes.join(", ") : "none")]));
+
+          if (op.parameters) {
+            var rows = [el("tr", {}, [el("th", {}, ["Name"]), el("th", {}, ["In"]), el("th", {}, ["Required"]), el("th", {}, ["Description"])])];
+            op.parameters.forEach(function (p) {
+              rows.push(el("tr", {}, [el("td", {}, [p.name]), el("td", {}, [p.in]), el("td", {}, [p.required ? "yes" : "no"]), el("td", {}, [p.description || ""])]));
+            });
+            body.appendChild(el("table", {}, rows));
+          }
+          if (op.requestBody) {
+            body.appendChild(schemaBlock(spec, "Request body", op.requestBody.content["application/json"].schema));
+          }
+          Object.keys(op.responses).forEach(function (code) {
+            var response = op.responses[code];
+            var content = response.content || {};
+            var type = Object.keys(content)[0];
+            var title = code + " " + response.description + (type ? " (" + type + ")" : "");
+            if (type && content[type].schema) {
+              body.appendChild(schemaBlock(spec, title, content[type].schema));
+            } else {
+              body.appendChild(el("h4", {}, [title]));
+            }
+          });
+
+          var summary = el("summary", {}, [el("span", { "class": "method " + method }, [method.toUpperCase()]), path + "  " + op.summary]);
+          root.appendChild(el("details", { "class": op.deprecated ? "deprecated" : "" }, [summary, body]));
+        });
+      });
+    });
+  }
+
+  fetch("/openapi.json")
+    .then(function (res) { return res.json(); })
+    .then(render)
+    .catch(function (err) { document.getElementById("operations").textContent = "Could not load /openapi.json: " + err; });
+})();
+</script>
+</body>
+</html>
+`
@@ -24,18 +24,22 @@ func (a *App) createCustomerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Validate customer phone number
-	if err := validateCustomerPhoneNumber(c); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	// Validate the customer
+	if err := validateSignup(&c); err != nil {
+		errorHandler(w, err)
 		return
 	}
 
+	// New accounts are always customers, roles are granted by an admin
+	c.Role = roleCustomer
+
 	// Salt and hash the password using the 'bcrypt' algorithm with salt of 10 rounds (bcrypt.DefaultCost)
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	c.Password = ""
 
 	// Write customer data to DB
-	if err = c.createCustomer(a.DB, string(hashedPassword)); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	if err = a.Store.CreateCustomer(&c, string(hashedPassword)); err != nil {
+		errorHandler(w, err)
 		return
 	}
 
@@ -60,18 +64,30 @@ func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Validate customer phone number
-	if err := validateCustomerPhoneNumber(o); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	// A single 'pizzaId' is an order of one pizza
+	if len(o.Items) == 0 && o.PizzaID != 0 {
+		o.Items = []orderItem{{PizzaID: o.PizzaID, Quantity: 1}}
+	}
+	o.PizzaID = 0
+
+	// Validate customer phone number and order items
+	if err := a.validateNewOrder(&o); err != nil {
+		errorHandler(w, err)
 		return
 	}
 
+	// Link the order to the authenticated customer
+	o.CustomerID = authenticatedCustomerID(r)
+
 	// Write order data to DB
-	if err := o.createOrder(a.DB); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.CreateOrder(&o); err != nil {
+		errorHandler(w, err)
 		return
 	}
 
+	// Notify the kitchen feed of the new order
+	a.Events.Publish(orderEvent{Type: orderCreatedEvent, OrderID: o.OrderID, OrderStatus: statusOrderReceived, ChangedBy: authenticatedUserName(r), ChangedAt: a.Clock()})
+
 	// Create a HTTP Response payload
 	payload := map[string]int{
 		"orderId": o.OrderID,
@@ -82,7 +98,7 @@ func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handler to fetch the order status.
-// Retrieves the order id and returns the order status.
+// Retrieves the order id and returns the order status along with the order items.
 // If order is not found, respond with status code 404, if found, return the order status.
 func (a *App) getStatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Create route variable and retrieve 'orderId' from a Request URL
@@ -93,21 +109,35 @@ func (a *App) getStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Customers may only see their own orders
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		orderStatusErrorHandler(w, err)
+		return
+	}
+
 	// Get the current order status from DB
-	var s status
-	if err := s.getStatus(a.DB, orderID); err != nil {
+	statusName, err := a.Store.GetOrderStatus(orderID)
+	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			responseErrorHandler(w, http.StatusNotFound, "Order not found")
 		default:
-			responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+			errorHandler(w, err)
 		}
 		return
 	}
 
+	// Get the order items from DB
+	items, err := a.Store.GetOrderItems(orderID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
 	// Create a HTTP Response payload
-	payload := map[string]string{
-		"orderStatus": s.StatusName,
+	payload := map[string]interface{}{
+		"orderStatus": statusName,
+		"items":       items,
 	}
 
 	// Write HTTP response
@@ -123,24 +153,59 @@ func (a *App) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
 		responseErrorHandler(w, http.StatusBadRequest, "Invalid order ID")
 		return
 	}
-	var s status
 
-	// Update a row in DB
-	if err := s.cancelOrder(a.DB, orderID); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	// Customers may only cancel their own orders
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		orderStatusErrorHandler(w, err)
+		return
+	}
+
+	// Move the order to 'Canceled' if it has not been picked up yet
+	statusName, err := a.transitionOrderStatus(orderID, statusCanceled, authenticatedUserName(r), authenticatedCustomerID(r))
+	if err != nil {
+		orderStatusErrorHandler(w, err)
 		return
 	}
 
 	// Create a HTTP Response payload
 	payload := map[string]string{
-		"orderStatus": s.StatusName,
+		"orderStatus": statusName,
 	}
 
 	// Write HTTP response
 	responseWriter(w, http.StatusOK, payload)
 }
 
-// Handler to fetch orders given the customer phone number
+// Handler to fetch the status history of an order.
+// If order is not found, respond with status code 404, if found, return the status changes, oldest first.
+func (a *App) getOrderTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'orderId' from a Request URL
+	vars := mux.Vars(r)
+	orderID, err := strconv.Atoi(vars["orderId"])
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	// Make sure the order exists, customers may only see their own orders
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		orderStatusErrorHandler(w, err)
+		return
+	}
+
+	// Get the status history from DB
+	timeline, err := a.Store.GetOrderTimeline(orderID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, timeline)
+}
+
+// Handler to fetch orders given the customer phone number in the request body (Deprecated, see 'listOrdersHandler').
+// Customers get the orders they placed with that phone number, store employees get every order.
 func (a *App) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	var o order
 	decoder := json.NewDecoder(r.Body)
@@ -152,16 +217,36 @@ func (a *App) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	a.writeOrders(w, r, o)
+}
+
+// Handler to fetch orders given the 'customerPhoneNumber' query parameter.
+// Customers get the orders they placed with that phone number, store employees get every order.
+func (a *App) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	o := order{CustomerPhoneNumber: r.URL.Query().Get("customerPhoneNumber")}
+
+	a.writeOrders(w, r, o)
+}
+
+// Writes the orders placed with the phone number of 'o' that the authenticated user may access
+func (a *App) writeOrders(w http.ResponseWriter, r *http.Request, o order) {
 	// Validate customer phone number
-	if err := validateCustomerPhoneNumber(o); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	if err := validateCustomerPhoneNumber(&o); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Customers only get the orders they placed
+	customerID, ok := orderScope(r)
+	if !ok {
+		responseErrorHandler(w, http.StatusForbidden, "Forbidden")
 		return
 	}
 
 	// Get order data from DB
-	orders, err := o.getOrders(a.DB)
+	orders, err := a.Store.GetOrders(o.CustomerPhoneNumber, customerID)
 	if err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+		errorHandler(w, err)
 		return
 	}
 
@@ -169,37 +254,54 @@ func (a *App) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	responseWriter(w, http.StatusOK, orders)
 }
 
+// Checks that the authenticated user may access an order.
+// Customers may only access the orders they placed, store employees may access every order.
+// An order placed by someone else is reported as not found, so its existence is not revealed.
+func (a *App) authorizeOrder(r *http.Request, orderID int) error {
+	customerID, ok := orderScope(r)
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	owner, err := a.Store.GetOrderCustomerID(orderID)
+	if err != nil {
+		return err
+	}
+	if customerID != 0 && owner != customerID {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
 // Handler to fetch the list of available pizzas
 func (a *App) getAvailablePizzasHandler(w http.ResponseWriter, r *http.Request) {
-	var p pizza
-
 	// Get the list of available pizzas from DB
-	orders, err := p.getAvailablePizzas(a.DB)
+	pizzas, err := a.Store.GetAvailablePizzas()
 	if err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+		errorHandler(w, err)
 		return
 	}
 
 	// Write HTTP response
-	responseWriter(w, http.StatusOK, orders)
+	responseWriter(w, http.StatusOK, pizzas)
 }
 
 // Handler to fetch the list of order status (Used by store employees)
 func (a *App) getStatusCodeHandler(w http.ResponseWriter, r *http.Request) {
-	var s status
-
 	// Get order status from DB
-	orders, err := s.getStatusCode(a.DB)
+	statuses, err := a.Store.GetStatusCodes()
 	if err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+		errorHandler(w, err)
 		return
 	}
 
 	// Write HTTP response
-	responseWriter(w, http.StatusOK, orders)
+	responseWriter(w, http.StatusOK, statuses)
 }
 
-// Handler to update an order status (Used by store employees)
+// Handler to update an order status given the 'orderId' in the request body (Used by store employees)
+// Deprecated, see 'updateOrderHandler'.
 func (a *App) updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	var o order
 	decoder := json.NewDecoder(r.Body)
@@ -211,12 +313,41 @@ func (a *App) updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Update a row in DB
-	if err := o.updateOrderStatus(a.DB); err != nil {
-		responseErrorHandler(w, http.StatusInternalServerError, err.Error())
+	a.writeOrderStatusChange(w, r, o)
+}
+
+// Handler to update the status of the order in the Request URL (Used by store employees)
+func (a *App) updateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'orderId' from a Request URL
+	orderID, err := strconv.Atoi(mux.Vars(r)["orderId"])
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid order ID")
 		return
 	}
 
+	var o order
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&o); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+	o.OrderID = orderID
+
+	a.writeOrderStatusChange(w, r, o)
+}
+
+// Moves the order 'o.OrderID' to the status code 'o.OrderStatus' and writes the new status
+func (a *App) writeOrderStatusChange(w http.ResponseWriter, r *http.Request, o order) {
+	statusName, err := a.changeOrderStatus(o, authenticatedUserName(r), authenticatedCustomerID(r))
+	if err != nil {
+		orderStatusErrorHandler(w, err)
+		return
+	}
+	o.OrderStatus = statusName
+
 	// Create a HTTP Response payload
 	payload := map[string]interface{}{
 		"orderId":     strconv.Itoa(o.OrderID),
@@ -226,3 +357,120 @@ func (a *App) updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Write HTTP response
 	responseWriter(w, http.StatusOK, payload)
 }
+
+// Moves the order 'o.OrderID' to the status code 'o.OrderStatus' on behalf of 'actor' (customer 'actorID'), and returns the new status name
+// Shared by the HTTP routes and the kitchen feed, so both validate and persist the change the same way.
+func (a *App) changeOrderStatus(o order, actor string, actorID int) (string, error) {
+	// Order status is provided as a status code
+	statusID, err := parseStatusID(o.OrderStatus)
+	if err != nil {
+		return "", err
+	}
+
+	requested, err := a.statusNameByID(statusID)
+	if err != nil {
+		return "", err
+	}
+
+	// Update a row in DB if the transition is allowed
+	return a.transitionOrderStatus(o.OrderID, requested, actor, actorID)
+}
+
+// Handler to change the role of an account (Used by admins)
+func (a *App) updateCustomerRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var c customer
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&c); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate the role
+	if err := validateCustomerRole(c); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Update a row in DB
+	if err := a.Store.SetCustomerRole(c.Username, c.Role); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// Revoke the sessions and evict the cached credentials of the account, so the old role stops applying right away
+	creds, err := a.Store.GetCustomerCredentials(c.Username)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.revokeAllSessions(r, creds.CustomerID, c.Username); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"username": c.Username,
+		"role":     c.Role,
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to retrieve the account lockouts, most recent first (Used by managers and admins)
+// Takes an optional 'username' query parameter to only retrieve the lockouts of one account
+func (a *App) getAccountLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := a.Store.GetAccountLockouts(r.URL.Query().Get("username"))
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, lockouts)
+}
+
+// Handler to unlock an account that was locked after too many failed login attempts (Used by managers and admins)
+func (a *App) unlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var c customer
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&c); err != nil || c.Username == "" {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Update the lockout in DB
+	if err := a.Store.UnlockAccount(c.Username, authenticatedUserName(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Account is not locked")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// The failed attempts are forgotten, so the account is not slowed down after the unlock
+	loginAttempts.Reset(c.Username)
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"username": c.Username,
+		"message":  "Account unlocked",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Customers must not learn anything about the orders of other customers, an order of someone else is not found
+func TestCustomerCannotAccessTheOrdersOfAnotherCustomer(t *testing.T) {
+	alice := testToken(t, newTestCustomer(t, roleCustomer))
+	bob := testToken(t, newTestCustomer(t, roleCustomer))
+	staff := testToken(t, newTestCustomer(t, roleEmployee))
+	order := createTestOrder(t, bob)
+
+	for _, path := range []string{
+		"/v1/orders/%d",
+		"/v1/orders/%d/timeline",
+		"/order/show/%d",
+		"/order/%d/timeline",
+	} {
+		path = fmt.Sprintf(path, order)
+		if res, b := testRequest(t, "GET", path, alice, ""); res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404, got %d %s", path, res.StatusCode, b)
+		}
+		if res, b := testRequest(t, "GET", path, bob, ""); res.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected the owner to get 200, got %d %s", path, res.StatusCode, b)
+		}
+		if res, b := testRequest(t, "GET", path, staff, ""); res.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected the staff to get 200, got %d %s", path, res.StatusCode, b)
+		}
+	}
+
+	// The answer is the same as for an order that does not exist
+	_, missing := testRequest(t, "GET", "/v1/orders/999999", alice, "")
+	res, b := testRequest(t, "GET", fmt.Sprintf("/v1/orders/%d", order), alice, "")
+	var problem, missingProblem struct {
+		Detail string `json:"detail"`
+	}
+	decodeTestJSON(t, b, &problem)
+	decodeTestJSON(t, missing, &missingProblem)
+	if res.StatusCode != http.StatusNotFound || problem.Detail != missingProblem.Detail {
+		t.Errorf("expected the same answer as a missing order, got %d %s and %s", res.StatusCode, b, missing)
+	}
+
+	// Nor can the order be canceled
+	for _, req := range []struct{ method, path string }{
+		{"POST", fmt.Sprintf("/v1/orders/%d/cancel", order)},
+		{"PUT", fmt.Sprintf("/order/update/%d", order)},
+	} {
+		if res, b := testRequest(t, req.method, req.path, alice, ""); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404, got %d %s", req.method, req.path, res.StatusCode, b)
+		}
+	}
+	if res, b := testRequest(t, "GET", fmt.Sprintf("/v1/orders/%d", order), bob, ""); res.StatusCode != http.StatusOK || !hasTestOrderStatus(t, b, statusOrderReceived) {
+		t.Errorf("expected the order to be left as is, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestCustomerCannotFollowTheEventsOfAnotherCustomer(t *testing.T) {
+	alice := testToken(t, newTestCustomer(t, roleCustomer))
+	bob := testToken(t, newTestCustomer(t, roleCustomer))
+	order := createTestOrder(t, bob)
+
+	res, _ := openTestEventStream(t, alice, order, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.StatusCode)
+	}
+	res, _ = openTestEventStream(t, bob, order, "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the owner to get 200, got %d", res.StatusCode)
+	}
+}
+
+// Every test customer has the same phone number, a lookup only returns the orders of the caller
+func TestPhoneLookupOnlyReturnsTheOrdersOfTheCustomer(t *testing.T) {
+	alice := testToken(t, newTestCustomer(t, roleCustomer))
+	bob := testToken(t, newTestCustomer(t, roleCustomer))
+	staff := testToken(t, newTestCustomer(t, roleEmployee))
+	own := createTestOrder(t, alice)
+	other := createTestOrder(t, bob)
+
+	lookups := []struct{ method, path, body string }{
+		{"GET", "/v1/orders?customerPhoneNumber=" + url.QueryEscape("+18125984475"), ""},
+		{"GET", "/order/show", `{"customerPhoneNumber":"8125984475"}`},
+	}
+	for _, lookup := range lookups {
+		res, b := testRequest(t, lookup.method, lookup.path, alice, lookup.body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d %s", lookup.path, res.StatusCode, b)
+		}
+		ids := testOrderIDs(t, b)
+		if !ids[own] || ids[other] {
+			t.Errorf("%s: expected only the orders of the customer, got %s", lookup.path, b)
+		}
+
+		res, b = testRequest(t, lookup.method, lookup.path, staff, lookup.body)
+		if ids := testOrderIDs(t, b); res.StatusCode != http.StatusOK || !ids[own] || !ids[other] {
+			t.Errorf("%s: expected the staff to get every order, got %d %s", lookup.path, res.StatusCode, b)
+		}
+	}
+}
+
+// Returns the ids of a list of orders
+func testOrderIDs(t *testing.T, b []byte) map[int]bool {
+	t.Helper()
+
+	var orders []order
+	decodeTestJSON(t, b, &orders)
+	ids := map[int]bool{}
+	for _, o := range orders {
+		ids[o.OrderID] = true
+	}
+	return ids
+}
+
+// Checks the status of an order response
+func hasTestOrderStatus(t *testing.T, b []byte, status string) bool {
+	t.Helper()
+
+	var payload struct {
+		OrderStatus string `json:"orderStatus"`
+	}
+	decodeTestJSON(t, b, &payload)
+	return payload.OrderStatus == status
+}
+
+// Returns an order of the authenticated customer as listed by the phone number lookup
+func findTestOrder(t *testing.T, auth string, orderID int) order {
+	t.Helper()
+
+	res, b := testRequest(t, "GET", "/v1/orders?customerPhoneNumber="+url.QueryEscape("+18125984475"), auth, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("listing the orders: %d %s", res.StatusCode, b)
+	}
+	var orders []order
+	decodeTestJSON(t, b, &orders)
+	for _, o := range orders {
+		if o.OrderID == orderID {
+			return o
+		}
+	}
+	t.Fatalf("order %d not found in %s", orderID, b)
+	return order{}
+}
+
+func TestOrderOfSeveralItemsIsTotaledWithTax(t *testing.T) {
+	bearer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	tests := []struct {
+		name  string
+		body  string
+		items []orderItem
+		total float64
+	}{
+		// 6.99 * 2 + 12.99 + 8.99 * 3 = 53.94, plus 6.25% tax
+		{"several items", `{"items":[{"pizzaId":1,"quantity":2},{"pizzaId":9,"quantity":1},{"pizzaId":5,"quantity":3}],"customerPhoneNumber":"8125984475"}`,
+			[]orderItem{{1, 2, 6.99}, {9, 1, 12.99}, {5, 3, 8.99}}, 57.31},
+		// The same pizza twice stays two items
+		{"same pizza twice", `{"items":[{"pizzaId":8,"quantity":1},{"pizzaId":8,"quantity":4}],"customerPhoneNumber":"8125984475"}`,
+			[]orderItem{{8, 1, 10.99}, {8, 4, 10.99}}, 58.38},
+		// A single 'pizzaId' is an order of one pizza
+		{"single pizzaId", `{"pizzaId":2,"customerPhoneNumber":"8125984475"}`, []orderItem{{2, 1, 7.99}}, 8.49},
+	}
+
+	for _, tc := range tests {
+		res, b := testRequest(t, "POST", "/v1/orders", bearer, tc.body)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d %s", tc.name, res.StatusCode, b)
+		}
+		var created order
+		decodeTestJSON(t, b, &created)
+
+		o := findTestOrder(t, bearer, created.OrderID)
+		if o.TotalPrice != tc.total {
+			t.Errorf("%s: expected a total of %.2f, got %.2f", tc.name, tc.total, o.TotalPrice)
+		}
+		if fmt.Sprint(o.Items) != fmt.Sprint(tc.items) {
+			t.Errorf("%s: expected the items %v, got %v", tc.name, tc.items, o.Items)
+		}
+	}
+}
+
+// Store whose menu lists a pizza that the order cannot be written with, like a pizza removed after the order was validated
+type removedPizzaStore struct {
+	Store
+}
+
+func (s removedPizzaStore) GetAvailablePizzas() ([]pizza, error) {
+	pizzas, err := s.Store.GetAvailablePizzas()
+	return append(pizzas, pizza{999, "Removed Pizza", 9.99}), err
+}
+
+// Counts the orders and order items held by the in-memory store
+func countTestOrderRows(s *memoryStore) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.orders), len(s.orderItems)
+}
+
+func TestOrderIsWrittenAtomically(t *testing.T) {
+	bearer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	// An empty order is refused before anything is written
+	memory := testApp.Store.(*memoryStore)
+	orders, items := countTestOrderRows(memory)
+	for _, body := range []string{
+		`{"items":[],"customerPhoneNumber":"8125984475"}`,
+		`{"customerPhoneNumber":"8125984475"}`,
+	} {
+		errs := testValidationErrors(t, "POST", "/v1/orders", bearer, body)
+		checkTestErrors(t, body, errs, map[string]string{"items": "cannot be blank"})
+	}
+
+	// An item that cannot be written fails the whole order, the items before it are not kept
+	testApp.Store = removedPizzaStore{Store: memory}
+	t.Cleanup(func() { testApp.Store = memory })
+	res, b := testRequest(t, "POST", "/v1/orders", bearer, `{"items":[{"pizzaId":1,"quantity":1},{"pizzaId":2,"quantity":1},{"pizzaId":999,"quantity":1}],"customerPhoneNumber":"8125984475"}`)
+	if res.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(b), codePizzaNotAvailable) {
+		t.Fatalf("expected 422 %s, got %d %s", codePizzaNotAvailable, res.StatusCode, b)
+	}
+
+	if o, i := countTestOrderRows(memory); o != orders || i != items {
+		t.Errorf("expected no order rows to be written, got %d orders and %d items more", o-orders, i-items)
+	}
+}
@@ -1,21 +1,42 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"encoding/pem"
-	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 
-	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/shaj13/go-guardian/auth"
 )
 
 // Handle error message
+// The error code is the default code of the status, the message of a server error is logged and not returned
 func responseErrorHandler(w http.ResponseWriter, code int, message string) {
-	responseWriter(w, code, map[string]string{"error": message})
+	writeProblem(w, &appError{Status: code, Detail: message})
+}
+
+// Handle an error returned by the store or a validator
+// Known errors respond with their own status and error code (e.g. 409 'username_taken'), any other error is an internal error
+func errorHandler(w http.ResponseWriter, err error) {
+	writeProblem(w, toAppError(err))
+}
+
+// Handle errors of an order status change
+// An illegal transition responds with status code 409 along with the current and requested status
+func orderStatusErrorHandler(w http.ResponseWriter, err error) {
+	writeProblem(w, orderStatusError(err))
+}
+
+// Maps the errors of an order status change to an application error, a missing order is reported as not found
+func orderStatusError(err error) *appError {
+	if err == sql.ErrNoRows {
+		return &appError{Status: http.StatusNotFound, Detail: "Order not found"}
+	}
+
+	return toAppError(err)
 }
 
 // Write HTTP response in JSON format
@@ -26,55 +47,71 @@ func responseWriter(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-// Get DB connection string from file
-func getConnString() string {
-	connString, err := ioutil.ReadFile("cstrings.config")
-	if err != nil {
-		log.Fatal(err)
+// Returns the name of the user authenticated by the middleware
+func authenticatedUserName(r *http.Request) string {
+	if user := auth.User(r); user != nil {
+		return user.UserName()
 	}
-
-	return string(connString)
+	return ""
 }
 
-// CustomerPhoneNumber cannot be empty, and must be a string consisting of ten digits
-func validateCustomerPhoneNumber(i interface{}) error {
-	// Compile the regex expression once
-	re := regexp.MustCompile("^[0-9]{10}$")
-
-	switch v := i.(type) {
-	case order:
-		return validation.ValidateStruct(&v, validation.Field(&v.CustomerPhoneNumber, validation.Required, validation.Match(re)))
-	case customer:
-		return validation.ValidateStruct(&v, validation.Field(&v.CustomerPhoneNumber, validation.Required, validation.Match(re)))
+// Returns the customerId of the user authenticated by the middleware, 0 if unknown
+func authenticatedCustomerID(r *http.Request) int {
+	user := auth.User(r)
+	if user == nil {
+		return 0
 	}
 
-	return errors.New("validateCustomerPhoneNumber: invalid type provided")
+	customerID, err := strconv.Atoi(user.ID())
+	if err != nil {
+		return 0
+	}
+	return customerID
 }
 
-// Reads a RSA key from a file/env and decodes the key
-func rsaKeySetup() []byte {
-	var priv []byte
-	var err error
+// Returns the customerId whose orders the authenticated user may access
+// Store employees may access every order (0), customers only their own orders,
+// and a user without a known customerId may not access any order (false)
+func orderScope(r *http.Request) (int, bool) {
+	if user := auth.User(r); user != nil && hasRole(user, storeRoles...) {
+		return 0, true
+	}
 
-	privString := os.Getenv("PRIVATE_KEY")
+	customerID := authenticatedCustomerID(r)
+	return customerID, customerID != 0
+}
 
-	if privString == "" {
-		log.Println("No key found on cloud env, using local key")
+// Get an environment variable, or the fallback value if it is not set
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
 
-		priv, err = ioutil.ReadFile("key/jwtRS256.key")
-		if err != nil {
-			log.Println("No RSA private key found, halting the application")
-			panic(err)
-		}
-	} else {
-		priv = []byte(privString)
+// Get DB connection string from file
+func getConnString() string {
+	connString, err := ioutil.ReadFile("cstrings.config")
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	privPem, _ := pem.Decode(priv)
-	if privPem.Type != "RSA PRIVATE KEY" {
-		log.Println("RSA private key is of the wrong type")
+	return string(connString)
+}
+
+// Converts the 'orderStatus' value of a request body to a statusId
+// JSON numbers are decoded as float64, numeric strings are accepted as well
+func parseStatusID(v interface{}) (int, error) {
+	switch id := v.(type) {
+	case float64:
+		if id == float64(int(id)) {
+			return int(id), nil
+		}
+	case string:
+		if n, err := strconv.Atoi(id); err == nil {
+			return n, nil
+		}
 	}
 
-	privPemBytes := privPem.Bytes
-	return privPemBytes
+	return 0, errUnknownStatus
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Header carrying the key that identifies a request and its retries
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Header set on a response that is replayed from a previous request
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// Idempotency keys are made of visible ASCII characters (e.g. a UUID)
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// Maximum size of a request body sent with an idempotency key
+const maxIdempotentBodySize = 1 << 20
+
+// Setup global retention window of the stored responses, retries after the window run the request again
+var idempotencyRetention = time.Hour * 24
+
+// Reads the retention window from IDEMPOTENCY_RETENTION (e.g. "24h" or "90m")
+func loadIdempotencyRetention() error {
+	retention, err := time.ParseDuration(getEnv("IDEMPOTENCY_RETENTION", "24h"))
+	if err != nil || retention <= 0 {
+		return fmt.Errorf("IDEMPOTENCY_RETENTION %q must be a positive duration (e.g. \"24h\")", getEnv("IDEMPOTENCY_RETENTION", ""))
+	}
+
+	idempotencyRetention = retention
+	return nil
+}
+
+// Create a struct that captures the response of a request, so it can be stored along with the idempotency key
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	rr.statusCode = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.statusCode == 0 {
+		rr.statusCode = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// HTTP middleware that makes a request safe to retry with an 'Idempotency-Key' header
+// The first response is stored along with a fingerprint of the request and replayed on retries within the
+// retention window. A key reused with a different request is rejected with 422, and a retry sent while
+// the first request is still in progress is rejected with 409.
+// Keys are scoped to the route and the authenticated customer, server errors are not stored so they can be retried.
+// Anonymous requests (e.g. a signup) are refused with 400, they have no customer to scope the key to.
+func (a *App) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !idempotencyKeyPattern.MatchString(key) {
+			responseErrorHandler(w, http.StatusBadRequest, "Idempotency-Key must be 1 to 255 visible ASCII characters")
+			return
+		}
+		customerID := authenticatedCustomerID(r)
+		if customerID == 0 {
+			responseErrorHandler(w, http.StatusBadRequest, "Idempotency-Key is only accepted on authenticated requests")
+			return
+		}
+
+		// Read the HTTP Body Data, and hand it over to the handler
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		now := a.Clock()
+		rec := idempotencyRecord{
+			Scope:       fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, customerID),
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+			CustomerID:  customerID,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(idempotencyRetention),
+		}
+
+		reserved, err := a.Store.ReserveIdempotencyKey(rec)
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+		if !reserved {
+			a.replayIdempotentResponse(w, rec)
+			return
+		}
+
+		// The key is released unless the response is stored, a retry then runs the request again
+		completed := false
+		defer func() {
+			if !completed {
+				if err := a.Store.ReleaseIdempotencyKey(rec.Scope, rec.Key); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r)
+
+		if rr.statusCode == 0 || rr.statusCode >= http.StatusInternalServerError {
+			return
+		}
+
+		if err := a.Store.CompleteIdempotencyKey(rec.Scope, rec.Key, rr.statusCode, rr.Header().Get("Content-Type"), rr.body.Bytes()); err != nil {
+			log.Println(err)
+			return
+		}
+		completed = true
+	}
+}
+
+// Writes the stored response of an idempotency key, if the retry matches the first request
+func (a *App) replayIdempotentResponse(w http.ResponseWriter, rec idempotencyRecord) {
+	stored, err := a.Store.GetIdempotencyRecord(rec.Scope, rec.Key, rec.CreatedAt)
+	if err != nil {
+		// The first request failed and released the key in the meantime
+		writeProblem(w, &appError{Status: http.StatusConflict, Code: codeIdempotencyKeyInUse, Detail: "Request with this Idempotency-Key is being processed, retry later"})
+		return
+	}
+
+	switch {
+	case stored.Fingerprint != rec.Fingerprint:
+		writeProblem(w, &appError{Status: http.StatusUnprocessableEntity, Code: codeIdempotencyKeyReused, Detail: "Idempotency-Key was already used with a different request"})
+	case stored.StatusCode == 0:
+		writeProblem(w, &appError{Status: http.StatusConflict, Code: codeIdempotencyKeyInUse, Detail: "Request with this Idempotency-Key is being processed, retry later"})
+	default:
+		// Write the stored HTTP response
+		if stored.ContentType != "" {
+			w.Header().Set("Content-Type", stored.ContentType)
+		}
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(stored.StatusCode)
+		w.Write(stored.Body)
+	}
+}
+
+// Returns the SHA-256 hash of the method, path, and body of a request
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Body of the orders placed by the idempotency tests
+const idempotentOrderBody = `{"items":[{"pizzaId":3,"quantity":1}],"customerPhoneNumber":"8125984475"}`
+
+// Places an order with an idempotency key and returns the response along with the orderId
+func createIdempotentOrder(t *testing.T, auth, key, body string) (*http.Response, order) {
+	t.Helper()
+
+	res, b := testRequest(t, "POST", "/v1/orders", auth, body, idempotencyKeyHeader, key)
+	var o order
+	if res.StatusCode == http.StatusCreated {
+		decodeTestJSON(t, b, &o)
+	}
+	return res, o
+}
+
+func TestIdempotentRequestIsReplayed(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	first, o := createIdempotentOrder(t, customer, "order-1", idempotentOrderBody)
+	if first.StatusCode != http.StatusCreated || first.Header.Get(idempotentReplayedHeader) != "" {
+		t.Fatalf("expected a new order, got %d %v", first.StatusCode, first.Header)
+	}
+
+	retry, replayed := createIdempotentOrder(t, customer, "order-1", idempotentOrderBody)
+	if retry.StatusCode != http.StatusCreated || retry.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("expected the response to be replayed, got %d %v", retry.StatusCode, retry.Header)
+	}
+	if replayed.OrderID != o.OrderID {
+		t.Errorf("expected order %d to be replayed, got %d", o.OrderID, replayed.OrderID)
+	}
+
+	// Another key places a new order
+	if _, other := createIdempotentOrder(t, customer, "order-2", idempotentOrderBody); other.OrderID == o.OrderID {
+		t.Errorf("expected another key to place a new order")
+	}
+}
+
+func TestIdempotencyKeyReusedWithAnotherRequest(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	if res, _ := createIdempotentOrder(t, customer, "order-1", idempotentOrderBody); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.StatusCode)
+	}
+
+	res, b := testRequest(t, "POST", "/v1/orders", customer, `{"items":[{"pizzaId":1,"quantity":5}],"customerPhoneNumber":"8125984475"}`, idempotencyKeyHeader, "order-1")
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d %s", res.StatusCode, b)
+	}
+	var problem map[string]interface{}
+	decodeTestJSON(t, b, &problem)
+	if problem["code"] != codeIdempotencyKeyReused {
+		t.Errorf("expected %s, got %v", codeIdempotencyKeyReused, problem)
+	}
+
+	if res, b := testRequest(t, "POST", "/v1/orders", customer, idempotentOrderBody, idempotencyKeyHeader, "not ascii ✓"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid key, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestIdempotencyKeysAreScopedToTheCustomer(t *testing.T) {
+	alice := testToken(t, newTestCustomer(t, roleCustomer))
+	bob := testToken(t, newTestCustomer(t, roleCustomer))
+
+	_, aliceOrder := createIdempotentOrder(t, alice, "shared-key", idempotentOrderBody)
+	res, bobOrder := createIdempotentOrder(t, bob, "shared-key", idempotentOrderBody)
+	if res.StatusCode != http.StatusCreated || res.Header.Get(idempotentReplayedHeader) != "" {
+		t.Fatalf("expected a new order for another customer, got %d %v", res.StatusCode, res.Header)
+	}
+	if bobOrder.OrderID == aliceOrder.OrderID {
+		t.Errorf("expected the order of another customer not to be replayed")
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	now := time.Now()
+	setTestClock(t, now)
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	_, o := createIdempotentOrder(t, customer, "order-1", idempotentOrderBody)
+
+	setTestClock(t, now.Add(idempotencyRetention+time.Minute))
+	res, again := createIdempotentOrder(t, customer, "order-1", idempotentOrderBody)
+	if res.StatusCode != http.StatusCreated || res.Header.Get(idempotentReplayedHeader) != "" || again.OrderID == o.OrderID {
+		t.Fatalf("expected a new order after the retention window, got %d %v", res.StatusCode, res.Header)
+	}
+}
+
+// Anonymous clients would share one key space, and could be replayed the signup of someone else
+func TestIdempotencyKeyIsRefusedOnAnonymousRequests(t *testing.T) {
+	testCustomers++
+	userName := fmt.Sprintf("tester%d", testCustomers)
+	body := fmt.Sprintf(`{"firstName":"Test","lastName":"Customer","customerPhoneNumber":"8125984475","username":"%s","password":"%s"}`, userName, testPassword)
+
+	for _, path := range []string{"/v1/customers", "/customer/add"} {
+		if res, b := testRequest(t, "POST", path, "", body, idempotencyKeyHeader, "signup-1"); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 on %s, got %d %s", path, res.StatusCode, b)
+		}
+	}
+	if _, err := testApp.Store.GetCustomerCredentials(userName); err == nil {
+		t.Errorf("expected no account to be created")
+	}
+}
+
+// The stored responses hold personal data, they are erased along with the customer
+func TestErasureDeletesTheStoredResponses(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	userName := newTestCustomer(t, roleCustomer)
+	creds, err := testApp.Store.GetCustomerCredentials(userName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createIdempotentOrder(t, testToken(t, userName), "order-1", idempotentOrderBody)
+
+	scope := fmt.Sprintf("POST /v1/orders %d", creds.CustomerID)
+	if _, err := testApp.Store.GetIdempotencyRecord(scope, "order-1", time.Now()); err != nil {
+		t.Fatalf("expected the response to be stored: %v", err)
+	}
+
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/customers/%d/erase", creds.CustomerID), admin, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	if _, err := testApp.Store.GetIdempotencyRecord(scope, "order-1", time.Now()); err == nil {
+		t.Errorf("expected the response to be erased")
+	}
+}
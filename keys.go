@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Create a struct that holds a key used to sign and verify tokens
+// RSA keys sign with RS256, ECDSA P-256 keys sign with ES256
+type signingKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+}
+
+// Create a struct that holds the signing keys
+// The current key signs new tokens, retired keys keep verifying the tokens they signed
+// until the longest token lifetime has passed since they were retired.
+// The keys are stored in DB, so they survive a restart and every instance signs and verifies with the same keys.
+// Each instance reloads them periodically, and right away when a token names a key it does not hold.
+// The private keys are encrypted in DB with a key that is never stored there (see 'loadKeyEncryptionKey').
+type keyring struct {
+	mu       sync.RWMutex
+	store    Store
+	aead     cipher.AEAD
+	current  *signingKey
+	retired  []retiredKey
+	loadedAt time.Time
+}
+
+// How often the keys are reloaded from DB, to pick up a rotation made by another instance
+const keyringReloadInterval = time.Minute
+
+// Minimum time between two reloads caused by an unknown key id, so unknown ids cannot flood the DB
+const keyringMissReloadInterval = time.Second * 5
+
+// Create a struct that holds a key that no longer signs tokens
+type retiredKey struct {
+	key       *signingKey
+	retiredAt time.Time
+}
+
+// Create a struct that holds a public key in JSON Web Key format (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Reads the private key from a file/env and parses it
+// The key is read from PRIVATE_KEY, or from the file at PRIVATE_KEY_FILE (default 'key/jwtRS256.key')
+func loadSigningKey() *signingKey {
+	var priv []byte
+	var err error
+
+	privString := os.Getenv("PRIVATE_KEY")
+
+	if privString == "" {
+		log.Println("No key found on cloud env, using local key")
+
+		priv, err = ioutil.ReadFile(getEnv("PRIVATE_KEY_FILE", "key/jwtRS256.key"))
+		if err != nil {
+			log.Println("No private key found, halting the application")
+			panic(err)
+		}
+	} else {
+		priv = []byte(privString)
+	}
+
+	key, err := parseSigningKey(priv)
+	if err != nil {
+		log.Println("Private key cannot be used to sign tokens, halting the application")
+		panic(err)
+	}
+
+	return key
+}
+
+// Reads the key that encrypts the signing keys stored in DB
+// The key is read from SIGNING_KEY_ENCRYPTION_KEY as 32 base64 encoded bytes (AES-256-GCM), it is required
+// so the private keys are never stored in plaintext.
+func loadKeyEncryptionKey() (cipher.AEAD, error) {
+	encoded := os.Getenv("SIGNING_KEY_ENCRYPTION_KEY")
+	if encoded == "" {
+		return nil, errors.New("SIGNING_KEY_ENCRYPTION_KEY is not set, it must hold 32 base64 encoded bytes")
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New("SIGNING_KEY_ENCRYPTION_KEY must hold 32 base64 encoded bytes")
+	}
+
+	return newKeyEncryption(secret)
+}
+
+// Creates the cipher that encrypts the signing keys given a 32 bytes secret
+func newKeyEncryption(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Loads the keyring from DB
+// The configured key (see 'loadSigningKey') becomes the current key on the first start, and whenever it changes
+// to a key the keyring has never held. A configured key that was rotated away with 'POST /auth/keys/rotate'
+// does not come back on restart, the rotation is kept and logged.
+func loadKeyring(store Store, configured *signingKey, aead cipher.AEAD) (*keyring, error) {
+	kr := &keyring{store: store, aead: aead}
+
+	now := time.Now()
+	records, err := store.GetSigningKeys(now.Add(-tokenLifetime))
+	if err != nil {
+		return nil, err
+	}
+	currentID := ""
+	for _, rec := range records {
+		if rec.RetiredAt == nil {
+			currentID = rec.KeyID
+		}
+	}
+
+	switch currentID {
+	case "":
+		log.Printf("No signing key is stored, key %s becomes the current key\n", configured.ID)
+		if err := kr.storeRotation(configured, now); err != nil {
+			return nil, err
+		}
+	case configured.ID:
+	default:
+		known, err := store.SigningKeyExists(configured.ID)
+		if err != nil {
+			return nil, err
+		}
+		if known {
+			log.Printf("PRIVATE_KEY holds key %s, which was rotated away, key %s keeps signing the tokens\n", configured.ID, currentID)
+			break
+		}
+		log.Printf("PRIVATE_KEY changed, rotating the signing key %s to %s\n", currentID, configured.ID)
+		if err := kr.storeRotation(configured, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := kr.reload(now); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Returns the key that signs new tokens
+func (kr *keyring) Current() *signingKey {
+	kr.reloadIfOlder(keyringReloadInterval)
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return kr.current
+}
+
+// Finds the key that verifies a token given the key id (kid)
+// Retired keys are found until they expire. An unknown key id reloads the keys, it may come from a rotation
+// made by another instance.
+func (kr *keyring) Lookup(kid string) (*signingKey, bool) {
+	kr.reloadIfOlder(keyringReloadInterval)
+	if key, ok := kr.find(kid); ok {
+		return key, true
+	}
+
+	kr.reloadIfOlder(keyringMissReloadInterval)
+	return kr.find(kid)
+}
+
+// Finds a key that has not expired given the key id
+func (kr *keyring) find(kid string) (*signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	if kr.current.ID == kid {
+		return kr.current, true
+	}
+	for _, rk := range kr.activeRetired(time.Now()) {
+		if rk.key.ID == kid {
+			return rk.key, true
+		}
+	}
+
+	return nil, false
+}
+
+// Error returned when rotating to the key that already signs the tokens
+var errKeyAlreadyCurrent = errors.New("the new key is already the current key")
+
+// Makes the given key the current one and retires the previous current key
+// Expired retired keys lose their private key, the rotation is stored in DB so every instance picks it up
+func (kr *keyring) Rotate(next *signingKey) (retiredKey, error) {
+	now := time.Now()
+	if err := kr.reload(now); err != nil {
+		return retiredKey{}, err
+	}
+
+	kr.mu.RLock()
+	previous := retiredKey{key: kr.current, retiredAt: now}
+	kr.mu.RUnlock()
+	if next.ID == previous.key.ID {
+		return retiredKey{}, errKeyAlreadyCurrent
+	}
+
+	if err := kr.storeRotation(next, now); err != nil {
+		return retiredKey{}, err
+	}
+	if err := kr.reload(now); err != nil {
+		return retiredKey{}, err
+	}
+
+	return previous, nil
+}
+
+// Stores a key as the current one in DB
+func (kr *keyring) storeRotation(next *signingKey, now time.Time) error {
+	encrypted, err := kr.encrypt(next)
+	if err != nil {
+		return err
+	}
+
+	rec := signingKeyRecord{
+		KeyID:               next.ID,
+		EncryptedPrivateKey: encrypted,
+		CreatedAt:           now,
+	}
+	return kr.store.RotateSigningKey(rec, now, now.Add(-tokenLifetime))
+}
+
+// Encrypts the private key (PKCS #8) with a random nonce, which is prepended to the ciphertext
+// The key id is authenticated along with the key, so a stored key cannot be swapped with another.
+func (kr *keyring) encrypt(key *signingKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, kr.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return kr.aead.Seal(nonce, nonce, der, []byte(key.ID)), nil
+}
+
+// Decrypts a stored private key and checks that it is the key named by the record
+func (kr *keyring) decrypt(rec signingKeyRecord) (*signingKey, error) {
+	size := kr.aead.NonceSize()
+	if len(rec.EncryptedPrivateKey) < size {
+		return nil, errors.New("private key is missing")
+	}
+
+	der, err := kr.aead.Open(nil, rec.EncryptedPrivateKey[:size], rec.EncryptedPrivateKey[size:], []byte(rec.KeyID))
+	if err != nil {
+		return nil, errors.New("private key cannot be decrypted, check SIGNING_KEY_ENCRYPTION_KEY")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID != rec.KeyID {
+		return nil, errors.New("private key does not match the key id")
+	}
+	return key, nil
+}
+
+// Reloads the keys from DB when they were loaded longer than 'interval' ago
+// A failed reload is logged and the keys held so far are kept.
+func (kr *keyring) reloadIfOlder(interval time.Duration) {
+	kr.mu.RLock()
+	stale := time.Since(kr.loadedAt) > interval
+	kr.mu.RUnlock()
+
+	if stale {
+		if err := kr.reload(time.Now()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Replaces the keys held by the keys stored in DB
+func (kr *keyring) reload(now time.Time) error {
+	records, err := kr.store.GetSigningKeys(now.Add(-tokenLifetime))
+	if err != nil {
+		return err
+	}
+
+	var current *signingKey
+	retired := []retiredKey{}
+	for _, rec := range records {
+		key, err := kr.decrypt(rec)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %v", rec.KeyID, err)
+		}
+		if rec.RetiredAt == nil {
+			current = key
+		} else {
+			retired = append(retired, retiredKey{key: key, retiredAt: *rec.RetiredAt})
+		}
+	}
+	if current == nil {
+		return errors.New("no current signing key is stored")
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	kr.current = current
+	kr.retired = retired
+	kr.loadedAt = now
+	return nil
+}
+
+// Returns the public keys of the current and the retired keys that have not expired
+func (kr *keyring) PublicKeys() []jwk {
+	kr.reloadIfOlder(keyringReloadInterval)
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	keys := []jwk{kr.current.jwk()}
+	for _, rk := range kr.activeRetired(time.Now()) {
+		keys = append(keys, rk.key.jwk())
+	}
+
+	return keys
+}
+
+// Returns the retired keys that may still verify tokens, the caller must hold the lock
+func (kr *keyring) activeRetired(now time.Time) []retiredKey {
+	active := []retiredKey{}
+	for _, rk := range kr.retired {
+		if now.Before(rk.expiresAt()) {
+			active = append(active, rk)
+		}
+	}
+
+	return active
+}
+
+// Every token signed by a retired key has expired after the longest token lifetime
+func (rk retiredKey) expiresAt() time.Time {
+	return rk.retiredAt.Add(tokenLifetime)
+}
+
+// Generates a new private key of the same type as the given key
+func generateSigningKey(like *signingKey) (*signingKey, error) {
+	var priv interface{}
+	var err error
+
+	switch like.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(priv)
+}
+
+// Decodes a PEM encoded RSA or ECDSA private key (PKCS #1, SEC 1, or PKCS #8)
+func parseSigningKey(privPEM []byte) (*signingKey, error) {
+	block, _ := pem.Decode(privPEM)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	var priv interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("private key is of the wrong type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(priv)
+}
+
+// Creates a signing key from a parsed private key, the key id is its JWK thumbprint
+func newSigningKey(priv interface{}) (*signingKey, error) {
+	key := &signingKey{PrivateKey: priv}
+
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA private key must be at least 2048 bits")
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.PublicKey = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA private key must use the P-256 curve")
+		}
+		key.Method = jwt.SigningMethodES256
+		key.PublicKey = &k.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+
+	key.ID = key.jwk().thumbprint()
+	return key, nil
+}
+
+// Returns the public key in JSON Web Key format
+func (k *signingKey) jwk() jwk {
+	key := jwk{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+
+	switch pub := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key.Kty = "EC"
+		key.Crv = "P-256"
+		key.X = base64.RawURLEncoding.EncodeToString(padCoordinate(pub.X.Bytes(), 32))
+		key.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(pub.Y.Bytes(), 32))
+	}
+
+	return key
+}
+
+// Computes the JWK thumbprint (RFC 7638), used as the key id
+// Only the required members are hashed, in lexicographic order
+func (k jwk) thumbprint() string {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Crv, k.X, k.Y)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Left pads an elliptic curve coordinate to the size of the curve
+func padCoordinate(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// Handler to publish the public keys used to verify tokens (JWKS)
+// Other services can verify customer tokens offline with these keys
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	payload := map[string][]jwk{
+		"keys": tokenKeys.PublicKeys(),
+	}
+
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Generates an ECDSA P-256 signing key, faster to generate than an RSA key
+func newTestSigningKey(t *testing.T) *signingKey {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newSigningKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Loads a keyring on its own in-memory store, encrypted with the key of the test application
+func newTestKeyring(t *testing.T, s *memoryStore, configured *signingKey) *keyring {
+	t.Helper()
+
+	aead, err := loadKeyEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := loadKeyring(s, configured, aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// Makes the application sign and verify the tokens with the given keyring until the test ends
+func useTestKeyring(t *testing.T, kr *keyring) {
+	previous := tokenKeys
+	t.Cleanup(func() { tokenKeys = previous })
+	tokenKeys = kr
+}
+
+// Moves the retirement of a stored key, as if it had been retired at 'retiredAt'
+func setTestKeyRetirement(t *testing.T, s *memoryStore, kid string, retiredAt time.Time) {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.signingKeys {
+		if s.signingKeys[i].KeyID == kid {
+			s.signingKeys[i].RetiredAt = &retiredAt
+			return
+		}
+	}
+	t.Fatalf("no signing key %s", kid)
+}
+
+// Returns the PKCS #8 PEM encoding of a signing key, as sent to the rotation endpoint
+func testKeyPEM(t *testing.T, key *signingKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestRetiredKeyVerifiesUntilTokenLifetime(t *testing.T) {
+	s := newMemoryStore()
+	retired := newTestSigningKey(t)
+	kr := newTestKeyring(t, s, retired)
+	useTestKeyring(t, kr)
+
+	token := strings.TrimPrefix(testToken(t, newTestCustomer(t, roleCustomer)), "Bearer ")
+	if _, err := kr.Rotate(newTestSigningKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is verified directly, the bearer strategy would answer from its cache
+	for _, tc := range []struct {
+		name      string
+		retiredAt time.Time
+		valid     bool
+	}{
+		{"just retired", time.Now(), true},
+		{"before the token lifetime", time.Now().Add(-tokenLifetime + time.Minute), true},
+		{"after the token lifetime", time.Now().Add(-tokenLifetime - time.Second), false},
+	} {
+		setTestKeyRetirement(t, s, retired.ID, tc.retiredAt)
+		if err := kr.reload(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := testApp.VerifyTokenHandler(context.Background(), nil, token)
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected the token to verify, got %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected the token to be rejected", tc.name)
+		}
+
+		_, published := kr.find(retired.ID)
+		if published != tc.valid {
+			t.Errorf("%s: expected the retired key to be held %v, got %v", tc.name, tc.valid, published)
+		}
+	}
+}
+
+func TestUnknownKeyIDIsRejected(t *testing.T) {
+	token := strings.TrimPrefix(testToken(t, newTestCustomer(t, roleCustomer)), "Bearer ")
+
+	// Sign the same claims with a key that the keyring does not hold
+	claims := &tokenClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		t.Fatal(err)
+	}
+	foreign := newTestSigningKey(t)
+	for name, kid := range map[string]string{
+		"unknown kid": foreign.ID,
+		"current kid": tokenKeys.Current().ID,
+		"missing kid": "",
+	} {
+		forged := jwt.NewWithClaims(foreign.Method, claims)
+		if kid != "" {
+			forged.Header["kid"] = kid
+		}
+		signed, err := forged.SignedString(foreign.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := testApp.VerifyTokenHandler(context.Background(), nil, signed); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+		if res, b := testRequest(t, "GET", "/customer/me", "Bearer "+signed, ""); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d %s", name, res.StatusCode, b)
+		}
+	}
+}
+
+func TestWrongAudienceOrIssuerIsRejected(t *testing.T) {
+	token := strings.TrimPrefix(testToken(t, newTestCustomer(t, roleCustomer)), "Bearer ")
+	key := tokenKeys.Current()
+
+	tests := []struct {
+		name     string
+		issuer   string
+		audience string
+		valid    bool
+	}{
+		{"issued by and for this service", tokenIssuer, tokenAudience, true},
+		{"wrong audience", tokenIssuer, "another-service", false},
+		{"missing audience", tokenIssuer, "", false},
+		{"wrong issuer", "another-issuer", tokenAudience, false},
+		{"missing issuer", "", tokenAudience, false},
+	}
+
+	for _, tc := range tests {
+		// Sign the claims with the current key, so only the issuer and audience are wrong
+		claims := &tokenClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+			t.Fatal(err)
+		}
+		claims.Issuer, claims.Audience = tc.issuer, tc.audience
+		forged := jwt.NewWithClaims(key.Method, claims)
+		forged.Header["kid"] = key.ID
+		signed, err := forged.SignedString(key.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := testApp.VerifyTokenHandler(context.Background(), nil, signed); (err == nil) != tc.valid {
+			t.Errorf("%s: expected the token to be valid %v, got %v", tc.name, tc.valid, err)
+		}
+		want := http.StatusUnauthorized
+		if tc.valid {
+			want = http.StatusOK
+		}
+		if res, b := testRequest(t, "GET", "/customer/me", "Bearer "+signed, ""); res.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, want, res.StatusCode, b)
+		}
+	}
+}
+
+func TestRotatingToTheCurrentKeyConflicts(t *testing.T) {
+	s := newMemoryStore()
+	current := newTestSigningKey(t)
+	useTestKeyring(t, newTestKeyring(t, s, current))
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+
+	res, b := testRequest(t, "POST", "/auth/keys/rotate", admin, testKeyPEM(t, current))
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d %s", res.StatusCode, b)
+	}
+	if tokenKeys.Current().ID != current.ID || len(s.signingKeys) != 1 {
+		t.Errorf("expected the keyring to be left as is, got %d keys", len(s.signingKeys))
+	}
+
+	// A new key rotates, and the admin token signed by the previous key keeps working
+	next := newTestSigningKey(t)
+	res, b = testRequest(t, "POST", "/auth/keys/rotate", admin, testKeyPEM(t, next))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	var rotation struct {
+		Kid        string `json:"kid"`
+		RetiredKid string `json:"retiredKid"`
+	}
+	decodeTestJSON(t, b, &rotation)
+	if rotation.Kid != next.ID || rotation.RetiredKid != current.ID {
+		t.Errorf("unexpected rotation %s", b)
+	}
+	if _, err := testApp.VerifyTokenHandler(context.Background(), nil, strings.TrimPrefix(admin, "Bearer ")); err != nil {
+		t.Errorf("expected the token of the retired key to verify, got %v", err)
+	}
+}
+
+func TestChangedPrivateKeyRotatesAtStartup(t *testing.T) {
+	s := newMemoryStore()
+	first := newTestSigningKey(t)
+	newTestKeyring(t, s, first)
+
+	// A key the keyring has never held becomes the current key
+	second := newTestSigningKey(t)
+	kr := newTestKeyring(t, s, second)
+	if kr.Current().ID != second.ID {
+		t.Errorf("expected the changed key to be current, got %s", kr.Current().ID)
+	}
+	if _, ok := kr.find(first.ID); !ok {
+		t.Error("expected the previous key to keep verifying")
+	}
+
+	// A key that was rotated away does not come back, even once it has expired
+	third := newTestSigningKey(t)
+	if _, err := kr.Rotate(third); err != nil {
+		t.Fatal(err)
+	}
+	setTestKeyRetirement(t, s, first.ID, time.Now().Add(-tokenLifetime-time.Minute))
+	if _, err := kr.Rotate(newTestSigningKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	current := kr.Current().ID
+	for _, configured := range []*signingKey{first, second} {
+		if kr := newTestKeyring(t, s, configured); kr.Current().ID != current {
+			t.Errorf("expected %s to keep signing, got %s", current, kr.Current().ID)
+		}
+	}
+}
+
+func TestSigningKeysAreEncryptedAtRest(t *testing.T) {
+	s := newMemoryStore()
+	key := newTestSigningKey(t)
+	kr := newTestKeyring(t, s, key)
+	if _, err := kr.Rotate(newTestSigningKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scalar := key.PrivateKey.(*ecdsa.PrivateKey).D.Bytes()
+	for _, rec := range s.signingKeys {
+		if len(rec.EncryptedPrivateKey) == 0 {
+			t.Fatalf("expected the private key of %s to be stored", rec.KeyID)
+		}
+		if bytes.Contains(rec.EncryptedPrivateKey, der) || bytes.Contains(rec.EncryptedPrivateKey, scalar) || bytes.Contains(rec.EncryptedPrivateKey, []byte("PRIVATE KEY")) {
+			t.Errorf("expected the private key of %s to be encrypted", rec.KeyID)
+		}
+	}
+
+	// Another encryption key cannot read the keys
+	other, err := newKeyEncryption(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyring(s, key, other); err == nil {
+		t.Error("expected the keys to be unreadable with another encryption key")
+	}
+
+	// A stored key cannot be swapped under another key id
+	s.signingKeys[0].EncryptedPrivateKey, s.signingKeys[1].EncryptedPrivateKey = s.signingKeys[1].EncryptedPrivateKey, s.signingKeys[0].EncryptedPrivateKey
+	if err := kr.reload(time.Now()); err == nil {
+		t.Error("expected swapped keys to be rejected")
+	}
+
+	// Expired keys lose their private key
+	setTestKeyRetirement(t, s, key.ID, time.Now().Add(-tokenLifetime-time.Minute))
+	s.signingKeys[0].EncryptedPrivateKey, s.signingKeys[1].EncryptedPrivateKey = s.signingKeys[1].EncryptedPrivateKey, s.signingKeys[0].EncryptedPrivateKey
+	if _, err := kr.Rotate(newTestSigningKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range s.signingKeys {
+		if rec.KeyID == key.ID && rec.EncryptedPrivateKey != nil {
+			t.Error("expected the expired private key to be erased")
+		}
+	}
+	if known, _ := s.SigningKeyExists(key.ID); !known {
+		t.Error("expected the expired key id to be kept")
+	}
+}
+
+func TestKeyEncryptionKeyIsRequired(t *testing.T) {
+	previous := os.Getenv("SIGNING_KEY_ENCRYPTION_KEY")
+	t.Cleanup(func() { os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", previous) })
+
+	for _, value := range []string{"", "not base64", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", value)
+		if _, err := loadKeyEncryptionKey(); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+// Fetches the published key set and returns the keys by key id
+func fetchTestJWKS(t *testing.T) map[string]jwk {
+	t.Helper()
+
+	res, b := testRequest(t, "GET", "/.well-known/jwks.json", "", "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/jwk-set+json" {
+		t.Fatalf("expected the key set, got %d %s", res.StatusCode, b)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	decodeTestJSON(t, b, &set)
+
+	keys := map[string]jwk{}
+	for _, k := range set.Keys {
+		keys[k.Kid] = k
+	}
+	return keys
+}
+
+func TestJWKSListsTheCurrentAndUnexpiredRetiredKeys(t *testing.T) {
+	s := newMemoryStore()
+	rsaKey := loadSigningKey()
+	kr := newTestKeyring(t, s, rsaKey)
+	useTestKeyring(t, kr)
+
+	ecKey := newTestSigningKey(t)
+	if _, err := kr.Rotate(ecKey); err != nil {
+		t.Fatal(err)
+	}
+	expired := newTestSigningKey(t)
+	if _, err := kr.Rotate(expired); err != nil {
+		t.Fatal(err)
+	}
+	current := newTestSigningKey(t)
+	if _, err := kr.Rotate(current); err != nil {
+		t.Fatal(err)
+	}
+	setTestKeyRetirement(t, s, expired.ID, time.Now().Add(-tokenLifetime-time.Second))
+	if err := kr.reload(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := fetchTestJWKS(t)
+	if len(keys) != 3 {
+		t.Errorf("expected the current and two retired keys, got %v", keys)
+	}
+	if _, ok := keys[expired.ID]; ok {
+		t.Error("expected the expired key to be left out")
+	}
+
+	for _, tc := range []struct {
+		key      *signingKey
+		kty, alg string
+	}{
+		{rsaKey, "RSA", "RS256"},
+		{ecKey, "EC", "ES256"},
+		{current, "EC", "ES256"},
+	} {
+		k, ok := keys[tc.key.ID]
+		if !ok {
+			t.Errorf("expected key %s to be published", tc.key.ID)
+			continue
+		}
+		if k.Kty != tc.kty || k.Alg != tc.alg || k.Use != "sig" {
+			t.Errorf("expected %s %s, got %+v", tc.kty, tc.alg, k)
+		}
+
+		// The key id is the thumbprint of the published members, so a verifier can recompute it
+		if k.thumbprint() != k.Kid {
+			t.Errorf("expected the kid to be the thumbprint of %+v", k)
+		}
+		switch k.Kty {
+		case "RSA":
+			if k.N == "" || k.E != "AQAB" || k.X != "" {
+				t.Errorf("unexpected RSA members %+v", k)
+			}
+		case "EC":
+			if k.Crv != "P-256" || len(k.X) != 43 || len(k.Y) != 43 || k.N != "" {
+				t.Errorf("unexpected EC members %+v", k)
+			}
+		}
+	}
+}
+
+func TestTokensRoundTripWithEachAlgorithm(t *testing.T) {
+	userName := newTestCustomer(t, roleCustomer)
+
+	for _, tc := range []struct {
+		alg string
+		key *signingKey
+	}{
+		{"RS256", loadSigningKey()},
+		{"ES256", newTestSigningKey(t)},
+	} {
+		useTestKeyring(t, newTestKeyring(t, newMemoryStore(), tc.key))
+
+		bearer := testToken(t, userName)
+		token, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(bearer, "Bearer "), &tokenClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Header["alg"] != tc.alg || token.Header["kid"] != tc.key.ID {
+			t.Errorf("expected a %s token signed by %s, got %v", tc.alg, tc.key.ID, token.Header)
+		}
+
+		info, err := testApp.VerifyTokenHandler(context.Background(), nil, strings.TrimPrefix(bearer, "Bearer "))
+		if err != nil {
+			t.Fatalf("%s: expected the token to verify, got %v", tc.alg, err)
+		}
+		if info.UserName() != userName {
+			t.Errorf("%s: expected %s, got %s", tc.alg, userName, info.UserName())
+		}
+		if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d %s", tc.alg, res.StatusCode, b)
+		}
+
+		// The algorithm of the token must match the key named by its kid
+		claims := &tokenClaims{}
+		new(jwt.Parser).ParseUnverified(strings.TrimPrefix(bearer, "Bearer "), claims)
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		forged.Header["kid"] = tc.key.ID
+		signed, err := forged.SignedString([]byte(tc.key.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testApp.VerifyTokenHandler(context.Background(), nil, signed); err == nil {
+			t.Errorf("%s: expected an HS256 token to be rejected", tc.alg)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Interval of the pings sent to a kitchen display, a display that stays silent for two intervals is disconnected
+const kitchenFeedPingInterval = time.Second * 30
+
+// Types of the messages sent by a kitchen display
+const (
+	kitchenSubscribe    = "subscribe"
+	kitchenUpdateStatus = "updateStatus"
+)
+
+// Create a struct that holds a message sent by a kitchen display
+// 'id' is chosen by the display and echoed in the reply, so it can match replies to its messages.
+type kitchenFeedMessage struct {
+	Type        string        `json:"type"`
+	ID          interface{}   `json:"id"`
+	Statuses    []interface{} `json:"statuses"`
+	OrderID     int           `json:"orderId"`
+	OrderStatus interface{}   `json:"orderStatus"`
+}
+
+// Handler to push new orders and order status changes to the kitchen displays over a WebSocket (Used by store employees)
+// The statuses a display follows are set with the 'status' query parameters (status codes, every status by default)
+// and changed later with a 'subscribe' message. An 'updateStatus' message changes the status of an order the same
+// way 'PUT /order/update' does, and is answered with 'statusUpdated' or with 'error' along with the problem details.
+func (a *App) kitchenFeedHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := a.kitchenFeedFilter(stringsToInterfaces(r.URL.Query()["status"]))
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Subscribe before upgrading, so no order placed in between is missed
+	events, unsubscribe := a.Events.Subscribe(allOrders)
+	defer unsubscribe()
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	defer conn.Close()
+	conn.readTimeout = kitchenFeedPingInterval * 2
+
+	actor, actorID := authenticatedUserName(r), authenticatedCustomerID(r)
+	requestID := r.Header.Get(requestIDHeader)
+
+	// Read the messages of the display in the background, until the display closes the connection
+	messages := make(chan []byte)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := conn.WriteJSON(kitchenSubscribed(nil, filter)); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(kitchenFeedPingInterval)
+	defer ping.Stop()
+
+	for {
+		var reply interface{}
+
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			if err := conn.Ping(); err != nil {
+				return
+			}
+			continue
+		case e := <-events:
+			// An order leaving a followed status is pushed too, so the display can take it off
+			if filter != nil && !filter[e.OrderStatus] && !filter[e.PreviousStatus] {
+				continue
+			}
+			reply = a.kitchenFeedEvent(e)
+		case message := <-messages:
+			reply = a.kitchenFeedReply(message, &filter, actor, actorID, requestID)
+		}
+
+		if err := conn.WriteJSON(reply); err != nil {
+			return
+		}
+	}
+}
+
+// Resolves the status codes a display follows to a set of status names, nil follows every status
+func (a *App) kitchenFeedFilter(statusIDs []interface{}) (map[string]bool, error) {
+	if len(statusIDs) == 0 {
+		return nil, nil
+	}
+
+	filter := map[string]bool{}
+	for _, v := range statusIDs {
+		statusID, err := parseStatusID(v)
+		if err != nil {
+			return nil, err
+		}
+		statusName, err := a.statusNameByID(statusID)
+		if err != nil {
+			return nil, err
+		}
+		filter[statusName] = true
+	}
+
+	return filter, nil
+}
+
+// Handles a message of a display and returns the reply
+func (a *App) kitchenFeedReply(message []byte, filter *map[string]bool, actor string, actorID int, requestID string) interface{} {
+	var m kitchenFeedMessage
+	if err := json.Unmarshal(message, &m); err != nil {
+		return kitchenError(nil, &appError{Status: http.StatusBadRequest, Detail: "Message must be a JSON object of the documented format"}, requestID)
+	}
+
+	switch m.Type {
+	case kitchenSubscribe:
+		f, err := a.kitchenFeedFilter(m.Statuses)
+		if err != nil {
+			return kitchenError(m.ID, toAppError(err), requestID)
+		}
+		*filter = f
+		return kitchenSubscribed(m.ID, f)
+	case kitchenUpdateStatus:
+		// Validate and persist the change like the HTTP routes do
+		statusName, err := a.changeOrderStatus(order{OrderID: m.OrderID, OrderStatus: m.OrderStatus}, actor, actorID)
+		if err != nil {
+			return kitchenError(m.ID, orderStatusError(err), requestID)
+		}
+		return map[string]interface{}{
+			"type":        "statusUpdated",
+			"id":          m.ID,
+			"orderId":     m.OrderID,
+			"orderStatus": statusName,
+		}
+	default:
+		return kitchenError(m.ID, &appError{Status: http.StatusBadRequest, Detail: "Unknown message type"}, requestID)
+	}
+}
+
+// Returns the message pushed to the displays for a broker event
+func (a *App) kitchenFeedEvent(e orderEvent) map[string]interface{} {
+	payload := map[string]interface{}{
+		"type":        e.Type,
+		"orderId":     e.OrderID,
+		"orderStatus": e.OrderStatus,
+		"changedAt":   e.ChangedAt,
+		"changedBy":   e.ChangedBy,
+	}
+
+	switch e.Type {
+	case orderCreatedEvent:
+		// The display needs the items to start making the pizzas
+		items, err := a.Store.GetOrderItems(e.OrderID)
+		if err != nil {
+			log.Println(err)
+		}
+		payload["items"] = items
+	case orderStatusChangedEvent:
+		payload["previousStatus"] = e.PreviousStatus
+	}
+
+	return payload
+}
+
+// Returns the reply confirming the statuses a display follows
+func kitchenSubscribed(id interface{}, filter map[string]bool) map[string]interface{} {
+	statuses := []string{}
+	for statusName := range filter {
+		statuses = append(statuses, statusName)
+	}
+	sort.Strings(statuses)
+
+	return map[string]interface{}{
+		"type":     "subscribed",
+		"id":       id,
+		"statuses": statuses,
+	}
+}
+
+// Returns the reply reporting an error along with the problem details
+func kitchenError(id interface{}, e *appError, requestID string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "error",
+		"id":    id,
+		"error": problemPayload(e, requestID),
+	}
+}
+
+// Converts the values of a query parameter, so they are parsed like the status codes of a JSON body
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
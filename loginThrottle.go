@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaj13/go-guardian/auth"
+	gerrors "github.com/shaj13/go-guardian/errors"
+)
+
+// Failed basic authentication attempts allowed before the attempts are slowed down
+const (
+	userBackoffThreshold = 3
+	ipBackoffThreshold   = 10
+)
+
+// The delay after a failed attempt doubles with every failure, starting at 'loginBackoffBase'
+const (
+	loginBackoffBase = time.Second
+	maxLoginBackoff  = time.Minute * 5
+)
+
+// Consecutive failed attempts on a username that lock the account, and how long it stays locked
+const (
+	lockoutThreshold = 10
+	lockoutDuration  = time.Minute * 15
+)
+
+// Password reset requests allowed per username and per IP address before the requests are slowed down
+const (
+	userResetThreshold = 3
+	ipResetThreshold   = 10
+)
+
+// Failed attempts are forgotten after this long without a new failure
+const failedAttemptWindow = time.Hour
+
+// Setup global tracker of the failed basic authentication attempts
+var loginAttempts = newLoginThrottle()
+
+// Error returned when a basic authentication attempt is rejected without checking the password
+type loginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *loginThrottledError) Error() string {
+	return fmt.Sprintf("Too many failed attempts, retry after %v", e.RetryAfter)
+}
+
+// Create a struct that holds the failed attempts of a username or an IP address
+type failedAttempts struct {
+	Count       int
+	LastFailure time.Time
+}
+
+// Tracks the failed basic authentication attempts per username and per IP address, and the wrong two-factor codes
+// per username. The wrong codes are counted apart, so the correct password that comes with each guess does not
+// clear them. The attempts are kept in memory, lockouts are stored in DB so they apply to every instance.
+type loginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*failedAttempts
+}
+
+// Create an empty tracker
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{attempts: map[string]*failedAttempts{}}
+}
+
+// Returns how long the username and IP address must wait before the next attempt, 0 if they may try now
+func (t *loginThrottle) Delay(userName, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	delay := t.delay("user:"+userName, userBackoffThreshold, now)
+	if d := t.delay("totp:"+userName, userBackoffThreshold, now); d > delay {
+		delay = d
+	}
+	if d := t.delay("ip:"+ip, ipBackoffThreshold, now); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// Records a failed attempt and returns the number of consecutive failures of the username
+func (t *loginThrottle) Fail(userName, ip string) int {
+	return t.fail("user:"+userName, ip)
+}
+
+// Records a wrong two-factor code and returns the number of consecutive wrong codes of the username
+func (t *loginThrottle) FailSecondFactor(userName, ip string) int {
+	return t.fail("totp:"+userName, ip)
+}
+
+// Forgets the failed password attempts of a username after a correct password
+// The wrong two-factor codes are kept until a code is accepted.
+func (t *loginThrottle) PasswordSucceeded(userName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, "user:"+userName)
+}
+
+// Forgets every failed attempt of a username, after a complete login or when the account is locked or unlocked
+func (t *loginThrottle) Reset(userName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, "user:"+userName)
+	delete(t.attempts, "totp:"+userName)
+}
+
+// Returns how long a password reset request for the username from the IP address must wait, 0 if it may be sent now
+// The reset requests are counted apart from the login attempts, so they do not slow down the logins.
+func (t *loginThrottle) PasswordResetDelay(userName, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	delay := t.delay("reset:"+userName, userResetThreshold, now)
+	if d := t.delay("reset-ip:"+ip, ipResetThreshold, now); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// Records a password reset request, whether or not the username exists
+func (t *loginThrottle) PasswordResetRequested(userName, ip string) {
+	t.count("reset:"+userName, "reset-ip:"+ip)
+}
+
+// Counts a failure of a username key and of the IP address, and returns the count of the username key
+func (t *loginThrottle) fail(userKey, ip string) int {
+	return t.count(userKey, "ip:"+ip)
+}
+
+// Counts an attempt on each key and returns the count of the first key
+func (t *loginThrottle) count(keys ...string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+	for _, key := range keys {
+		a, ok := t.attempts[key]
+		if !ok {
+			a = &failedAttempts{}
+			t.attempts[key] = a
+		}
+		a.Count++
+		a.LastFailure = now
+	}
+	return t.attempts[keys[0]].Count
+}
+
+// Returns the remaining delay of a key, the caller must hold the lock
+func (t *loginThrottle) delay(key string, threshold int, now time.Time) time.Duration {
+	a, ok := t.attempts[key]
+	if !ok || a.Count < threshold {
+		return 0
+	}
+
+	backoff := maxLoginBackoff
+	if shift := uint(a.Count - threshold); shift < 16 && loginBackoffBase<<shift < maxLoginBackoff {
+		backoff = loginBackoffBase << shift
+	}
+	if remaining := a.LastFailure.Add(backoff).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Drops the failed attempts that are older than the window, the caller must hold the lock
+func (t *loginThrottle) prune(now time.Time) {
+	for key, a := range t.attempts {
+		if now.Sub(a.LastFailure) > failedAttemptWindow {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// Strategy that wraps the basic strategy with the failed attempt tracking.
+// The attempts are checked before the wrapped strategy runs, so a cached authentication decision
+// does not bypass a lockout or the backoff.
+type throttledBasicStrategy struct {
+	app  *App
+	next auth.Strategy
+}
+
+// Authenticate the request, unless the username is locked or the username or IP address must wait
+func (s *throttledBasicStrategy) Authenticate(ctx context.Context, r *http.Request) (auth.Info, error) {
+	userName, _, ok := r.BasicAuth()
+	if !ok {
+		return s.next.Authenticate(ctx, r)
+	}
+	ip := clientIP(r)
+
+	// Reject the attempt while the account is locked
+	lockout, err := s.app.Store.GetAccountLockout(userName)
+	if err == nil {
+		return nil, &loginThrottledError{RetryAfter: time.Until(lockout.LockedUntil)}
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Reject the attempt while the username or IP address is backing off
+	if delay := loginAttempts.Delay(userName, ip); delay > 0 {
+		return nil, &loginThrottledError{RetryAfter: delay}
+	}
+
+	info, err := s.next.Authenticate(ctx, r)
+	if err != nil {
+		if failures := loginAttempts.Fail(userName, ip); failures >= lockoutThreshold {
+			s.app.lockAccount(r, userName, ip, failures)
+		}
+		return nil, err
+	}
+
+	loginAttempts.PasswordSucceeded(userName)
+	return info, nil
+}
+
+// Locks an account after too many failed attempts, and records the lockout in DB
+// The cached authentication decision of the account is evicted, so the lockout applies right away
+func (a *App) lockAccount(r *http.Request, userName, ip string, failures int) {
+	now := time.Now()
+	lockout := accountLockout{
+		Username:       userName,
+		IPAddress:      ip,
+		FailedAttempts: failures,
+		LockedAt:       now,
+		LockedUntil:    now.Add(lockoutDuration),
+	}
+	if err := a.Store.CreateAccountLockout(&lockout); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Account %s locked until %v after %d failed attempts from %s\n", userName, lockout.LockedUntil, failures, ip)
+
+	loginAttempts.Reset(userName)
+	cache.Delete(userName, r)
+}
+
+// Returns the IP address of the client
+// Behind a proxy that appends the client address to 'X-Forwarded-For' (e.g. the Heroku router),
+// set TRUST_PROXY to 'true' to use the last address of the header
+func clientIP(r *http.Request) string {
+	if getEnv("TRUST_PROXY", "") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Writes the 'Retry-After' header, in whole seconds rounded up
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// Returns how long the client must wait when one of the strategies rejected the request
+// because of too many failed attempts
+func loginRetryAfter(err error) (time.Duration, bool) {
+	errs, ok := err.(gerrors.MultiError)
+	if !ok {
+		errs = gerrors.MultiError{err}
+	}
+
+	for _, e := range errs {
+		if throttled, ok := e.(*loginThrottledError); ok {
+			return throttled.RetryAfter, true
+		}
+	}
+	return 0, false
+}
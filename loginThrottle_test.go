@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Forgets every failed attempt at the end of the test, all the tests share the client IP address
+func resetLoginAttempts(t *testing.T) {
+	loginAttempts = newLoginThrottle()
+	t.Cleanup(func() { loginAttempts = newLoginThrottle() })
+}
+
+// Moves the failed attempts back in time, so the next attempt is not delayed by the backoff
+func skipLoginBackoff() {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+
+	for _, a := range loginAttempts.attempts {
+		a.LastFailure = time.Now().Add(-maxLoginBackoff)
+	}
+}
+
+// Sends a request authenticated with a wrong password
+func wrongPasswordRequest(t *testing.T, userName string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", testServer.URL+"/auth/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(userName, "Wr0ngPassword")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := newLoginThrottle()
+	ip := "192.0.2.1"
+
+	for i := 1; i < userBackoffThreshold; i++ {
+		throttle.Fail("alice", ip)
+		if d := throttle.Delay("alice", ip); d != 0 {
+			t.Fatalf("expected no delay after %d failures, got %v", i, d)
+		}
+	}
+
+	// The delay starts at the base and doubles with every failure, up to the maximum
+	throttle.Fail("alice", ip)
+	if d := throttle.Delay("alice", ip); d <= 0 || d > loginBackoffBase {
+		t.Fatalf("expected a delay of at most %v, got %v", loginBackoffBase, d)
+	}
+	throttle.Fail("alice", ip)
+	if d := throttle.Delay("alice", ip); d <= loginBackoffBase || d > loginBackoffBase*2 {
+		t.Fatalf("expected a delay of at most %v, got %v", loginBackoffBase*2, d)
+	}
+	for i := 0; i < 20; i++ {
+		throttle.Fail("alice", ip)
+	}
+	if d := throttle.Delay("alice", ip); d > maxLoginBackoff {
+		t.Fatalf("expected the delay to be capped at %v, got %v", maxLoginBackoff, d)
+	}
+
+	// Another username from another IP address is not delayed, the correct password clears the username
+	if d := throttle.Delay("bob", "192.0.2.2"); d != 0 {
+		t.Fatalf("expected no delay for another username, got %v", d)
+	}
+	throttle.PasswordSucceeded("alice")
+	if d := throttle.Delay("alice", "192.0.2.2"); d != 0 {
+		t.Fatalf("expected no delay after a correct password, got %v", d)
+	}
+}
+
+func TestLoginThrottleDelaysAnIPAddressAcrossUsernames(t *testing.T) {
+	throttle := newLoginThrottle()
+	ip := "192.0.2.1"
+
+	for i := 0; i < ipBackoffThreshold; i++ {
+		throttle.Fail(fmt.Sprintf("user%d", i), ip)
+	}
+	if d := throttle.Delay("someone", ip); d <= 0 {
+		t.Fatalf("expected the IP address to be delayed after %d failures", ipBackoffThreshold)
+	}
+	if d := throttle.Delay("someone", "192.0.2.2"); d != 0 {
+		t.Fatalf("expected another IP address not to be delayed, got %v", d)
+	}
+}
+
+func TestWrongPasswordsAreThrottled(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+
+	for i := 0; i < userBackoffThreshold; i++ {
+		if res := wrongPasswordRequest(t, userName); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, res.StatusCode)
+		}
+	}
+
+	// The correct password is not even checked while the username backs off
+	res, b := testRequest(t, "POST", "/auth/token", userName, "")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d %s", res.StatusCode, b)
+	}
+	if retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("expected a Retry-After header, got %q", res.Header.Get("Retry-After"))
+	}
+
+	skipLoginBackoff()
+	if res, b := testRequest(t, "POST", "/auth/token", userName, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 once the backoff is over, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestAccountIsLockedAfterRepeatedFailures(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+	manager := testToken(t, newTestCustomer(t, roleManager))
+
+	for i := 0; i < lockoutThreshold; i++ {
+		skipLoginBackoff()
+		if res := wrongPasswordRequest(t, userName); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, res.StatusCode)
+		}
+	}
+
+	// The lockout applies to the correct password, and is not lifted by the backoff ending
+	skipLoginBackoff()
+	if res, b := testRequest(t, "POST", "/auth/token", userName, ""); res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while locked, got %d %s", res.StatusCode, b)
+	}
+
+	res, b := testRequest(t, "GET", "/customer/lockouts", manager, "")
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(b), `"`+userName+`"`) {
+		t.Fatalf("expected the lockout to be listed, got %d %s", res.StatusCode, b)
+	}
+
+	body := fmt.Sprintf(`{"username":"%s"}`, userName)
+	if res, b := testRequest(t, "PUT", "/customer/unlock", manager, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "POST", "/auth/token", userName, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 once unlocked, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "PUT", "/customer/unlock", manager, body); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an account that is not locked, got %d %s", res.StatusCode, b)
+	}
+}
@@ -6,6 +6,18 @@ import (
 )
 
 func main() {
+	// Run the schema migrations instead of the API Server: migrate up|down|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	// Change the role of an account instead of running the API Server: role <username> <role>
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		runRoleCommand(os.Args[2:])
+		return
+	}
+
 	// Create an app struct and initialize the DB connection
 	a := App{}
 	a.Initialize()
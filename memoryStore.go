@@ -0,0 +1,1232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sales tax applied to the order total (matches 'PAS_SP_CREATE_ORDER')
+const salesTaxRate = 0.0625
+
+// Store implementation kept in memory.
+// Mirrors the Postgres tables and stored procedures, including the 'isDeleted' soft-delete flag.
+type memoryStore struct {
+	mu sync.Mutex
+
+	customers  []memoryCustomer
+	orders     []memoryOrder
+	orderItems []memoryOrderItem
+	history    []memoryStatusHistory
+	pizzas     []memoryPizza
+	statuses   []memoryStatus
+
+	sessions      []memorySession
+	refreshTokens []memoryRefreshToken
+	deniedTokens  []memoryDeniedToken
+
+	lockouts []accountLockout
+
+	passwordResets []memoryPasswordReset
+
+	twoFactors    []twoFactor
+	recoveryCodes []memoryRecoveryCode
+
+	apiKeys []apiKey
+
+	idempotencyRecords []idempotencyRecord
+	signingKeys        []signingKeyRecord
+}
+
+// Row of the 'CUSTOMERS' table
+// The hashed password is kept apart from the profile, so the profile can be returned as is
+type memoryCustomer struct {
+	customer
+	HashedPassword string
+	IsDeleted      bool
+}
+
+// Row of the 'ORDERS' table
+type memoryOrder struct {
+	OrderID             int
+	CustomerID          int
+	OrderTime           time.Time
+	CustomerPhoneNumber string
+	StatusID            int
+	TotalPrice          float64
+	IsDeleted           bool
+}
+
+// Row of the 'ORDER_ITEMS' table
+type memoryOrderItem struct {
+	orderItem
+	OrderID int
+}
+
+// Row of the 'ORDER_STATUS_HISTORY' table
+type memoryStatusHistory struct {
+	OrderID      int
+	FromStatusID int
+	ToStatusID   int
+	ChangedBy    string
+	ChangedByID  int
+	ChangedAt    time.Time
+}
+
+// Row of the 'AUTH_SESSIONS' table
+type memorySession struct {
+	authSession
+	CreatedAt time.Time
+}
+
+// Row of the 'REFRESH_TOKENS' table
+type memoryRefreshToken struct {
+	refreshToken
+	Used bool
+}
+
+// Row of the 'DENIED_TOKENS' table
+type memoryDeniedToken struct {
+	TokenID   string
+	ExpiresAt time.Time
+}
+
+// Row of the 'PASSWORD_RESETS' table
+type memoryPasswordReset struct {
+	passwordReset
+	Used bool
+}
+
+// Row of the 'TWO_FACTOR_RECOVERY_CODES' table
+type memoryRecoveryCode struct {
+	CustomerID int
+	CodeHash   string
+	Used       bool
+}
+
+// Row of the 'PIZZAS' table
+type memoryPizza struct {
+	pizza
+	IsDeleted bool
+}
+
+// Row of the 'ORDER_STATUS_CODES' table
+type memoryStatus struct {
+	status
+	IsDeleted bool
+}
+
+// Create an in-memory store seeded with the same pizzas and status codes as the production DB
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		pizzas: []memoryPizza{
+			{pizza: pizza{1, "Cheese Pizza", 6.99}},
+			{pizza: pizza{2, "Veggie Pizza", 7.99}},
+			{pizza: pizza{3, "Pepperoni Pizza", 6.99}},
+			{pizza: pizza{4, "Meat Pizza", 7.99}},
+			{pizza: pizza{5, "Margherita Pizza", 8.99}},
+			{pizza: pizza{6, "BBQ Chicken Pizza", 8.99}},
+			{pizza: pizza{7, "Hawaiian Pizza", 7.99}},
+			{pizza: pizza{8, "Buffalo Pizza", 10.99}},
+			{pizza: pizza{9, "Supreme Pizza", 12.99}},
+		},
+		statuses: []memoryStatus{
+			{status: status{1, "Order Received"}},
+			{status: status{2, "Making Your Pizza"}},
+			{status: status{3, "Ready for Pick Up"}},
+			{status: status{4, "Picked Up"}},
+			{status: status{5, "Canceled"}},
+		},
+	}
+}
+
+// Creates a new customer, usernames must be unique
+func (s *memoryStore) CreateCustomer(c *customer, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	username := strings.TrimSpace(c.Username)
+	for _, mc := range s.customers {
+		if mc.Username == username {
+			return errUsernameTaken
+		}
+	}
+
+	c.CustomerID = len(s.customers) + 1
+	s.customers = append(s.customers, memoryCustomer{customer: customer{
+		CustomerID:          c.CustomerID,
+		FirstName:           strings.TrimSpace(c.FirstName),
+		LastName:            strings.TrimSpace(c.LastName),
+		CustomerPhoneNumber: strings.TrimSpace(c.CustomerPhoneNumber),
+		Username:            username,
+		Role:                roleCustomer,
+	}, HashedPassword: strings.TrimSpace(hashedPassword)})
+
+	return nil
+}
+
+// Retrieves the customerId, hashed password, and role given the username
+func (s *memoryStore) GetCustomerCredentials(username string) (credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mc := range s.customers {
+		if mc.Username == username && !mc.IsDeleted {
+			return credentials{CustomerID: mc.CustomerID, Password: mc.HashedPassword, Role: mc.Role}, nil
+		}
+	}
+
+	return credentials{}, sql.ErrNoRows
+}
+
+// Retrieves the profile of a customer given the customerId, closed accounts are flagged with 'Closed'
+func (s *memoryStore) GetCustomer(customerID int) (customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mc := range s.customers {
+		if mc.CustomerID == customerID {
+			c := mc.customer
+			c.Closed = mc.IsDeleted
+			return c, nil
+		}
+	}
+
+	return customer{}, sql.ErrNoRows
+}
+
+// Updates the profile of a customer that is not closed
+// The orders of the customer follow the new phone number, so they stay linked to the customer
+func (s *memoryStore) UpdateCustomer(c customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc := s.findCustomer(c.CustomerID)
+	if mc == nil {
+		return sql.ErrNoRows
+	}
+
+	username := strings.TrimSpace(c.Username)
+	for _, other := range s.customers {
+		if other.Username == username && other.CustomerID != c.CustomerID {
+			return errUsernameTaken
+		}
+	}
+
+	mc.FirstName = strings.TrimSpace(c.FirstName)
+	mc.LastName = strings.TrimSpace(c.LastName)
+	mc.CustomerPhoneNumber = strings.TrimSpace(c.CustomerPhoneNumber)
+	mc.Username = username
+	for i := range s.orders {
+		if s.orders[i].CustomerID == c.CustomerID {
+			s.orders[i].CustomerPhoneNumber = mc.CustomerPhoneNumber
+		}
+	}
+
+	return nil
+}
+
+// Closes the account of a customer with the 'isDeleted' flag, and revokes the API keys of the account
+func (s *memoryStore) CloseCustomer(customerID int, closedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc := s.findCustomer(customerID)
+	if mc == nil {
+		return sql.ErrNoRows
+	}
+	mc.IsDeleted = true
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].CustomerID == customerID && s.apiKeys[i].RevokedAt == nil {
+			s.apiKeys[i].RevokedAt = &closedAt
+		}
+	}
+
+	return nil
+}
+
+// Anonymizes the personal data of a customer and closes the account
+// The orders are kept with their items and totals, so the sales figures do not change
+func (s *memoryStore) EraseCustomer(customerID int, erasedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var mc *memoryCustomer
+	for i := range s.customers {
+		if s.customers[i].CustomerID == customerID {
+			mc = &s.customers[i]
+		}
+	}
+	if mc == nil {
+		return sql.ErrNoRows
+	}
+	erasedUserName := erasedUsername(customerID)
+
+	for i := range s.orders {
+		if s.orders[i].CustomerID == customerID {
+			s.orders[i].CustomerPhoneNumber = erasedPhoneNumber
+		}
+	}
+	for i := range s.history {
+		if s.history[i].ChangedByID == customerID {
+			s.history[i].ChangedBy = erasedUserName
+		}
+	}
+	for i := range s.sessions {
+		if s.sessions[i].CustomerID == customerID {
+			s.sessions[i].Username = erasedUserName
+			s.sessions[i].Revoked = true
+		}
+	}
+
+	lockouts := []accountLockout{}
+	for _, l := range s.lockouts {
+		if l.CustomerID != customerID {
+			lockouts = append(lockouts, l)
+		}
+	}
+	s.lockouts = lockouts
+
+	resets := []memoryPasswordReset{}
+	for _, p := range s.passwordResets {
+		if p.CustomerID != customerID {
+			resets = append(resets, p)
+		}
+	}
+	s.passwordResets = resets
+
+	twoFactors := []twoFactor{}
+	for _, tf := range s.twoFactors {
+		if tf.CustomerID != customerID {
+			twoFactors = append(twoFactors, tf)
+		}
+	}
+	s.twoFactors = twoFactors
+	s.dropRecoveryCodes(customerID)
+
+	records := []idempotencyRecord{}
+	for _, rec := range s.idempotencyRecords {
+		if rec.CustomerID != customerID {
+			records = append(records, rec)
+		}
+	}
+	s.idempotencyRecords = records
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].CustomerID == customerID {
+			s.apiKeys[i].Name = erasedUserName
+			s.apiKeys[i].Username = erasedUserName
+			if s.apiKeys[i].RevokedAt == nil {
+				s.apiKeys[i].RevokedAt = &erasedAt
+			}
+		}
+	}
+
+	mc.customer = customer{
+		CustomerID:          customerID,
+		FirstName:           erasedName,
+		LastName:            erasedName,
+		CustomerPhoneNumber: erasedPhoneNumber,
+		Username:            erasedUserName,
+		Role:                roleCustomer,
+	}
+	mc.HashedPassword = ""
+	mc.IsDeleted = true
+
+	return nil
+}
+
+// Finds a customer that is not closed by customerId, the caller must hold the lock
+func (s *memoryStore) findCustomer(customerID int) *memoryCustomer {
+	for i := range s.customers {
+		if s.customers[i].CustomerID == customerID && !s.customers[i].IsDeleted {
+			return &s.customers[i]
+		}
+	}
+
+	return nil
+}
+
+// Changes the role of a customer given the username
+func (s *memoryStore) SetCustomerRole(username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.customers {
+		if s.customers[i].Username == username {
+			s.customers[i].Role = role
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// Replaces the hashed password of a customer given the customerId
+func (s *memoryStore) SetCustomerPassword(customerID int, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.customers {
+		if s.customers[i].CustomerID == customerID {
+			s.customers[i].HashedPassword = hashedPassword
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// Records a password reset, the earlier password resets of the customer can no longer be used
+func (s *memoryStore) CreatePasswordReset(p passwordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.passwordResets {
+		if s.passwordResets[i].CustomerID == p.CustomerID {
+			s.passwordResets[i].Used = true
+		}
+	}
+	s.passwordResets = append(s.passwordResets, memoryPasswordReset{passwordReset: p})
+
+	return nil
+}
+
+// Marks a password reset as used and returns it
+func (s *memoryStore) UsePasswordReset(tokenHash string) (passwordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.passwordResets {
+		mp := &s.passwordResets[i]
+		if mp.TokenHash == tokenHash && !mp.Used {
+			mp.Used = true
+			return mp.passwordReset, nil
+		}
+	}
+
+	return passwordReset{}, sql.ErrNoRows
+}
+
+// Retrieves the two-factor authentication settings of a customer
+func (s *memoryStore) GetTwoFactor(customerID int) (twoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tf := s.findTwoFactor(customerID); tf != nil {
+		return *tf, nil
+	}
+
+	return twoFactor{}, sql.ErrNoRows
+}
+
+// Stores a new, unconfirmed, secret and the hashed recovery codes of a customer
+func (s *memoryStore) EnrollTwoFactor(customerID int, secret string, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf := s.findTwoFactor(customerID)
+	if tf == nil {
+		s.twoFactors = append(s.twoFactors, twoFactor{CustomerID: customerID})
+		tf = &s.twoFactors[len(s.twoFactors)-1]
+	}
+	tf.Secret = secret
+	tf.Confirmed = false
+	tf.LastUsedStep = 0
+
+	s.dropRecoveryCodes(customerID)
+	for _, h := range recoveryCodeHashes {
+		s.recoveryCodes = append(s.recoveryCodes, memoryRecoveryCode{CustomerID: customerID, CodeHash: h})
+	}
+
+	return nil
+}
+
+// Confirms the enrollment of a customer
+func (s *memoryStore) ConfirmTwoFactor(customerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf := s.findTwoFactor(customerID)
+	if tf == nil || tf.Secret == "" {
+		return sql.ErrNoRows
+	}
+	tf.Confirmed = true
+
+	return nil
+}
+
+// Removes the secret and the recovery codes of a customer
+func (s *memoryStore) DisableTwoFactor(customerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tf := s.findTwoFactor(customerID); tf != nil {
+		tf.Secret = ""
+		tf.Confirmed = false
+	}
+	s.dropRecoveryCodes(customerID)
+
+	return nil
+}
+
+// Requires, or no longer requires, a customer to use two-factor authentication
+func (s *memoryStore) SetTwoFactorRequired(customerID int, required bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf := s.findTwoFactor(customerID)
+	if tf == nil {
+		s.twoFactors = append(s.twoFactors, twoFactor{CustomerID: customerID})
+		tf = &s.twoFactors[len(s.twoFactors)-1]
+	}
+	tf.Required = required
+
+	return nil
+}
+
+// Records the time step of a one-time password that was used
+func (s *memoryStore) UseTwoFactorStep(customerID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf := s.findTwoFactor(customerID)
+	if tf == nil {
+		return false, sql.ErrNoRows
+	}
+	if step <= tf.LastUsedStep {
+		return false, nil
+	}
+	tf.LastUsedStep = step
+
+	return true, nil
+}
+
+// Marks a recovery code as used
+func (s *memoryStore) UseRecoveryCode(customerID int, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.recoveryCodes {
+		mc := &s.recoveryCodes[i]
+		if mc.CustomerID == customerID && mc.CodeHash == codeHash && !mc.Used {
+			mc.Used = true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Creates a new API key
+func (s *memoryStore) CreateAPIKey(k apiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findAPIKey(k.KeyID) != nil {
+		return errors.New("duplicate key value violates unique constraint on keyId")
+	}
+	k.Scopes = append([]string(nil), k.Scopes...)
+	s.apiKeys = append(s.apiKeys, k)
+
+	return nil
+}
+
+// Retrieves an API key given the keyId
+func (s *memoryStore) GetAPIKey(keyID string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k := s.findAPIKey(keyID); k != nil {
+		return *k, nil
+	}
+
+	return apiKey{}, sql.ErrNoRows
+}
+
+// Retrieves the list of API keys, most recent first
+func (s *memoryStore) GetAPIKeys() ([]apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []apiKey{}
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		keys = append(keys, s.apiKeys[i])
+	}
+
+	return keys, nil
+}
+
+// Revokes an API key
+func (s *memoryStore) RevokeAPIKey(keyID string, revokedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := s.findAPIKey(keyID)
+	if k == nil {
+		return sql.ErrNoRows
+	}
+	if k.RevokedAt == nil {
+		k.RevokedAt = &revokedAt
+	}
+
+	return nil
+}
+
+// Records when an API key was last used
+func (s *memoryStore) TouchAPIKey(keyID string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := s.findAPIKey(keyID)
+	if k == nil {
+		return sql.ErrNoRows
+	}
+	k.LastUsedAt = &usedAt
+
+	return nil
+}
+
+// Finds an API key by keyId, the caller must hold the lock
+func (s *memoryStore) findAPIKey(keyID string) *apiKey {
+	for i := range s.apiKeys {
+		if s.apiKeys[i].KeyID == keyID {
+			return &s.apiKeys[i]
+		}
+	}
+
+	return nil
+}
+
+// Finds the two-factor authentication settings of a customer, the caller must hold the lock
+func (s *memoryStore) findTwoFactor(customerID int) *twoFactor {
+	for i := range s.twoFactors {
+		if s.twoFactors[i].CustomerID == customerID {
+			return &s.twoFactors[i]
+		}
+	}
+
+	return nil
+}
+
+// Removes the recovery codes of a customer, the caller must hold the lock
+func (s *memoryStore) dropRecoveryCodes(customerID int) {
+	codes := s.recoveryCodes[:0]
+	for _, mc := range s.recoveryCodes {
+		if mc.CustomerID != customerID {
+			codes = append(codes, mc)
+		}
+	}
+	s.recoveryCodes = codes
+}
+
+// Creates a new order with status 'Order Received', snapshots the pizza prices on its items,
+// and computes the taxed total from the items
+// Every pizza is checked before anything is written, so a failed order leaves no rows behind
+func (s *memoryStore) CreateOrder(o *order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]orderItem, len(o.Items))
+	subtotal := 0.0
+	for i, item := range o.Items {
+		p, ok := s.findPizza(item.PizzaID)
+		if !ok {
+			return fmt.Errorf("pizza %d: %w", item.PizzaID, errPizzaNotAvailable)
+		}
+		items[i] = orderItem{PizzaID: p.PizzaID, Quantity: item.Quantity, UnitPrice: p.PizzaPrice}
+		subtotal += p.PizzaPrice * float64(item.Quantity)
+	}
+
+	o.OrderID = len(s.orders) + 1
+	s.orders = append(s.orders, memoryOrder{
+		OrderID:             o.OrderID,
+		CustomerID:          o.CustomerID,
+		OrderTime:           time.Now(),
+		CustomerPhoneNumber: strings.TrimSpace(o.CustomerPhoneNumber),
+		StatusID:            1,
+		TotalPrice:          roundPrice(subtotal * (1 + salesTaxRate)),
+	})
+	for _, item := range items {
+		s.orderItems = append(s.orderItems, memoryOrderItem{orderItem: item, OrderID: o.OrderID})
+	}
+
+	return nil
+}
+
+// Retrieves the items of an order
+func (s *memoryStore) GetOrderItems(orderID int) ([]orderItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.itemsOf(orderID), nil
+}
+
+// Retrieves the customerId that placed an order, 0 if the order is not linked to a customer
+func (s *memoryStore) GetOrderCustomerID(orderID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mo := s.findOrder(orderID)
+	if mo == nil {
+		return 0, sql.ErrNoRows
+	}
+
+	return mo.CustomerID, nil
+}
+
+// Retrieves the order status name given the orderId
+func (s *memoryStore) GetOrderStatus(orderID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mo := s.findOrder(orderID)
+	if mo == nil {
+		return "", sql.ErrNoRows
+	}
+
+	return s.statusName(mo.StatusID)
+}
+
+// Retrieves the list of orders by specific phone number, skipping deleted orders
+// Only orders placed by 'customerID' are returned, unless 'customerID' is 0
+func (s *memoryStore) GetOrders(customerPhoneNumber string, customerID int) ([]order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []order{}
+	for _, mo := range s.orders {
+		if mo.IsDeleted || mo.CustomerPhoneNumber != customerPhoneNumber {
+			continue
+		}
+		if customerID != 0 && mo.CustomerID != customerID {
+			continue
+		}
+		statusName, err := s.statusName(mo.StatusID)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order{
+			OrderID:             mo.OrderID,
+			CustomerID:          mo.CustomerID,
+			Items:               s.itemsOf(mo.OrderID),
+			OrderTime:           mo.OrderTime,
+			CustomerPhoneNumber: mo.CustomerPhoneNumber,
+			OrderStatus:         statusName,
+			TotalPrice:          mo.TotalPrice,
+		})
+	}
+
+	return orders, nil
+}
+
+// Retrieves the orders placed by a customer, oldest first
+func (s *memoryStore) GetCustomerOrders(customerID int) ([]order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []order{}
+	for _, mo := range s.orders {
+		if mo.IsDeleted || mo.CustomerID != customerID {
+			continue
+		}
+		statusName, err := s.statusName(mo.StatusID)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order{
+			OrderID:             mo.OrderID,
+			CustomerID:          mo.CustomerID,
+			Items:               s.itemsOf(mo.OrderID),
+			OrderTime:           mo.OrderTime,
+			CustomerPhoneNumber: mo.CustomerPhoneNumber,
+			OrderStatus:         statusName,
+			TotalPrice:          mo.TotalPrice,
+		})
+	}
+
+	return orders, nil
+}
+
+// Retrieves the list of pizzas that are not deleted
+func (s *memoryStore) GetAvailablePizzas() ([]pizza, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pizzas := []pizza{}
+	for _, mp := range s.pizzas {
+		if !mp.IsDeleted {
+			pizzas = append(pizzas, mp.pizza)
+		}
+	}
+
+	return pizzas, nil
+}
+
+// Retrieves the list of status codes that are not deleted
+func (s *memoryStore) GetStatusCodes() ([]status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := []status{}
+	for _, ms := range s.statuses {
+		if !ms.IsDeleted {
+			statuses = append(statuses, ms.status)
+		}
+	}
+
+	return statuses, nil
+}
+
+// Updates the order status if the order is still in status 'fromStatusID',
+// records the change in the status history, and returns the order status name after the update
+func (s *memoryStore) UpdateOrderStatus(orderID, fromStatusID, toStatusID int, changedBy string, changedByID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mo := s.findOrder(orderID)
+	if mo == nil {
+		return "", sql.ErrNoRows
+	}
+	if _, err := s.statusName(toStatusID); err != nil {
+		return "", errors.New("insert or update on table orders violates foreign key constraint on statusId")
+	}
+
+	if mo.StatusID == fromStatusID {
+		mo.StatusID = toStatusID
+		s.history = append(s.history, memoryStatusHistory{
+			OrderID:      orderID,
+			FromStatusID: fromStatusID,
+			ToStatusID:   toStatusID,
+			ChangedBy:    changedBy,
+			ChangedByID:  changedByID,
+			ChangedAt:    time.Now(),
+		})
+	}
+	return s.statusName(mo.StatusID)
+}
+
+// Retrieves the status history of an order, oldest change first
+func (s *memoryStore) GetOrderTimeline(orderID int) ([]statusChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timeline := []statusChange{}
+	for _, mh := range s.history {
+		if mh.OrderID != orderID {
+			continue
+		}
+		previous, err := s.statusName(mh.FromStatusID)
+		if err != nil {
+			return nil, err
+		}
+		next, err := s.statusName(mh.ToStatusID)
+		if err != nil {
+			return nil, err
+		}
+		timeline = append(timeline, statusChange{
+			ChangedAt:      mh.ChangedAt,
+			ChangedBy:      mh.ChangedBy,
+			PreviousStatus: previous,
+			NewStatus:      next,
+		})
+	}
+
+	return timeline, nil
+}
+
+// Creates a new login session along with its first refresh token
+func (s *memoryStore) CreateSession(session authSession, t refreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ms := range s.sessions {
+		if ms.SessionID == session.SessionID {
+			return errors.New("duplicate key value violates unique constraint on sessionId")
+		}
+	}
+
+	session.Revoked = false
+	s.sessions = append(s.sessions, memorySession{authSession: session, CreatedAt: time.Now()})
+	s.refreshTokens = append(s.refreshTokens, memoryRefreshToken{refreshToken: t})
+
+	return nil
+}
+
+// Retrieves a login session given the sessionId
+func (s *memoryStore) GetSession(sessionID string) (authSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ms := s.findSession(sessionID); ms != nil {
+		return ms.authSession, nil
+	}
+
+	return authSession{}, sql.ErrNoRows
+}
+
+// Adds a refresh token to an existing session
+func (s *memoryStore) CreateRefreshToken(t refreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findSession(t.SessionID) == nil {
+		return errors.New("insert or update on table refresh_tokens violates foreign key constraint on sessionId")
+	}
+	s.refreshTokens = append(s.refreshTokens, memoryRefreshToken{refreshToken: t})
+
+	return nil
+}
+
+// Marks a refresh token as used and returns it
+// Using a refresh token again revokes its whole session
+func (s *memoryStore) UseRefreshToken(tokenHash string) (refreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.refreshTokens {
+		mt := &s.refreshTokens[i]
+		if mt.TokenHash != tokenHash {
+			continue
+		}
+		if mt.Used {
+			if ms := s.findSession(mt.SessionID); ms != nil {
+				ms.Revoked = true
+			}
+			return mt.refreshToken, errRefreshTokenReused
+		}
+		mt.Used = true
+		return mt.refreshToken, nil
+	}
+
+	return refreshToken{}, sql.ErrNoRows
+}
+
+// Revokes a login session
+func (s *memoryStore) RevokeSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := s.findSession(sessionID)
+	if ms == nil {
+		return sql.ErrNoRows
+	}
+	ms.Revoked = true
+
+	return nil
+}
+
+// Revokes every login session of a customer
+func (s *memoryStore) RevokeCustomerSessions(customerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.sessions {
+		if s.sessions[i].CustomerID == customerID {
+			s.sessions[i].Revoked = true
+		}
+	}
+
+	return nil
+}
+
+// Adds an access token id to the denylist, and drops the entries of the tokens that have expired
+func (s *memoryStore) DenyToken(tokenID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	denied := s.deniedTokens[:0]
+	for _, md := range s.deniedTokens {
+		if md.ExpiresAt.After(now) && md.TokenID != tokenID {
+			denied = append(denied, md)
+		}
+	}
+	s.deniedTokens = append(denied, memoryDeniedToken{TokenID: tokenID, ExpiresAt: expiresAt})
+
+	return nil
+}
+
+// Reports whether an access token id is on the denylist
+func (s *memoryStore) IsTokenDenied(tokenID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, md := range s.deniedTokens {
+		if md.TokenID == tokenID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Records an account lockout, linked to the account holding the username, and sets the lockoutId and customerId
+func (s *memoryStore) CreateAccountLockout(l *accountLockout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l.CustomerID = 0
+	for _, mc := range s.customers {
+		if mc.Username == l.Username {
+			l.CustomerID = mc.CustomerID
+		}
+	}
+	l.LockoutID = len(s.lockouts) + 1
+	s.lockouts = append(s.lockouts, *l)
+
+	return nil
+}
+
+// Retrieves the lockout of a username that is still in effect
+func (s *memoryStore) GetAccountLockout(username string) (accountLockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ml := s.activeLockout(username); ml != nil {
+		return *ml, nil
+	}
+
+	return accountLockout{}, sql.ErrNoRows
+}
+
+// Retrieves the lockouts of a username, most recent first
+func (s *memoryStore) GetAccountLockouts(username string) ([]accountLockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lockouts := []accountLockout{}
+	for i := len(s.lockouts) - 1; i >= 0; i-- {
+		if username == "" || s.lockouts[i].Username == username {
+			lockouts = append(lockouts, s.lockouts[i])
+		}
+	}
+
+	return lockouts, nil
+}
+
+// Lifts the lockout of a username that is still in effect
+func (s *memoryStore) UnlockAccount(username, unlockedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.activeLockout(username)
+	if ml == nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	ml.UnlockedAt = &now
+	ml.UnlockedBy = unlockedBy
+
+	return nil
+}
+
+// Reserves an idempotency key for a request in progress, and drops the records that have expired
+func (s *memoryStore) ReserveIdempotencyKey(rec idempotencyRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := s.idempotencyRecords[:0]
+	for _, r := range s.idempotencyRecords {
+		if r.ExpiresAt.After(rec.CreatedAt) {
+			records = append(records, r)
+		}
+	}
+	s.idempotencyRecords = records
+
+	if s.findIdempotencyRecord(rec.Scope, rec.Key) != nil {
+		return false, nil
+	}
+	rec.StatusCode = 0
+	rec.Body = nil
+	s.idempotencyRecords = append(s.idempotencyRecords, rec)
+
+	return true, nil
+}
+
+// Retrieves the record of an idempotency key that has not expired at 'now'
+func (s *memoryStore) GetIdempotencyRecord(scope, key string, now time.Time) (idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.findIdempotencyRecord(scope, key)
+	if r == nil || !r.ExpiresAt.After(now) {
+		return idempotencyRecord{}, sql.ErrNoRows
+	}
+	return *r, nil
+}
+
+// Stores the response of the request holding an idempotency key
+func (s *memoryStore) CompleteIdempotencyKey(scope, key string, statusCode int, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.findIdempotencyRecord(scope, key)
+	if r == nil {
+		return sql.ErrNoRows
+	}
+	r.StatusCode = statusCode
+	r.ContentType = contentType
+	r.Body = append([]byte(nil), body...)
+
+	return nil
+}
+
+// Retrieves the current signing key and the keys retired after 'retiredAfter'
+func (s *memoryStore) GetSigningKeys(retiredAfter time.Time) ([]signingKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []signingKeyRecord{}
+	for _, k := range s.signingKeys {
+		if k.RetiredAt == nil || k.RetiredAt.After(retiredAfter) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+// Makes a signing key the current one and retires the previous current key
+func (s *memoryStore) RotateSigningKey(next signingKeyRecord, now, expiredBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []signingKeyRecord{}
+	for _, k := range s.signingKeys {
+		switch {
+		case k.KeyID == next.KeyID:
+			continue
+		case k.RetiredAt == nil:
+			retiredAt := now
+			k.RetiredAt = &retiredAt
+		case k.RetiredAt.Before(expiredBefore):
+			k.EncryptedPrivateKey = nil
+		}
+		keys = append(keys, k)
+	}
+	next.RetiredAt = nil
+	s.signingKeys = append(keys, next)
+
+	return nil
+}
+
+// Checks whether a signing key was ever stored
+func (s *memoryStore) SigningKeyExists(kid string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.signingKeys {
+		if k.KeyID == kid {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Releases an idempotency key
+func (s *memoryStore) ReleaseIdempotencyKey(scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := s.idempotencyRecords[:0]
+	for _, r := range s.idempotencyRecords {
+		if r.Scope != scope || r.Key != key {
+			records = append(records, r)
+		}
+	}
+	s.idempotencyRecords = records
+
+	return nil
+}
+
+// Finds the record of an idempotency key, the caller must hold the lock
+func (s *memoryStore) findIdempotencyRecord(scope, key string) *idempotencyRecord {
+	for i := range s.idempotencyRecords {
+		if s.idempotencyRecords[i].Scope == scope && s.idempotencyRecords[i].Key == key {
+			return &s.idempotencyRecords[i]
+		}
+	}
+
+	return nil
+}
+
+// Finds the lockout of a username that is still in effect, the caller must hold the lock
+func (s *memoryStore) activeLockout(username string) *accountLockout {
+	now := time.Now()
+	for i := len(s.lockouts) - 1; i >= 0; i-- {
+		ml := &s.lockouts[i]
+		if ml.Username == username && ml.UnlockedAt == nil && ml.LockedUntil.After(now) {
+			return ml
+		}
+	}
+
+	return nil
+}
+
+// Finds a login session by sessionId, the caller must hold the lock
+func (s *memoryStore) findSession(sessionID string) *memorySession {
+	for i := range s.sessions {
+		if s.sessions[i].SessionID == sessionID {
+			return &s.sessions[i]
+		}
+	}
+
+	return nil
+}
+
+// Finds an order by orderId, the caller must hold the lock
+func (s *memoryStore) findOrder(orderID int) *memoryOrder {
+	for i := range s.orders {
+		if s.orders[i].OrderID == orderID {
+			return &s.orders[i]
+		}
+	}
+
+	return nil
+}
+
+// Collects the items of an order, the caller must hold the lock
+func (s *memoryStore) itemsOf(orderID int) []orderItem {
+	items := []orderItem{}
+	for _, mi := range s.orderItems {
+		if mi.OrderID == orderID {
+			items = append(items, mi.orderItem)
+		}
+	}
+
+	return items
+}
+
+// Finds an available pizza by pizzaId, the caller must hold the lock
+func (s *memoryStore) findPizza(pizzaID int) (pizza, bool) {
+	for _, mp := range s.pizzas {
+		if mp.PizzaID == pizzaID && !mp.IsDeleted {
+			return mp.pizza, true
+		}
+	}
+
+	return pizza{}, false
+}
+
+// Resolves a statusId to its status name, the caller must hold the lock
+func (s *memoryStore) statusName(statusID int) (string, error) {
+	for _, ms := range s.statuses {
+		if ms.StatusID == statusID {
+			return ms.StatusName, nil
+		}
+	}
+
+	return "", sql.ErrNoRows
+}
+
+// Rounds a price to two decimal places
+func roundPrice(price float64) float64 {
+	return math.Round(price*100) / 100
+}
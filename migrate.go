@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Bookkeeping table that records the applied migrations
+const migrationsTable = "SCHEMA_MIGRATIONS"
+
+// Arbitrary key for the Postgres advisory lock that serializes concurrent migration runs
+const migrationsLockKey = 7234001
+
+// Create a struct that holds a single versioned schema change
+// 'UpFunc' is an optional Go step that runs after 'Up' in the same transaction, for data changes SQL cannot express.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	UpFunc  func(tx *sql.Tx) error
+	Down    string
+}
+
+// Create a struct that holds the state of a migration in the DB
+type migrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt"`
+}
+
+// Returns the version of the newest migration compiled into the binary
+func latestMigrationVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Creates the bookkeeping table if it does not exist yet
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+	version INTEGER PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	appliedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	return err
+}
+
+// Retrieves the applied migrations keyed by version
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, appliedAt FROM " + migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Retrieves the highest applied migration version, 0 if none has been applied
+func schemaVersion(db *sql.DB) (int, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + migrationsTable).Scan(&version)
+	return version, err
+}
+
+// Lists every known migration along with the time it was applied
+func migrateStatus(db *sql.DB) ([]migrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []migrationStatus{}
+	for _, m := range migrations {
+		ms := migrationStatus{Version: m.Version, Name: m.Name}
+		if appliedAt, ok := applied[m.Version]; ok {
+			ms.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, ms)
+	}
+
+	return statuses, nil
+}
+
+// Applies every pending migration in order, each in its own transaction
+func migrateUp(db *sql.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		m := m
+		applied := false
+
+		err := withMigrationLock(db, func(tx *sql.Tx) error {
+			// Another instance may have applied the migration while we waited for the lock
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM "+migrationsTable+" WHERE version = $1)", m.Version).Scan(&applied); err != nil || applied {
+				return err
+			}
+			if m.Up != "" {
+				if _, err := tx.Exec(m.Up); err != nil {
+					return err
+				}
+			}
+			if m.UpFunc != nil {
+				if err := m.UpFunc(tx); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec("INSERT INTO "+migrationsTable+" (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		if !applied {
+			log.Printf("Applied migration %d (%s)\n", m.Version, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// Rolls back the most recently applied migration
+func migrateDown(db *sql.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	var rolledBack *migration
+	err := withMigrationLock(db, func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + migrationsTable).Scan(&version); err != nil {
+			return err
+		}
+		if version == 0 {
+			return errors.New("no migration to roll back")
+		}
+
+		for i := range migrations {
+			if migrations[i].Version != version {
+				continue
+			}
+			if _, err := tx.Exec(migrations[i].Down); err != nil {
+				return fmt.Errorf("migration %d (%s): %v", version, migrations[i].Name, err)
+			}
+			rolledBack = &migrations[i]
+			_, err := tx.Exec("DELETE FROM "+migrationsTable+" WHERE version = $1", version)
+			return err
+		}
+
+		return fmt.Errorf("applied migration %d is unknown to this binary", version)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rolled back migration %d (%s)\n", rolledBack.Version, rolledBack.Name)
+	return nil
+}
+
+// Runs fn in a transaction that holds the migrations advisory lock,
+// so two instances never migrate the same DB at once
+func withMigrationLock(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationsLockKey); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Checks that every migration compiled into the binary has been applied
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if latest := latestMigrationVersion(); version < latest {
+		return fmt.Errorf("database schema is at version %d, expected %d; run 'migrate up'", version, latest)
+	}
+
+	return nil
+}
+
+// Runs the 'migrate' command: migrate up|down|status
+func runMigrateCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: pizza-api-service migrate up|down|status")
+		os.Exit(2)
+	}
+
+	db := openDB()
+	defer db.Close()
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = migrateUp(db)
+	case "down":
+		err = migrateDown(db)
+	case "status":
+		var statuses []migrationStatus
+		statuses, err = migrateStatus(db)
+		for _, ms := range statuses {
+			applied := "pending"
+			if ms.AppliedAt != nil {
+				applied = "applied at " + ms.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s %s\n", ms.Version, ms.Name, applied)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q, expected up, down, or status\n", args[0])
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Database driver that records the statements of the migrations and keeps the applied versions
+// It understands the bookkeeping queries of 'migrate.go', every other statement succeeds without rows.
+type fakeMigrationDB struct {
+	mu       sync.Mutex
+	applied  map[int]time.Time
+	executed []string
+
+	// Statement that fails, to test a failed migration
+	failing string
+}
+
+// Pending changes to the bookkeeping table, applied on commit
+type fakeMigrationTx struct {
+	db       *fakeMigrationDB
+	inserted []int
+	deleted  []int
+}
+
+type fakeMigrationConn struct {
+	db *fakeMigrationDB
+	tx *fakeMigrationTx
+}
+
+type fakeMigrationStmt struct {
+	conn  *fakeMigrationConn
+	query string
+}
+
+type fakeMigrationRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+// Databases of the running tests, keyed by data source name
+var fakeMigrationDBs = struct {
+	sync.Mutex
+	dbs map[string]*fakeMigrationDB
+}{dbs: map[string]*fakeMigrationDB{}}
+
+type fakeMigrationDriver struct{}
+
+func init() {
+	sql.Register("fakemigrations", fakeMigrationDriver{})
+}
+
+func (fakeMigrationDriver) Open(name string) (driver.Conn, error) {
+	fakeMigrationDBs.Lock()
+	defer fakeMigrationDBs.Unlock()
+
+	return &fakeMigrationConn{db: fakeMigrationDBs.dbs[name]}, nil
+}
+
+func (c *fakeMigrationConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeMigrationStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeMigrationConn) Close() error { return nil }
+
+func (c *fakeMigrationConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeMigrationTx{db: c.db}
+	return c.tx, nil
+}
+
+func (tx *fakeMigrationTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	for _, version := range tx.inserted {
+		tx.db.applied[version] = time.Now()
+	}
+	for _, version := range tx.deleted {
+		delete(tx.db.applied, version)
+	}
+	return nil
+}
+
+func (tx *fakeMigrationTx) Rollback() error { return nil }
+
+func (s *fakeMigrationStmt) Close() error  { return nil }
+func (s *fakeMigrationStmt) NumInput() int { return -1 }
+
+func (s *fakeMigrationStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db, tx := s.conn.db, s.conn.tx
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.failing != "" && s.query == db.failing {
+		return nil, errors.New("syntax error")
+	}
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO "+migrationsTable):
+		tx.inserted = append(tx.inserted, int(args[0].(int64)))
+	case strings.HasPrefix(s.query, "DELETE FROM "+migrationsTable):
+		tx.deleted = append(tx.deleted, int(args[0].(int64)))
+	case strings.Contains(s.query, migrationsTable), strings.Contains(s.query, "pg_advisory_xact_lock"):
+	default:
+		db.executed = append(db.executed, s.query)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeMigrationStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "SELECT EXISTS"):
+		_, ok := db.applied[int(args[0].(int64))]
+		return &fakeMigrationRows{columns: []string{"exists"}, values: [][]driver.Value{{ok}}}, nil
+	case strings.Contains(s.query, "MAX(version)"):
+		max := int64(0)
+		for version := range db.applied {
+			if int64(version) > max {
+				max = int64(version)
+			}
+		}
+		return &fakeMigrationRows{columns: []string{"version"}, values: [][]driver.Value{{max}}}, nil
+	case strings.HasPrefix(s.query, "SELECT version, appliedAt"):
+		rows := &fakeMigrationRows{columns: []string{"version", "appliedAt"}}
+		for version, appliedAt := range db.applied {
+			rows.values = append(rows.values, []driver.Value{int64(version), appliedAt})
+		}
+		return rows, nil
+	}
+
+	// The data migrations find nothing to rewrite
+	db.executed = append(db.executed, s.query)
+	return &fakeMigrationRows{columns: []string{"id", "value"}}, nil
+}
+
+func (r *fakeMigrationRows) Columns() []string { return r.columns }
+func (r *fakeMigrationRows) Close() error      { return nil }
+
+func (r *fakeMigrationRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// Opens an empty database on the fake driver
+func openFakeMigrationDB(t *testing.T) (*sql.DB, *fakeMigrationDB) {
+	t.Helper()
+
+	fake := &fakeMigrationDB{applied: map[int]time.Time{}}
+	fakeMigrationDBs.Lock()
+	fakeMigrationDBs.dbs[t.Name()] = fake
+	fakeMigrationDBs.Unlock()
+
+	db, err := sql.Open("fakemigrations", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	names := map[string]bool{}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %s: expected version %d, got %d", m.Name, i+1, m.Version)
+		}
+		if m.Name == "" || names[m.Name] {
+			t.Errorf("migration %d: expected a unique name, got %q", m.Version, m.Name)
+		}
+		names[m.Name] = true
+		if m.Up == "" && m.UpFunc == nil {
+			t.Errorf("migration %d (%s) changes nothing", m.Version, m.Name)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %d (%s) cannot be rolled back", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrateUpAppliesThePendingMigrationsInOrder(t *testing.T) {
+	db, fake := openFakeMigrationDB(t)
+
+	if err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{}
+	for _, m := range migrations {
+		if m.Up != "" {
+			want = append(want, m.Up)
+		}
+	}
+	ups := []string{}
+	for _, query := range fake.executed {
+		if !strings.HasPrefix(query, "SELECT") {
+			ups = append(ups, query)
+		}
+	}
+	if strings.Join(ups, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected the %d migrations to run in order, got %d statements", len(want), len(ups))
+	}
+	if version, err := schemaVersion(db); err != nil || version != latestMigrationVersion() {
+		t.Errorf("expected version %d, got %d %v", latestMigrationVersion(), version, err)
+	}
+
+	// A second run has nothing to apply
+	fake.executed = nil
+	if err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.executed) != 0 {
+		t.Errorf("expected no migration to run again, got %d statements", len(fake.executed))
+	}
+
+	statuses, err := migrateStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("expected migration %d to be applied", s.Version)
+		}
+	}
+}
+
+func TestMigrateUpStopsAtAFailedMigration(t *testing.T) {
+	db, fake := openFakeMigrationDB(t)
+	failed := migrations[2]
+	fake.failing = failed.Up
+
+	err := migrateUp(db)
+	if err == nil || !strings.Contains(err.Error(), "migration 3 ("+failed.Name+")") {
+		t.Fatalf("expected migration 3 to fail, got %v", err)
+	}
+
+	// The failed migration is not recorded, and the later ones do not run
+	if version, err := schemaVersion(db); err != nil || version != 2 {
+		t.Errorf("expected version 2, got %d %v", version, err)
+	}
+	for _, query := range fake.executed {
+		if query == migrations[3].Up {
+			t.Error("expected the migrations after the failed one not to run")
+		}
+	}
+
+	// Once fixed, the run resumes at the failed migration
+	fake.failing = ""
+	if err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schemaVersion(db); err != nil || version != latestMigrationVersion() {
+		t.Errorf("expected version %d, got %d %v", latestMigrationVersion(), version, err)
+	}
+}
+
+func TestMigrateDownRollsBackTheLatestMigration(t *testing.T) {
+	db, fake := openFakeMigrationDB(t)
+
+	if err := migrateDown(db); err == nil {
+		t.Error("expected an error when no migration is applied")
+	}
+	if err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []migration{migrations[len(migrations)-1], migrations[len(migrations)-2]} {
+		fake.executed = nil
+		if err := migrateDown(db); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.executed) != 1 || fake.executed[0] != m.Down {
+			t.Errorf("expected the rollback of migration %d, got %v", m.Version, fake.executed)
+		}
+		if version, err := schemaVersion(db); err != nil || version != m.Version-1 {
+			t.Errorf("expected version %d, got %d %v", m.Version-1, version, err)
+		}
+	}
+}
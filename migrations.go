@@ -0,0 +1,836 @@
+package main
+
+// Versioned schema migrations, compiled into the binary.
+// Append new migrations to the end of the list, never edit one that has been released.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_tables",
+		Up: `
+CREATE TABLE IF NOT EXISTS CUSTOMERS (
+	customerId SERIAL PRIMARY KEY,
+	firstName VARCHAR(50) NOT NULL,
+	lastName VARCHAR(50) NOT NULL,
+	customerPhoneNumber VARCHAR(20) NOT NULL,
+	username VARCHAR(62) NOT NULL UNIQUE,
+	password VARCHAR(60) NOT NULL,
+	isDeleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS PIZZAS (
+	pizzaId SERIAL PRIMARY KEY,
+	pizzaName VARCHAR(50) NOT NULL,
+	pizzaPrice NUMERIC(10, 2) NOT NULL,
+	isDeleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS ORDER_STATUS_CODES (
+	statusId SERIAL PRIMARY KEY,
+	statusName VARCHAR(30) NOT NULL,
+	isDeleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS ORDERS (
+	orderId SERIAL PRIMARY KEY,
+	pizzaId INTEGER NOT NULL REFERENCES PIZZAS (pizzaId),
+	orderTime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	customerPhoneNumber VARCHAR(20) NOT NULL,
+	statusId INTEGER NOT NULL REFERENCES ORDER_STATUS_CODES (statusId),
+	totalPrice NUMERIC(10, 2) NOT NULL,
+	isDeleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS ORDERS_CUSTOMER_PHONE_NUMBER_IDX ON ORDERS (customerPhoneNumber);
+`,
+		Down: `
+DROP TABLE IF EXISTS ORDERS;
+DROP TABLE IF EXISTS ORDER_STATUS_CODES;
+DROP TABLE IF EXISTS PIZZAS;
+DROP TABLE IF EXISTS CUSTOMERS;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "seed_pizzas_and_status_codes",
+		Up: `
+INSERT INTO PIZZAS (pizzaId, pizzaName, pizzaPrice) VALUES
+	(1, 'Cheese Pizza', 6.99),
+	(2, 'Veggie Pizza', 7.99),
+	(3, 'Pepperoni Pizza', 6.99),
+	(4, 'Meat Pizza', 7.99),
+	(5, 'Margherita Pizza', 8.99),
+	(6, 'BBQ Chicken Pizza', 8.99),
+	(7, 'Hawaiian Pizza', 7.99),
+	(8, 'Buffalo Pizza', 10.99),
+	(9, 'Supreme Pizza', 12.99)
+ON CONFLICT (pizzaId) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('PIZZAS', 'pizzaid'), (SELECT MAX(pizzaId) FROM PIZZAS));
+
+INSERT INTO ORDER_STATUS_CODES (statusId, statusName) VALUES
+	(1, 'Order Received'),
+	(2, 'Making Your Pizza'),
+	(3, 'Ready for Pick Up'),
+	(4, 'Picked Up'),
+	(5, 'Canceled')
+ON CONFLICT (statusId) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('ORDER_STATUS_CODES', 'statusid'), (SELECT MAX(statusId) FROM ORDER_STATUS_CODES));
+`,
+		Down: `
+DELETE FROM ORDER_STATUS_CODES WHERE statusId BETWEEN 1 AND 5;
+DELETE FROM PIZZAS WHERE pizzaId BETWEEN 1 AND 9;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "create_stored_procedures",
+		Up: `
+-- Create a customer (PAS_SP_CREATE_CUSTOMER)
+CREATE OR REPLACE PROCEDURE PAS_SP_CREATE_CUSTOMER(
+	IN p_firstName VARCHAR(50),
+	IN p_lastName VARCHAR(50),
+	IN p_customerPhoneNumber VARCHAR(20),
+	IN p_userName VARCHAR(62),
+	IN p_password VARCHAR(60),
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	INSERT INTO CUSTOMERS VALUES (DEFAULT, TRIM(p_firstName), TRIM(p_lastName), TRIM(p_customerPhoneNumber), TRIM(p_userName), TRIM(p_password), FALSE) RETURNING customerId;
+$$;
+
+-- Create an order (PAS_SP_CREATE_ORDER)
+CREATE OR REPLACE PROCEDURE PAS_SP_CREATE_ORDER(
+	IN p_pizzaId INTEGER,
+	IN p_customerPhoneNumber VARCHAR(20),
+	INOUT _orderId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	INSERT INTO ORDERS VALUES (DEFAULT, p_pizzaId, CURRENT_TIMESTAMP, TRIM(p_customerPhoneNumber), 1,
+		ROUND(((SELECT p.pizzaPrice FROM PIZZAS p where p.pizzaId = p_pizzaId) * 1.0625), 2),
+		FALSE) RETURNING orderId;
+$$;
+
+-- Fetch an order status (PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER)
+CREATE OR REPLACE PROCEDURE PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER(
+	IN p_orderId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+-- Cancel an order (PAS_SP_CANCEL_ORDER)
+CREATE OR REPLACE PROCEDURE PAS_SP_CANCEL_ORDER(
+	IN p_orderId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = 5 WHERE orderId = p_orderId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+-- Update an order status (PAS_SP_UPDATE_ORDER_STATUS)
+CREATE OR REPLACE PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(
+	IN p_orderId INTEGER,
+	IN p_statusId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = p_statusId WHERE orderId = p_orderId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+-- Fetch a password given the username (PAS_SP_GET_CUSTOMER_PASSWORD)
+CREATE OR REPLACE PROCEDURE PAS_SP_GET_CUSTOMER_PASSWORD(
+	IN p_userName VARCHAR(62),
+	INOUT _password VARCHAR(60) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT password FROM CUSTOMERS WHERE username = p_userName;
+$$;
+`,
+		Down: `
+DROP PROCEDURE IF EXISTS PAS_SP_GET_CUSTOMER_PASSWORD;
+DROP PROCEDURE IF EXISTS PAS_SP_UPDATE_ORDER_STATUS;
+DROP PROCEDURE IF EXISTS PAS_SP_CANCEL_ORDER;
+DROP PROCEDURE IF EXISTS PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER;
+DROP PROCEDURE IF EXISTS PAS_SP_CREATE_ORDER;
+DROP PROCEDURE IF EXISTS PAS_SP_CREATE_CUSTOMER;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "create_order_items",
+		Up: `
+CREATE TABLE ORDER_ITEMS (
+	orderItemId SERIAL PRIMARY KEY,
+	orderId INTEGER NOT NULL REFERENCES ORDERS (orderId),
+	pizzaId INTEGER NOT NULL REFERENCES PIZZAS (pizzaId),
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	unitPrice NUMERIC(10, 2) NOT NULL
+);
+
+CREATE INDEX ORDER_ITEMS_ORDER_ID_IDX ON ORDER_ITEMS (orderId);
+
+-- Existing orders hold a single pizza, recover its price from the taxed total
+INSERT INTO ORDER_ITEMS (orderId, pizzaId, quantity, unitPrice)
+	SELECT orderId, pizzaId, 1, ROUND(totalPrice / 1.0625, 2) FROM ORDERS WHERE pizzaId IS NOT NULL;
+
+ALTER TABLE ORDERS ALTER COLUMN pizzaId DROP NOT NULL;
+
+DROP PROCEDURE PAS_SP_CREATE_ORDER(INTEGER, VARCHAR, INTEGER);
+
+-- Create an order with its items (PAS_SP_CREATE_ORDER)
+-- Snapshots the current pizza prices and computes the taxed total from the items
+CREATE PROCEDURE PAS_SP_CREATE_ORDER(
+	IN p_customerPhoneNumber VARCHAR(20),
+	IN p_pizzaIds INTEGER[],
+	IN p_quantities INTEGER[],
+	INOUT _orderId INTEGER DEFAULT null
+)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+	v_missingPizzaId INTEGER;
+BEGIN
+	SELECT i.pizzaId INTO v_missingPizzaId FROM UNNEST(p_pizzaIds) AS i(pizzaId)
+		WHERE NOT EXISTS (SELECT 1 FROM PIZZAS p WHERE p.pizzaId = i.pizzaId AND p.isDeleted = FALSE) LIMIT 1;
+	IF v_missingPizzaId IS NOT NULL THEN
+		RAISE EXCEPTION 'pizza % is not available', v_missingPizzaId USING ERRCODE = 'foreign_key_violation';
+	END IF;
+
+	INSERT INTO ORDERS (orderTime, customerPhoneNumber, statusId, totalPrice, isDeleted)
+		VALUES (CURRENT_TIMESTAMP, TRIM(p_customerPhoneNumber), 1, 0, FALSE) RETURNING orderId INTO _orderId;
+
+	INSERT INTO ORDER_ITEMS (orderId, pizzaId, quantity, unitPrice)
+		SELECT _orderId, i.pizzaId, i.quantity, p.pizzaPrice
+		FROM UNNEST(p_pizzaIds, p_quantities) AS i(pizzaId, quantity)
+		INNER JOIN PIZZAS p ON p.pizzaId = i.pizzaId;
+
+	UPDATE ORDERS SET totalPrice = (SELECT ROUND(SUM(unitPrice * quantity) * 1.0625, 2) FROM ORDER_ITEMS WHERE orderId = _orderId)
+		WHERE orderId = _orderId;
+END;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_CREATE_ORDER(VARCHAR, INTEGER[], INTEGER[], INTEGER);
+
+-- Create an order (PAS_SP_CREATE_ORDER)
+CREATE PROCEDURE PAS_SP_CREATE_ORDER(
+	IN p_pizzaId INTEGER,
+	IN p_customerPhoneNumber VARCHAR(20),
+	INOUT _orderId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	INSERT INTO ORDERS VALUES (DEFAULT, p_pizzaId, CURRENT_TIMESTAMP, TRIM(p_customerPhoneNumber), 1,
+		ROUND(((SELECT p.pizzaPrice FROM PIZZAS p where p.pizzaId = p_pizzaId) * 1.0625), 2),
+		FALSE) RETURNING orderId;
+$$;
+
+-- Multi-item orders keep their first pizza only
+UPDATE ORDERS AS o SET pizzaId = (SELECT oi.pizzaId FROM ORDER_ITEMS oi WHERE oi.orderId = o.orderId ORDER BY oi.orderItemId LIMIT 1)
+	WHERE o.pizzaId IS NULL;
+
+ALTER TABLE ORDERS ALTER COLUMN pizzaId SET NOT NULL;
+
+DROP TABLE ORDER_ITEMS;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "order_status_transitions",
+		Up: `
+DROP PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(INTEGER, INTEGER, VARCHAR);
+
+-- Update an order status if it is still in the expected status (PAS_SP_UPDATE_ORDER_STATUS)
+-- Returns the order status after the update, which differs from the requested one when the order moved concurrently
+CREATE PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(
+	IN p_orderId INTEGER,
+	IN p_fromStatusId INTEGER,
+	IN p_toStatusId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = p_toStatusId WHERE orderId = p_orderId AND statusId = p_fromStatusId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+-- Canceling an order is a regular status transition now
+DROP PROCEDURE PAS_SP_CANCEL_ORDER(INTEGER, VARCHAR);
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(INTEGER, INTEGER, INTEGER, VARCHAR);
+
+-- Update an order status (PAS_SP_UPDATE_ORDER_STATUS)
+CREATE PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(
+	IN p_orderId INTEGER,
+	IN p_statusId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = p_statusId WHERE orderId = p_orderId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+-- Cancel an order (PAS_SP_CANCEL_ORDER)
+CREATE PROCEDURE PAS_SP_CANCEL_ORDER(
+	IN p_orderId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = 5 WHERE orderId = p_orderId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "create_order_status_history",
+		Up: `
+CREATE TABLE ORDER_STATUS_HISTORY (
+	historyId SERIAL PRIMARY KEY,
+	orderId INTEGER NOT NULL REFERENCES ORDERS (orderId),
+	fromStatusId INTEGER NOT NULL REFERENCES ORDER_STATUS_CODES (statusId),
+	toStatusId INTEGER NOT NULL REFERENCES ORDER_STATUS_CODES (statusId),
+	changedBy VARCHAR(62) NOT NULL,
+	changedById INTEGER REFERENCES CUSTOMERS (customerId),
+	changedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX ORDER_STATUS_HISTORY_ORDER_ID_IDX ON ORDER_STATUS_HISTORY (orderId);
+CREATE INDEX ORDER_STATUS_HISTORY_CHANGED_BY_ID_IDX ON ORDER_STATUS_HISTORY (changedById);
+
+DROP PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(INTEGER, INTEGER, INTEGER, VARCHAR);
+
+-- Update an order status if it is still in the expected status, and record the change (PAS_SP_UPDATE_ORDER_STATUS)
+-- Returns the order status after the update, which differs from the requested one when the order moved concurrently
+CREATE PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(
+	IN p_orderId INTEGER,
+	IN p_fromStatusId INTEGER,
+	IN p_toStatusId INTEGER,
+	IN p_changedBy VARCHAR(62),
+	IN p_changedById INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	WITH updated AS (
+		UPDATE ORDERS SET statusId = p_toStatusId WHERE orderId = p_orderId AND statusId = p_fromStatusId RETURNING orderId
+	)
+	INSERT INTO ORDER_STATUS_HISTORY (orderId, fromStatusId, toStatusId, changedBy, changedById)
+		SELECT orderId, p_fromStatusId, p_toStatusId, p_changedBy, p_changedById FROM updated;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(INTEGER, INTEGER, INTEGER, VARCHAR, INTEGER, VARCHAR);
+
+-- Update an order status if it is still in the expected status (PAS_SP_UPDATE_ORDER_STATUS)
+CREATE PROCEDURE PAS_SP_UPDATE_ORDER_STATUS(
+	IN p_orderId INTEGER,
+	IN p_fromStatusId INTEGER,
+	IN p_toStatusId INTEGER,
+	INOUT _orderStatus VARCHAR(30) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET statusId = p_toStatusId WHERE orderId = p_orderId AND statusId = p_fromStatusId;
+	SELECT sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE o.orderId = p_orderId;
+$$;
+
+DROP TABLE ORDER_STATUS_HISTORY;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "customer_roles",
+		Up: `
+ALTER TABLE CUSTOMERS ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'customer'
+	CHECK (role IN ('customer', 'employee', 'manager', 'admin'));
+
+DROP PROCEDURE PAS_SP_GET_CUSTOMER_PASSWORD(VARCHAR, VARCHAR);
+
+-- Fetch the customer id, password, and role given the username (PAS_SP_GET_CUSTOMER_CREDENTIALS)
+CREATE PROCEDURE PAS_SP_GET_CUSTOMER_CREDENTIALS(
+	IN p_userName VARCHAR(62),
+	INOUT _customerId INTEGER DEFAULT null,
+	INOUT _password VARCHAR(60) DEFAULT null,
+	INOUT _role VARCHAR(20) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT customerId, password, role FROM CUSTOMERS WHERE username = p_userName;
+$$;
+
+-- Change the role of a customer given the username (PAS_SP_UPDATE_CUSTOMER_ROLE)
+CREATE PROCEDURE PAS_SP_UPDATE_CUSTOMER_ROLE(
+	IN p_userName VARCHAR(62),
+	IN p_role VARCHAR(20),
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE CUSTOMERS SET role = p_role WHERE username = p_userName RETURNING customerId;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_UPDATE_CUSTOMER_ROLE(VARCHAR, VARCHAR, INTEGER);
+DROP PROCEDURE PAS_SP_GET_CUSTOMER_CREDENTIALS(VARCHAR, INTEGER, VARCHAR, VARCHAR);
+
+-- Fetch a password given the username (PAS_SP_GET_CUSTOMER_PASSWORD)
+CREATE PROCEDURE PAS_SP_GET_CUSTOMER_PASSWORD(
+	IN p_userName VARCHAR(62),
+	INOUT _password VARCHAR(60) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT password FROM CUSTOMERS WHERE username = p_userName;
+$$;
+
+ALTER TABLE CUSTOMERS DROP COLUMN role;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "order_customer_ownership",
+		Up: `
+ALTER TABLE ORDERS ADD COLUMN customerId INTEGER REFERENCES CUSTOMERS (customerId);
+
+CREATE INDEX ORDERS_CUSTOMER_ID_IDX ON ORDERS (customerId);
+
+-- Link existing orders to the customer with the same phone number, when exactly one customer has it
+UPDATE ORDERS AS o SET customerId = c.customerId
+	FROM CUSTOMERS AS c
+	WHERE c.customerPhoneNumber = o.customerPhoneNumber AND c.isDeleted = FALSE
+		AND (SELECT COUNT(*) FROM CUSTOMERS AS d WHERE d.customerPhoneNumber = o.customerPhoneNumber AND d.isDeleted = FALSE) = 1;
+
+DROP PROCEDURE PAS_SP_CREATE_ORDER(VARCHAR, INTEGER[], INTEGER[], INTEGER);
+
+-- Create an order with its items for a customer (PAS_SP_CREATE_ORDER)
+-- Snapshots the current pizza prices and computes the taxed total from the items
+CREATE PROCEDURE PAS_SP_CREATE_ORDER(
+	IN p_customerId INTEGER,
+	IN p_customerPhoneNumber VARCHAR(20),
+	IN p_pizzaIds INTEGER[],
+	IN p_quantities INTEGER[],
+	INOUT _orderId INTEGER DEFAULT null
+)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+	v_missingPizzaId INTEGER;
+BEGIN
+	SELECT i.pizzaId INTO v_missingPizzaId FROM UNNEST(p_pizzaIds) AS i(pizzaId)
+		WHERE NOT EXISTS (SELECT 1 FROM PIZZAS p WHERE p.pizzaId = i.pizzaId AND p.isDeleted = FALSE) LIMIT 1;
+	IF v_missingPizzaId IS NOT NULL THEN
+		RAISE EXCEPTION 'pizza % is not available', v_missingPizzaId USING ERRCODE = 'foreign_key_violation';
+	END IF;
+
+	INSERT INTO ORDERS (customerId, orderTime, customerPhoneNumber, statusId, totalPrice, isDeleted)
+		VALUES (NULLIF(p_customerId, 0), CURRENT_TIMESTAMP, TRIM(p_customerPhoneNumber), 1, 0, FALSE) RETURNING orderId INTO _orderId;
+
+	INSERT INTO ORDER_ITEMS (orderId, pizzaId, quantity, unitPrice)
+		SELECT _orderId, i.pizzaId, i.quantity, p.pizzaPrice
+		FROM UNNEST(p_pizzaIds, p_quantities) AS i(pizzaId, quantity)
+		INNER JOIN PIZZAS p ON p.pizzaId = i.pizzaId;
+
+	UPDATE ORDERS SET totalPrice = (SELECT ROUND(SUM(unitPrice * quantity) * 1.0625, 2) FROM ORDER_ITEMS WHERE orderId = _orderId)
+		WHERE orderId = _orderId;
+END;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_CREATE_ORDER(INTEGER, VARCHAR, INTEGER[], INTEGER[], INTEGER);
+
+-- Create an order with its items (PAS_SP_CREATE_ORDER)
+CREATE PROCEDURE PAS_SP_CREATE_ORDER(
+	IN p_customerPhoneNumber VARCHAR(20),
+	IN p_pizzaIds INTEGER[],
+	IN p_quantities INTEGER[],
+	INOUT _orderId INTEGER DEFAULT null
+)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+	v_missingPizzaId INTEGER;
+BEGIN
+	SELECT i.pizzaId INTO v_missingPizzaId FROM UNNEST(p_pizzaIds) AS i(pizzaId)
+		WHERE NOT EXISTS (SELECT 1 FROM PIZZAS p WHERE p.pizzaId = i.pizzaId AND p.isDeleted = FALSE) LIMIT 1;
+	IF v_missingPizzaId IS NOT NULL THEN
+		RAISE EXCEPTION 'pizza % is not available', v_missingPizzaId USING ERRCODE = 'foreign_key_violation';
+	END IF;
+
+	INSERT INTO ORDERS (orderTime, customerPhoneNumber, statusId, totalPrice, isDeleted)
+		VALUES (CURRENT_TIMESTAMP, TRIM(p_customerPhoneNumber), 1, 0, FALSE) RETURNING orderId INTO _orderId;
+
+	INSERT INTO ORDER_ITEMS (orderId, pizzaId, quantity, unitPrice)
+		SELECT _orderId, i.pizzaId, i.quantity, p.pizzaPrice
+		FROM UNNEST(p_pizzaIds, p_quantities) AS i(pizzaId, quantity)
+		INNER JOIN PIZZAS p ON p.pizzaId = i.pizzaId;
+
+	UPDATE ORDERS SET totalPrice = (SELECT ROUND(SUM(unitPrice * quantity) * 1.0625, 2) FROM ORDER_ITEMS WHERE orderId = _orderId)
+		WHERE orderId = _orderId;
+END;
+$$;
+
+ALTER TABLE ORDERS DROP COLUMN customerId;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "auth_sessions",
+		Up: `
+CREATE TABLE AUTH_SESSIONS (
+	sessionId VARCHAR(32) PRIMARY KEY,
+	customerId INTEGER NOT NULL REFERENCES CUSTOMERS (customerId),
+	username VARCHAR(62) NOT NULL,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	revokedAt TIMESTAMPTZ
+);
+
+CREATE INDEX AUTH_SESSIONS_CUSTOMER_ID_IDX ON AUTH_SESSIONS (customerId);
+
+-- Only the SHA-256 hash of a refresh token is stored
+CREATE TABLE REFRESH_TOKENS (
+	tokenHash CHAR(64) PRIMARY KEY,
+	sessionId VARCHAR(32) NOT NULL REFERENCES AUTH_SESSIONS (sessionId),
+	expiresAt TIMESTAMPTZ NOT NULL,
+	usedAt TIMESTAMPTZ,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX REFRESH_TOKENS_SESSION_ID_IDX ON REFRESH_TOKENS (sessionId);
+
+-- Access token ids (jti) that were revoked before they expired
+CREATE TABLE DENIED_TOKENS (
+	tokenId VARCHAR(32) PRIMARY KEY,
+	expiresAt TIMESTAMPTZ NOT NULL
+);
+`,
+		Down: `
+DROP TABLE DENIED_TOKENS;
+DROP TABLE REFRESH_TOKENS;
+DROP TABLE AUTH_SESSIONS;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "account_lockouts",
+		Up: `
+-- Lockouts are recorded per username, whether or not the username exists
+-- 'customerId' is the account holding the username when it was locked, NULL for an unknown username
+CREATE TABLE ACCOUNT_LOCKOUTS (
+	lockoutId SERIAL PRIMARY KEY,
+	username VARCHAR(62) NOT NULL,
+	customerId INTEGER REFERENCES CUSTOMERS (customerId),
+	ipAddress VARCHAR(45) NOT NULL,
+	failedAttempts INTEGER NOT NULL,
+	lockedAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	lockedUntil TIMESTAMPTZ NOT NULL,
+	unlockedAt TIMESTAMPTZ,
+	unlockedBy VARCHAR(62)
+);
+
+CREATE INDEX ACCOUNT_LOCKOUTS_USERNAME_IDX ON ACCOUNT_LOCKOUTS (username, lockedUntil);
+CREATE INDEX ACCOUNT_LOCKOUTS_CUSTOMER_ID_IDX ON ACCOUNT_LOCKOUTS (customerId);
+`,
+		Down: `
+DROP TABLE ACCOUNT_LOCKOUTS;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "password_resets",
+		Up: `
+-- Only the SHA-256 hash of a reset token is stored
+CREATE TABLE PASSWORD_RESETS (
+	tokenHash CHAR(64) PRIMARY KEY,
+	customerId INTEGER NOT NULL REFERENCES CUSTOMERS (customerId),
+	username VARCHAR(62) NOT NULL,
+	expiresAt TIMESTAMPTZ NOT NULL,
+	usedAt TIMESTAMPTZ,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX PASSWORD_RESETS_CUSTOMER_ID_IDX ON PASSWORD_RESETS (customerId);
+
+-- Replace the password of a customer given the customer id (PAS_SP_UPDATE_CUSTOMER_PASSWORD)
+CREATE PROCEDURE PAS_SP_UPDATE_CUSTOMER_PASSWORD(
+	IN p_customerId INTEGER,
+	IN p_password VARCHAR(60),
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE CUSTOMERS SET password = TRIM(p_password) WHERE customerId = p_customerId RETURNING customerId;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_UPDATE_CUSTOMER_PASSWORD(INTEGER, VARCHAR, INTEGER);
+DROP TABLE PASSWORD_RESETS;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "two_factor",
+		Up: `
+-- The secret is NULL until the customer enrolls, 'required' is set by managers
+CREATE TABLE TWO_FACTOR (
+	customerId INTEGER PRIMARY KEY REFERENCES CUSTOMERS (customerId),
+	secret VARCHAR(64),
+	confirmedAt TIMESTAMPTZ,
+	required BOOLEAN NOT NULL DEFAULT FALSE,
+	lastUsedStep BIGINT NOT NULL DEFAULT 0
+);
+
+-- Only the SHA-256 hash of a recovery code is stored
+CREATE TABLE TWO_FACTOR_RECOVERY_CODES (
+	codeHash CHAR(64) PRIMARY KEY,
+	customerId INTEGER NOT NULL REFERENCES CUSTOMERS (customerId),
+	usedAt TIMESTAMPTZ
+);
+
+CREATE INDEX TWO_FACTOR_RECOVERY_CODES_CUSTOMER_ID_IDX ON TWO_FACTOR_RECOVERY_CODES (customerId);
+`,
+		Down: `
+DROP TABLE TWO_FACTOR_RECOVERY_CODES;
+DROP TABLE TWO_FACTOR;
+`,
+	},
+	{
+		Version: 13,
+		Name:    "api_keys",
+		Up: `
+-- Only the SHA-256 hash of an API key is stored, the key id is used to look the key up
+CREATE TABLE API_KEYS (
+	keyId VARCHAR(32) PRIMARY KEY,
+	keyHash CHAR(64) NOT NULL,
+	name VARCHAR(62) NOT NULL,
+	customerId INTEGER NOT NULL REFERENCES CUSTOMERS (customerId),
+	scopes VARCHAR(30)[] NOT NULL,
+	createdBy VARCHAR(62) NOT NULL,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expiresAt TIMESTAMPTZ,
+	lastUsedAt TIMESTAMPTZ,
+	revokedAt TIMESTAMPTZ
+);
+`,
+		Down: `
+DROP TABLE API_KEYS;
+`,
+	},
+	{
+		Version: 14,
+		Name:    "customer_profile",
+		Up: `
+-- Closed accounts ('isDeleted') can no longer authenticate
+CREATE OR REPLACE PROCEDURE PAS_SP_GET_CUSTOMER_CREDENTIALS(
+	IN p_userName VARCHAR(62),
+	INOUT _customerId INTEGER DEFAULT null,
+	INOUT _password VARCHAR(60) DEFAULT null,
+	INOUT _role VARCHAR(20) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT customerId, password, role FROM CUSTOMERS WHERE username = p_userName AND isDeleted = FALSE;
+$$;
+
+-- Update the name, phone number, and username of a customer (PAS_SP_UPDATE_CUSTOMER_PROFILE)
+-- The orders of the customer follow the new phone number, so they stay linked to the customer
+CREATE PROCEDURE PAS_SP_UPDATE_CUSTOMER_PROFILE(
+	IN p_customerId INTEGER,
+	IN p_firstName VARCHAR(50),
+	IN p_lastName VARCHAR(50),
+	IN p_customerPhoneNumber VARCHAR(20),
+	IN p_userName VARCHAR(62),
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET customerPhoneNumber = TRIM(p_customerPhoneNumber)
+		WHERE customerId = p_customerId
+			AND EXISTS (SELECT 1 FROM CUSTOMERS WHERE customerId = p_customerId AND isDeleted = FALSE);
+	UPDATE CUSTOMERS SET firstName = TRIM(p_firstName), lastName = TRIM(p_lastName),
+			customerPhoneNumber = TRIM(p_customerPhoneNumber), username = TRIM(p_userName)
+		WHERE customerId = p_customerId AND isDeleted = FALSE RETURNING customerId;
+$$;
+
+-- Close the account of a customer and revoke its API keys (PAS_SP_CLOSE_CUSTOMER)
+CREATE PROCEDURE PAS_SP_CLOSE_CUSTOMER(
+	IN p_customerId INTEGER,
+	IN p_closedAt TIMESTAMPTZ,
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE API_KEYS SET revokedAt = COALESCE(revokedAt, p_closedAt) WHERE customerId = p_customerId;
+	UPDATE CUSTOMERS SET isDeleted = TRUE WHERE customerId = p_customerId AND isDeleted = FALSE RETURNING customerId;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_CLOSE_CUSTOMER(INTEGER, TIMESTAMPTZ, INTEGER);
+DROP PROCEDURE PAS_SP_UPDATE_CUSTOMER_PROFILE(INTEGER, VARCHAR, VARCHAR, VARCHAR, VARCHAR, INTEGER);
+
+CREATE OR REPLACE PROCEDURE PAS_SP_GET_CUSTOMER_CREDENTIALS(
+	IN p_userName VARCHAR(62),
+	INOUT _customerId INTEGER DEFAULT null,
+	INOUT _password VARCHAR(60) DEFAULT null,
+	INOUT _role VARCHAR(20) DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	SELECT customerId, password, role FROM CUSTOMERS WHERE username = p_userName;
+$$;
+`,
+	},
+	{
+		Version: 15,
+		Name:    "customer_erasure",
+		Up: `
+-- Anonymize the personal data of a customer and close the account (PAS_SP_ERASE_CUSTOMER)
+-- The orders keep their items, prices, and status, so the sales figures do not change
+-- The status changes and lockouts are matched on the customerId, they may have been recorded under a previous username
+-- The erased username holds a colon, which usernames cannot hold, so it never collides with an account
+CREATE PROCEDURE PAS_SP_ERASE_CUSTOMER(
+	IN p_customerId INTEGER,
+	IN p_erasedPhoneNumber VARCHAR(20),
+	IN p_erasedAt TIMESTAMPTZ,
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET customerPhoneNumber = p_erasedPhoneNumber WHERE customerId = p_customerId;
+	UPDATE ORDER_STATUS_HISTORY SET changedBy = 'erased:' || p_customerId WHERE changedById = p_customerId;
+	DELETE FROM ACCOUNT_LOCKOUTS WHERE customerId = p_customerId;
+	UPDATE AUTH_SESSIONS SET username = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	DELETE FROM PASSWORD_RESETS WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR_RECOVERY_CODES WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR WHERE customerId = p_customerId;
+	UPDATE API_KEYS SET name = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	UPDATE CUSTOMERS SET firstName = 'Erased', lastName = 'Erased', customerPhoneNumber = p_erasedPhoneNumber,
+			username = 'erased:' || p_customerId, password = '', role = 'customer', isDeleted = TRUE
+		WHERE customerId = p_customerId RETURNING customerId;
+$$;
+`,
+		Down: `
+DROP PROCEDURE PAS_SP_ERASE_CUSTOMER(INTEGER, VARCHAR, TIMESTAMPTZ, INTEGER);
+`,
+	},
+	{
+		Version: 16,
+		Name:    "e164_phone_numbers",
+		// Phone numbers are stored in E.164, the numbers stored so far are rewritten with the rules of new numbers
+		UpFunc: normalizeLegacyPhoneNumbers,
+		Down: `
+-- Only North American numbers can be written back as ten digits, other numbers are kept in E.164
+UPDATE ORDERS SET customerPhoneNumber = SUBSTRING(customerPhoneNumber FROM 3) WHERE customerPhoneNumber ~ '^\+1[2-9][0-9]{9}$';
+UPDATE CUSTOMERS SET customerPhoneNumber = SUBSTRING(customerPhoneNumber FROM 3) WHERE customerPhoneNumber ~ '^\+1[2-9][0-9]{9}$';
+`,
+	},
+	{
+		Version: 17,
+		Name:    "idempotency_keys",
+		Up: `
+-- Responses of the requests sent with an 'Idempotency-Key' header, replayed when the request is retried
+-- 'fingerprint' is the SHA-256 hash of the request, 'statusCode' is NULL while the request is in progress
+-- 'customerId' is the customer that sent the request, erasing the customer erases the responses holding their data
+CREATE TABLE IDEMPOTENCY_KEYS (
+	scope VARCHAR(200) NOT NULL,
+	idempotencyKey VARCHAR(255) NOT NULL,
+	fingerprint CHAR(64) NOT NULL,
+	customerId INTEGER NOT NULL,
+	statusCode INTEGER,
+	contentType VARCHAR(100),
+	body BYTEA,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expiresAt TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (scope, idempotencyKey)
+);
+
+CREATE INDEX IDEMPOTENCY_KEYS_EXPIRES_AT_IDX ON IDEMPOTENCY_KEYS (expiresAt);
+CREATE INDEX IDEMPOTENCY_KEYS_CUSTOMER_ID_IDX ON IDEMPOTENCY_KEYS (customerId);
+
+CREATE OR REPLACE PROCEDURE PAS_SP_ERASE_CUSTOMER(
+	IN p_customerId INTEGER,
+	IN p_erasedPhoneNumber VARCHAR(20),
+	IN p_erasedAt TIMESTAMPTZ,
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET customerPhoneNumber = p_erasedPhoneNumber WHERE customerId = p_customerId;
+	UPDATE ORDER_STATUS_HISTORY SET changedBy = 'erased:' || p_customerId WHERE changedById = p_customerId;
+	DELETE FROM ACCOUNT_LOCKOUTS WHERE customerId = p_customerId;
+	UPDATE AUTH_SESSIONS SET username = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	DELETE FROM PASSWORD_RESETS WHERE customerId = p_customerId;
+	DELETE FROM IDEMPOTENCY_KEYS WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR_RECOVERY_CODES WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR WHERE customerId = p_customerId;
+	UPDATE API_KEYS SET name = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	UPDATE CUSTOMERS SET firstName = 'Erased', lastName = 'Erased', customerPhoneNumber = p_erasedPhoneNumber,
+			username = 'erased:' || p_customerId, password = '', role = 'customer', isDeleted = TRUE
+		WHERE customerId = p_customerId RETURNING customerId;
+$$;
+`,
+		Down: `
+CREATE OR REPLACE PROCEDURE PAS_SP_ERASE_CUSTOMER(
+	IN p_customerId INTEGER,
+	IN p_erasedPhoneNumber VARCHAR(20),
+	IN p_erasedAt TIMESTAMPTZ,
+	INOUT _customerId INTEGER DEFAULT null
+)
+LANGUAGE SQL
+AS $$
+	UPDATE ORDERS SET customerPhoneNumber = p_erasedPhoneNumber WHERE customerId = p_customerId;
+	UPDATE ORDER_STATUS_HISTORY SET changedBy = 'erased:' || p_customerId WHERE changedById = p_customerId;
+	DELETE FROM ACCOUNT_LOCKOUTS WHERE customerId = p_customerId;
+	UPDATE AUTH_SESSIONS SET username = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	DELETE FROM PASSWORD_RESETS WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR_RECOVERY_CODES WHERE customerId = p_customerId;
+	DELETE FROM TWO_FACTOR WHERE customerId = p_customerId;
+	UPDATE API_KEYS SET name = 'erased:' || p_customerId, revokedAt = COALESCE(revokedAt, p_erasedAt)
+		WHERE customerId = p_customerId;
+	UPDATE CUSTOMERS SET firstName = 'Erased', lastName = 'Erased', customerPhoneNumber = p_erasedPhoneNumber,
+			username = 'erased:' || p_customerId, password = '', role = 'customer', isDeleted = TRUE
+		WHERE customerId = p_customerId RETURNING customerId;
+$$;
+
+DROP TABLE IDEMPOTENCY_KEYS;
+`,
+	},
+	{
+		Version: 18,
+		Name:    "signing_keys",
+		Up: `
+-- Keys that sign and verify the tokens, shared by every instance and kept across restarts
+-- The current key has no 'retiredAt', a retired key verifies the tokens it signed until they have expired
+-- The private key is encrypted by the application (AES-256-GCM, nonce first) with a key that is not stored in DB,
+-- it is erased once the key has expired and the row is kept so the key id stays known
+CREATE TABLE SIGNING_KEYS (
+	kid VARCHAR(64) PRIMARY KEY,
+	encryptedPrivateKey BYTEA,
+	createdAt TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	retiredAt TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX SIGNING_KEYS_CURRENT_IDX ON SIGNING_KEYS ((retiredAt IS NULL)) WHERE retiredAt IS NULL;
+`,
+		Down: `
+DROP TABLE SIGNING_KEYS;
+`,
+	},
+}
@@ -1,30 +1,67 @@
 package main
 
 import (
-	"database/sql"
 	"time"
 )
 
 // Create a struct that holds the 'customer' information
+// 'password' is only accepted on requests, it is hashed right away and never written back
 type customer struct {
 	CustomerID          int    `json:"customerId"`
 	FirstName           string `json:"firstName"`
 	LastName            string `json:"lastName"`
 	CustomerPhoneNumber string `json:"customerPhoneNumber"`
 	Username            string `json:"username"`
-	Password            string `json:"password"`
+	Password            string `json:"password,omitempty"`
+	Role                string `json:"role,omitempty"`
+	Closed              bool   `json:"closed,omitempty"`
+}
+
+// Create a struct that holds the body of a profile update request
+// Fields that are left out are not changed
+type profileRequest struct {
+	FirstName           *string `json:"firstName"`
+	LastName            *string `json:"lastName"`
+	CustomerPhoneNumber *string `json:"customerPhoneNumber"`
+	Username            *string `json:"username"`
+}
+
+// Create a struct that holds what is needed to authenticate a customer
+type credentials struct {
+	CustomerID int
+	Password   string
+	Role       string
 }
 
 // Create a struct that holds the 'order' information
+// 'pizzaId' is only accepted on requests as a shorthand for a single item with a quantity of one
 type order struct {
 	OrderID             int         `json:"orderId"`
-	PizzaID             int         `json:"pizzaId"`
+	CustomerID          int         `json:"customerId,omitempty"`
+	PizzaID             int         `json:"pizzaId,omitempty"`
+	Items               []orderItem `json:"items"`
 	OrderTime           time.Time   `json:"orderTime"`
 	CustomerPhoneNumber string      `json:"customerPhoneNumber"`
 	OrderStatus         interface{} `json:"orderStatus"`
 	TotalPrice          float64     `json:"totalPrice"`
 }
 
+// Create a struct that holds the 'order item' information
+// The unit price is the pizza price at the time the order was placed
+type orderItem struct {
+	PizzaID   int     `json:"pizzaId"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unitPrice"`
+}
+
+// Create a struct that holds a single order status change
+type statusChange struct {
+	ChangedAt      time.Time `json:"changedAt"`
+	ChangedBy      string    `json:"changedBy"`
+	PreviousStatus string    `json:"previousStatus"`
+	NewStatus      string    `json:"newStatus"`
+}
+
 // Create a struct that holds the 'pizza' information
 type pizza struct {
 	PizzaID    int     `json:"pizzaId"`
@@ -38,119 +75,134 @@ type status struct {
 	StatusName string `json:"statusName"`
 }
 
-// Takes firstName, lastName, customerPhoneNumber, username, and hashedPassword and
-// creates a new row to 'CUSTOMERS' table with provided customer information, and returns the customerId
-func (c *customer) createCustomer(db *sql.DB, hashedPassword string) error {
-	// Calls the Stored Procedure and captures the customer id
-	err := db.QueryRow("CALL PAS_SP_CREATE_CUSTOMER($1, $2, $3, $4, $5)", c.FirstName, c.LastName, c.CustomerPhoneNumber, c.Username, hashedPassword).Scan(&c.CustomerID)
+// Create a struct that holds a login session
+// Every refresh token issued after a login belongs to the same session
+type authSession struct {
+	SessionID  string
+	CustomerID int
+	Username   string
+	Revoked    bool
+}
+
+// Create a struct that holds a refresh token, only the SHA-256 hash of the token is stored
+type refreshToken struct {
+	TokenHash string
+	SessionID string
+	ExpiresAt time.Time
+}
+
+// Create a struct that holds an account lockout, recorded after too many failed login attempts
+type accountLockout struct {
+	LockoutID      int        `json:"lockoutId"`
+	Username       string     `json:"username"`
+	CustomerID     int        `json:"customerId,omitempty"`
+	IPAddress      string     `json:"ipAddress"`
+	FailedAttempts int        `json:"failedAttempts"`
+	LockedAt       time.Time  `json:"lockedAt"`
+	LockedUntil    time.Time  `json:"lockedUntil"`
+	UnlockedAt     *time.Time `json:"unlockedAt,omitempty"`
+	UnlockedBy     string     `json:"unlockedBy,omitempty"`
+}
+
+// Create a struct that holds the response of a request sent with an 'Idempotency-Key' header
+// 'Fingerprint' is the SHA-256 hash of the request, 'StatusCode' is 0 while the request is in progress
+type idempotencyRecord struct {
+	Scope       string
+	Key         string
+	Fingerprint string
+	CustomerID  int
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Create a struct that holds a stored token signing key, the private key (PKCS #8) is encrypted with AES-256-GCM
+// The current key has no 'RetiredAt', an expired key has no 'EncryptedPrivateKey'
+type signingKeyRecord struct {
+	KeyID               string
+	EncryptedPrivateKey []byte
+	CreatedAt           time.Time
+	RetiredAt           *time.Time
+}
+
+// Create a struct that holds a password reset, only the SHA-256 hash of the reset token is stored
+type passwordReset struct {
+	TokenHash  string
+	CustomerID int
+	Username   string
+	ExpiresAt  time.Time
+}
+
+// Create a struct that holds the body of the password requests
+type passwordRequest struct {
+	Username        string `json:"username"`
+	Token           string `json:"token"`
+	CurrentPassword string `json:"currentPassword"`
+	Password        string `json:"password"`
+}
+
+// Create a struct that holds the two-factor authentication settings of a customer
+// The secret is set once the customer enrolled, and the enrollment is confirmed with a first one-time password
+type twoFactor struct {
+	CustomerID   int
+	Secret       string
+	Confirmed    bool
+	Required     bool
+	LastUsedStep int64
+}
+
+// Create a struct that holds the body of the two-factor authentication requests
+type twoFactorRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	Required bool   `json:"required"`
+}
+
+// Create a struct that holds an API key, only the SHA-256 hash of the key is stored
+// The key acts on behalf of the account 'customerId', limited to its scopes
+type apiKey struct {
+	KeyID      string     `json:"keyId"`
+	KeyHash    string     `json:"-"`
+	Name       string     `json:"name"`
+	CustomerID int        `json:"customerId"`
+	Username   string     `json:"username"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Create a struct that holds the body of an API key request
+type apiKeyRequest struct {
+	Name          string   `json:"name"`
+	Username      string   `json:"username"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+// Create a struct that holds everything held about a customer, returned by a personal data export
+type customerExport struct {
+	ExportedAt      time.Time        `json:"exportedAt"`
+	Customer        customer         `json:"customer"`
+	Orders          []orderExport    `json:"orders"`
+	TwoFactor       twoFactorExport  `json:"twoFactor"`
+	APIKeys         []apiKey         `json:"apiKeys"`
+	AccountLockouts []accountLockout `json:"accountLockouts"`
+}
+
+// Create a struct that holds an order along with its status history, part of a personal data export
+type orderExport struct {
+	order
+	Timeline []statusChange `json:"timeline"`
+}
 
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Takes pizzaId, and customerPhoneNumber, and
-// creates a new row to 'ORDERS' table with provided order information, and returns the orderId
-func (o *order) createOrder(db *sql.DB) error {
-	// Calls the Stored Procedure and captures the order id
-	err := db.QueryRow("CALL PAS_SP_CREATE_ORDER($1, $2)", o.PizzaID, o.CustomerPhoneNumber).Scan(&o.OrderID)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Takes in the orderId and returns the order status from 'ORDERS' table, and returns the orderStatus
-func (s *status) getStatus(db *sql.DB, orderID int) error {
-	// Calls the Stored Procedure 'PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER' and captures the order status
-	return db.QueryRow("CALL PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER($1)", orderID).Scan(&s.StatusName)
-}
-
-// Cancels an order - Updates a statusId to '5' in 'ORDERS' table
-func (s *status) cancelOrder(db *sql.DB, orderID int) error {
-	// Calls the Stored Procedure 'PAS_SP_CANCEL_ORDER'
-	return db.QueryRow("CALL PAS_SP_CANCEL_ORDER($1)", orderID).Scan(&s.StatusName)
-}
-
-// Retrieves list of orders by specific phone number
-// Takes in the customerPhoneNumber and returns the list of orders by specific phone number
-func (o *order) getOrders(db *sql.DB) ([]order, error) {
-	rows, err := db.Query(
-		"SELECT o.customerPhoneNumber, o.orderId, o.orderTime, o.pizzaId, o.totalPrice, sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId WHERE customerPhoneNumber = $1 AND o.isDeleted = FALSE", o.CustomerPhoneNumber)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Create a 'orders' list and append each resulting row to the 'orders' list
-	orders := []order{}
-	for rows.Next() {
-		if err := rows.Scan(&o.CustomerPhoneNumber, &o.OrderID, &o.OrderTime, &o.PizzaID, &o.TotalPrice, &o.OrderStatus); err != nil {
-			return nil, err
-		}
-		orders = append(orders, *o)
-	}
-
-	return orders, nil
-}
-
-// Retrieves the list of available pizzas
-func (p *pizza) getAvailablePizzas(db *sql.DB) ([]pizza, error) {
-	rows, err := db.Query(
-		"SELECT pizzaId, pizzaName, pizzaPrice FROM PIZZAS WHERE isDeleted = FALSE")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Create a 'pizzas' list and append each resulting row to the 'pizzas' list
-	pizzas := []pizza{}
-	for rows.Next() {
-		if err := rows.Scan(&p.PizzaID, &p.PizzaName, &p.PizzaPrice); err != nil {
-			return nil, err
-		}
-		pizzas = append(pizzas, *p)
-	}
-
-	return pizzas, nil
-}
-
-// Retrieves the list of status code (used by the store employees)
-func (s *status) getStatusCode(db *sql.DB) ([]status, error) {
-	rows, err := db.Query("SELECT statusId, statusName FROM ORDER_STATUS_CODES WHERE isDeleted = FALSE")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Create a 'statuses' list and append each resulting row to the 'statuses' list
-	statuses := []status{}
-	for rows.Next() {
-		if err := rows.Scan(&s.StatusID, &s.StatusName); err != nil {
-			return nil, err
-		}
-		statuses = append(statuses, *s)
-	}
-
-	return statuses, nil
-}
-
-// Updates an OrderStatus for the specific order (used by the store employees) and returns the order status.
-func (o *order) updateOrderStatus(db *sql.DB) error {
-	// Calls the Stored Procedure 'PAS_SP_UPDATE_ORDER_STATUS'
-	return db.QueryRow("CALL PAS_SP_UPDATE_ORDER_STATUS($1, $2)", o.OrderID, o.OrderStatus).Scan(&o.OrderStatus)
-}
-
-// Retrieves the hashed password given the username
-func (c *customer) getCustomerPassword(db *sql.DB) error {
-	// Calls the Stored Procedure 'PAS_SP_GET_CUSTOMER_PASSWORD'
-	err := db.QueryRow("CALL PAS_SP_GET_CUSTOMER_PASSWORD($1)", c.Username).Scan(&c.Password)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// Create a struct that holds the two-factor authentication settings, part of a personal data export
+// The secret and the recovery codes are never exported
+type twoFactorExport struct {
+	Enabled  bool `json:"enabled"`
+	Required bool `json:"required"`
 }
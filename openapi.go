@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Create a struct that holds an operation of the OpenAPI document
+// 'Path' is written the OpenAPI way (e.g. "/v1/orders/{orderId}"), its variables become path parameters.
+// 'Auth' lists the accepted security schemes, an operation without any is open.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Tag         string
+	Auth        []string
+	Scope       string
+	Roles       []string
+	Deprecated  bool
+	Query       []apiParameter
+	Headers     []apiParameter
+	Body        interface{}
+	Status      int
+	Response    interface{}
+	ContentType string
+	Errors      []int
+}
+
+// Create a struct that holds a query or header parameter of an operation
+type apiParameter struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Security schemes accepted by the routes
+var (
+	passwordAuth = []string{"basicAuth"}
+	userAuth     = []string{"basicAuth", "bearerAuth"}
+	scopedAuth   = []string{"basicAuth", "bearerAuth", "apiKeyAuth"}
+)
+
+// Optional headers of the operations
+var (
+	idempotencyKeyParameter = apiParameter{Name: idempotencyKeyHeader, Description: "Makes the request safe to retry, the first response is replayed on retries"}
+	twoFactorCodeParameter  = apiParameter{Name: twoFactorHeader, Description: "One-time password or recovery code of an account with two-factor authentication"}
+	lastEventIDParameter    = apiParameter{Name: "Last-Event-ID", Description: "Id of the last event received, the stream resumes after it (responds with 204 once the order reached its final status)"}
+)
+
+// Schema helpers
+var (
+	stringSchema   = map[string]interface{}{"type": "string"}
+	integerSchema  = map[string]interface{}{"type": "integer"}
+	numberSchema   = map[string]interface{}{"type": "number"}
+	booleanSchema  = map[string]interface{}{"type": "boolean"}
+	dateTimeSchema = map[string]interface{}{"type": "string", "format": "date-time"}
+)
+
+// Returns a reference to a schema of the components
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// Returns an array schema of the items
+func arrayOf(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// Returns an object schema given the required properties and the name and schema of each property
+func objectSchema(required []string, properties ...interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i+1 < len(properties); i += 2 {
+		props[properties[i].(string)] = properties[i+1]
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Returns a schema along with its description
+func describe(schema map[string]interface{}, description string) map[string]interface{} {
+	described := map[string]interface{}{"description": description}
+	for k, v := range schema {
+		described[k] = v
+	}
+	return described
+}
+
+// Schemas of the request and response bodies
+func openAPISchemas() map[string]interface{} {
+	message := objectSchema(nil, "message", stringSchema)
+
+	return map[string]interface{}{
+		"Customer": objectSchema(nil,
+			"customerId", integerSchema,
+			"firstName", stringSchema,
+			"lastName", stringSchema,
+			"customerPhoneNumber", describe(stringSchema, "E.164 phone number (e.g. +18125984475)"),
+			"username", stringSchema,
+			"role", map[string]interface{}{"type": "string", "enum": roles},
+			"closed", booleanSchema,
+		),
+		"NewCustomer": objectSchema([]string{"firstName", "lastName", "customerPhoneNumber", "username", "password"},
+			"firstName", describe(stringSchema, "Letters, spaces, apostrophes, dots, and dashes, 50 chars max"),
+			"lastName", describe(stringSchema, "Letters, spaces, apostrophes, dots, and dashes, 50 chars max"),
+			"customerPhoneNumber", describe(stringSchema, "National number of the default region, or '+' and the country calling code"),
+			"username", describe(stringSchema, "3 to 62 letters, digits, and . _ @ + -"),
+			"password", describe(stringSchema, "8 to 72 chars with at least one letter and one digit"),
+		),
+		"NewCustomerResult": objectSchema(nil, "customerPhoneNumber", stringSchema),
+		"ProfileUpdate": objectSchema(nil,
+			"firstName", stringSchema,
+			"lastName", stringSchema,
+			"customerPhoneNumber", stringSchema,
+			"username", stringSchema,
+		),
+		"Order": objectSchema(nil,
+			"orderId", integerSchema,
+			"customerId", integerSchema,
+			"items", arrayOf(schemaRef("OrderItem")),
+			"orderTime", dateTimeSchema,
+			"customerPhoneNumber", stringSchema,
+			"orderStatus", stringSchema,
+			"totalPrice", describe(numberSchema, "Total price including tax"),
+		),
+		"OrderItem": objectSchema(nil,
+			"pizzaId", integerSchema,
+			"quantity", integerSchema,
+			"unitPrice", describe(numberSchema, "Pizza price when the order was placed"),
+		),
+		"NewOrder": objectSchema([]string{"customerPhoneNumber"},
+			"items", arrayOf(objectSchema([]string{"pizzaId", "quantity"},
+				"pizzaId", integerSchema,
+				"quantity", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxItemQuantity},
+			)),
+			"pizzaId", describe(integerSchema, "Shorthand for a single item with a quantity of one"),
+			"customerPhoneNumber", stringSchema,
+		),
+		"NewOrderResult": objectSchema(nil, "orderId", integerSchema),
+		"OrderStatus": objectSchema(nil,
+			"orderStatus", stringSchema,
+			"items", arrayOf(schemaRef("OrderItem")),
+		),
+		"OrderStatusUpdate": objectSchema([]string{"orderStatus"},
+			"orderStatus", describe(integerSchema, "statusId of the requested status"),
+		),
+		"LegacyOrderStatusUpdate": objectSchema([]string{"orderId", "orderStatus"},
+			"orderId", integerSchema,
+			"orderStatus", describe(integerSchema, "statusId of the requested status"),
+		),
+		"OrderStatusUpdateResult": objectSchema(nil, "orderId", stringSchema, "orderStatus", stringSchema),
+		"CanceledOrder":           objectSchema(nil, "orderStatus", stringSchema),
+		"StatusChange": objectSchema(nil,
+			"changedAt", dateTimeSchema,
+			"changedBy", stringSchema,
+			"previousStatus", stringSchema,
+			"newStatus", stringSchema,
+		),
+		"OrderEvent": describe(objectSchema([]string{"orderId", "orderStatus"},
+			"orderId", integerSchema,
+			"orderStatus", stringSchema,
+			"previousStatus", stringSchema,
+			"changedAt", dateTimeSchema,
+			"changedBy", stringSchema,
+		), "Data of a 'status' event, the event id is the position of the change in the status history"),
+		"Pizza": objectSchema(nil,
+			"pizzaId", integerSchema,
+			"pizzaName", stringSchema,
+			"pizzaPrice", numberSchema,
+		),
+		"Status": objectSchema(nil,
+			"statusId", integerSchema,
+			"statusName", stringSchema,
+		),
+		"Token": objectSchema(nil,
+			"access_token", stringSchema,
+			"token_type", stringSchema,
+			"expires_in", describe(integerSchema, "Lifetime of the access token in seconds"),
+			"refresh_token", stringSchema,
+		),
+		"RefreshTokenRequest": objectSchema([]string{"refresh_token"}, "refresh_token", stringSchema),
+		"Message":             message,
+		"ForgotPassword":      objectSchema([]string{"username"}, "username", stringSchema),
+		"ResetPassword":       objectSchema([]string{"token", "password"}, "token", stringSchema, "password", stringSchema),
+		"ChangePassword":      objectSchema([]string{"currentPassword", "password"}, "currentPassword", stringSchema, "password", stringSchema),
+		"CurrentPassword":     objectSchema([]string{"currentPassword"}, "currentPassword", stringSchema),
+		"TwoFactorCode":       objectSchema([]string{"code"}, "code", describe(stringSchema, "One-time password (6 digits)")),
+		"TwoFactorEnrollment": objectSchema(nil,
+			"secret", stringSchema,
+			"provisioningUri", stringSchema,
+			"recoveryCodes", arrayOf(stringSchema),
+		),
+		"TwoFactorRequirement": objectSchema([]string{"username", "required"}, "username", stringSchema, "required", booleanSchema),
+		"RoleChange": objectSchema([]string{"username", "role"},
+			"username", stringSchema,
+			"role", map[string]interface{}{"type": "string", "enum": roles},
+		),
+		"AccountLockout": objectSchema(nil,
+			"lockoutId", integerSchema,
+			"username", stringSchema,
+			"customerId", integerSchema,
+			"ipAddress", stringSchema,
+			"failedAttempts", integerSchema,
+			"lockedAt", dateTimeSchema,
+			"lockedUntil", dateTimeSchema,
+			"unlockedAt", dateTimeSchema,
+			"unlockedBy", stringSchema,
+		),
+		"Unlock":       objectSchema([]string{"username"}, "username", stringSchema),
+		"UnlockResult": objectSchema(nil, "username", stringSchema, "message", stringSchema),
+		"APIKey": objectSchema(nil,
+			"keyId", stringSchema,
+			"name", stringSchema,
+			"customerId", integerSchema,
+			"username", stringSchema,
+			"scopes", arrayOf(map[string]interface{}{"type": "string", "enum": apiKeyScopes}),
+			"createdBy", stringSchema,
+			"createdAt", dateTimeSchema,
+			"expiresAt", dateTimeSchema,
+			"lastUsedAt", dateTimeSchema,
+			"revokedAt", dateTimeSchema,
+		),
+		"NewAPIKey": objectSchema([]string{"name", "username", "scopes"},
+			"name", stringSchema,
+			"username", describe(stringSchema, "Account the key acts on behalf of"),
+			"scopes", arrayOf(map[string]interface{}{"type": "string", "enum": apiKeyScopes}),
+			"expiresInDays", describe(integerSchema, "0 for a key that does not expire"),
+		),
+		"NewAPIKeyResult": objectSchema(nil,
+			"key", describe(stringSchema, "The key, only returned once"),
+			"apiKey", schemaRef("APIKey"),
+		),
+		"RevokedAPIKey": objectSchema(nil, "keyId", stringSchema, "message", stringSchema),
+		"CustomerExport": objectSchema(nil,
+			"exportedAt", dateTimeSchema,
+			"customer", schemaRef("Customer"),
+			"orders", arrayOf(map[string]interface{}{
+				"allOf": []interface{}{schemaRef("Order"), objectSchema(nil, "timeline", arrayOf(schemaRef("StatusChange")))},
+			}),
+			"twoFactor", objectSchema(nil, "enabled", booleanSchema, "required", booleanSchema),
+			"apiKeys", arrayOf(schemaRef("APIKey")),
+			"accountLockouts", arrayOf(schemaRef("AccountLockout")),
+		),
+		"ErasedCustomer": objectSchema(nil, "customerId", integerSchema, "message", stringSchema),
+		"JWKS": objectSchema(nil, "keys", arrayOf(objectSchema(nil,
+			"kty", stringSchema,
+			"kid", stringSchema,
+			"use", stringSchema,
+			"alg", stringSchema,
+			"n", stringSchema,
+			"e", stringSchema,
+		))),
+		"SigningKeyRotation": objectSchema(nil,
+			"kid", stringSchema,
+			"alg", stringSchema,
+			"retiredKid", stringSchema,
+			"retiredUntil", dateTimeSchema,
+		),
+		"Problem": objectSchema([]string{"type", "title", "status", "detail", "code"},
+			"type", stringSchema,
+			"title", stringSchema,
+			"status", integerSchema,
+			"detail", stringSchema,
+			"code", describe(stringSchema, "Stable, machine-readable error code"),
+			"requestId", stringSchema,
+			"errors", describe(map[string]interface{}{"type": "object"}, "Error of each invalid field, keyed by field name"),
+			"currentStatus", stringSchema,
+			"requestedStatus", stringSchema,
+		),
+	}
+}
+
+// Operations of every route, see 'initializeRoutes' and 'initializeV1Routes'
+// 'TestOpenAPIDocumentDescribesEveryRoute' makes sure no route is left out.
+func openAPIOperations() []apiOperation {
+	phoneNumberQuery := apiParameter{Name: "customerPhoneNumber", Description: "Phone number the orders were placed with", Required: true}
+	statusFilterQuery := apiParameter{Name: "status", Description: "Status code to follow, repeat it to follow several statuses (every status by default)"}
+
+	return []apiOperation{
+		// Customers
+		{Method: "POST", Path: "/v1/customers", Summary: "Create a customer", Tag: "Customers", Body: schemaRef("NewCustomer"), Status: http.StatusCreated, Response: schemaRef("NewCustomerResult"), Errors: []int{400, 409, 422}},
+		{Method: "POST", Path: "/customer/add", Summary: "Create a customer", Tag: "Customers", Deprecated: true, Body: schemaRef("NewCustomer"), Status: http.StatusCreated, Response: schemaRef("NewCustomerResult"), Errors: []int{400, 409, 422}},
+		{Method: "GET", Path: "/v1/customers/me", Summary: "Show the profile", Tag: "Customers", Auth: userAuth, Status: http.StatusOK, Response: schemaRef("Customer"), Errors: []int{401, 404}},
+		{Method: "GET", Path: "/customer/me", Summary: "Show the profile", Tag: "Customers", Auth: userAuth, Deprecated: true, Status: http.StatusOK, Response: schemaRef("Customer"), Errors: []int{401, 404}},
+		{Method: "PATCH", Path: "/v1/customers/me", Summary: "Update the profile", Tag: "Customers", Auth: userAuth, Body: schemaRef("ProfileUpdate"), Status: http.StatusOK, Response: schemaRef("Customer"), Errors: []int{400, 401, 404, 409, 422}},
+		{Method: "PATCH", Path: "/customer/me", Summary: "Update the profile", Tag: "Customers", Auth: userAuth, Deprecated: true, Body: schemaRef("ProfileUpdate"), Status: http.StatusOK, Response: schemaRef("Customer"), Errors: []int{400, 401, 404, 409, 422}},
+		{Method: "DELETE", Path: "/v1/customers/me", Summary: "Close the account", Tag: "Customers", Auth: userAuth, Body: schemaRef("CurrentPassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 403}},
+		{Method: "DELETE", Path: "/customer/me", Summary: "Close the account", Tag: "Customers", Auth: userAuth, Deprecated: true, Body: schemaRef("CurrentPassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 403}},
+		{Method: "PUT", Path: "/v1/customers/me/password", Summary: "Change the password", Tag: "Customers", Auth: userAuth, Body: schemaRef("ChangePassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 403, 422}},
+		{Method: "PUT", Path: "/customer/password", Summary: "Change the password", Tag: "Customers", Auth: userAuth, Deprecated: true, Body: schemaRef("ChangePassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 403, 422}},
+		{Method: "GET", Path: "/v1/customers/me/export", Summary: "Export my personal data", Tag: "Customers", Auth: userAuth, Status: http.StatusOK, Response: schemaRef("CustomerExport"), Errors: []int{401, 404}},
+		{Method: "GET", Path: "/customer/me/export", Summary: "Export my personal data", Tag: "Customers", Auth: userAuth, Deprecated: true, Status: http.StatusOK, Response: schemaRef("CustomerExport"), Errors: []int{401, 404}},
+		{Method: "GET", Path: "/v1/customers/{customerId}/export", Summary: "Export the personal data of a customer", Tag: "Customers", Auth: userAuth, Roles: []string{roleAdmin}, Status: http.StatusOK, Response: schemaRef("CustomerExport"), Errors: []int{401, 403, 404}},
+		{Method: "GET", Path: "/customer/{customerId}/export", Summary: "Export the personal data of a customer", Tag: "Customers", Auth: userAuth, Roles: []string{roleAdmin}, Deprecated: true, Status: http.StatusOK, Response: schemaRef("CustomerExport"), Errors: []int{401, 403, 404}},
+		{Method: "POST", Path: "/v1/customers/{customerId}/erase", Summary: "Erase the personal data of a customer", Tag: "Customers", Auth: userAuth, Roles: []string{roleAdmin}, Status: http.StatusOK, Response: schemaRef("ErasedCustomer"), Errors: []int{401, 403, 404}},
+		{Method: "POST", Path: "/customer/{customerId}/erase", Summary: "Erase the personal data of a customer", Tag: "Customers", Auth: userAuth, Roles: []string{roleAdmin}, Deprecated: true, Status: http.StatusOK, Response: schemaRef("ErasedCustomer"), Errors: []int{401, 403, 404}},
+		{Method: "PUT", Path: "/customer/role", Summary: "Change the role of an account", Tag: "Customers", Auth: userAuth, Roles: []string{roleAdmin}, Body: schemaRef("RoleChange"), Status: http.StatusOK, Response: schemaRef("RoleChange"), Errors: []int{400, 401, 403, 404, 422}},
+		{Method: "GET", Path: "/customer/lockouts", Summary: "Show account lockouts", Tag: "Customers", Auth: userAuth, Roles: supportRoles, Query: []apiParameter{{Name: "username", Description: "Only the lockouts of this username"}}, Status: http.StatusOK, Response: arrayOf(schemaRef("AccountLockout")), Errors: []int{401, 403}},
+		{Method: "PUT", Path: "/customer/unlock", Summary: "Unlock an account", Tag: "Customers", Auth: userAuth, Roles: supportRoles, Body: schemaRef("Unlock"), Status: http.StatusOK, Response: schemaRef("UnlockResult"), Errors: []int{400, 401, 403, 404}},
+
+		// Orders
+		{Method: "POST", Path: "/v1/orders", Summary: "Create a new order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersCreate, Headers: []apiParameter{idempotencyKeyParameter}, Body: schemaRef("NewOrder"), Status: http.StatusCreated, Response: schemaRef("NewOrderResult"), Errors: []int{400, 401, 403, 409, 422}},
+		{Method: "POST", Path: "/order/add", Summary: "Create a new order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersCreate, Deprecated: true, Headers: []apiParameter{idempotencyKeyParameter}, Body: schemaRef("NewOrder"), Status: http.StatusCreated, Response: schemaRef("NewOrderResult"), Errors: []int{400, 401, 403, 409, 422}},
+		{Method: "GET", Path: "/v1/orders", Summary: "List the orders by phone number", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Query: []apiParameter{phoneNumberQuery}, Status: http.StatusOK, Response: arrayOf(schemaRef("Order")), Errors: []int{401, 403, 422}},
+		{Method: "GET", Path: "/order/show", Summary: "List the orders by phone number, given in the request body", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Deprecated: true, Body: objectSchema([]string{"customerPhoneNumber"}, "customerPhoneNumber", stringSchema), Status: http.StatusOK, Response: arrayOf(schemaRef("Order")), Errors: []int{400, 401, 403, 422}},
+		{Method: "GET", Path: "/v1/orders/{orderId}", Summary: "Check status of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Status: http.StatusOK, Response: schemaRef("OrderStatus"), Errors: []int{401, 403, 404}},
+		{Method: "GET", Path: "/order/show/{orderId}", Summary: "Check status of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Deprecated: true, Status: http.StatusOK, Response: schemaRef("OrderStatus"), Errors: []int{401, 403, 404}},
+		{Method: "PATCH", Path: "/v1/orders/{orderId}", Summary: "Update the order status", Tag: "Orders", Auth: userAuth, Roles: storeRoles, Body: schemaRef("OrderStatusUpdate"), Status: http.StatusOK, Response: schemaRef("OrderStatusUpdateResult"), Errors: []int{400, 401, 403, 404, 409}},
+		{Method: "GET", Path: "/v1/kitchen/feed", Summary: "Kitchen feed of new orders and status changes (WebSocket)", Tag: "Orders", Auth: userAuth, Roles: storeRoles, Query: []apiParameter{statusFilterQuery}, Status: http.StatusSwitchingProtocols, Errors: []int{400, 401, 403, 426}},
+		{Method: "PUT", Path: "/order/update", Summary: "Update the order status, given the orderId in the request body", Tag: "Orders", Auth: userAuth, Roles: storeRoles, Deprecated: true, Body: schemaRef("LegacyOrderStatusUpdate"), Status: http.StatusOK, Response: schemaRef("OrderStatusUpdateResult"), Errors: []int{400, 401, 403, 404, 409}},
+		{Method: "POST", Path: "/v1/orders/{orderId}/cancel", Summary: "Cancel an order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersCancel, Status: http.StatusOK, Response: schemaRef("CanceledOrder"), Errors: []int{401, 403, 404, 409}},
+		{Method: "PUT", Path: "/order/update/{orderId}", Summary: "Cancel an order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersCancel, Deprecated: true, Status: http.StatusOK, Response: schemaRef("CanceledOrder"), Errors: []int{401, 403, 404, 409}},
+		{Method: "GET", Path: "/v1/orders/{orderId}/timeline", Summary: "Show the status history of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Status: http.StatusOK, Response: arrayOf(schemaRef("StatusChange")), Errors: []int{401, 403, 404}},
+		{Method: "GET", Path: "/order/{orderId}/timeline", Summary: "Show the status history of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Deprecated: true, Status: http.StatusOK, Response: arrayOf(schemaRef("StatusChange")), Errors: []int{401, 403, 404}},
+		{Method: "GET", Path: "/v1/orders/{orderId}/events", Summary: "Stream the status changes of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Headers: []apiParameter{lastEventIDParameter}, Status: http.StatusOK, Response: schemaRef("OrderEvent"), ContentType: "text/event-stream", Errors: []int{400, 401, 403, 404}},
+		{Method: "GET", Path: "/order/{orderId}/events", Summary: "Stream the status changes of the order", Tag: "Orders", Auth: scopedAuth, Scope: scopeOrdersRead, Deprecated: true, Headers: []apiParameter{lastEventIDParameter}, Status: http.StatusOK, Response: schemaRef("OrderEvent"), ContentType: "text/event-stream", Errors: []int{400, 401, 403, 404}},
+		{Method: "GET", Path: "/status_code/show", Summary: "Show list of order status", Tag: "Orders", Auth: userAuth, Roles: storeRoles, Status: http.StatusOK, Response: arrayOf(schemaRef("Status")), Errors: []int{401, 403}},
+
+		// Pizzas
+		{Method: "GET", Path: "/v1/pizzas", Summary: "Show available pizzas", Tag: "Pizzas", Auth: scopedAuth, Scope: scopeMenuRead, Status: http.StatusOK, Response: arrayOf(schemaRef("Pizza")), Errors: []int{401, 403}},
+		{Method: "GET", Path: "/pizza/show", Summary: "Show available pizzas", Tag: "Pizzas", Auth: scopedAuth, Scope: scopeMenuRead, Deprecated: true, Status: http.StatusOK, Response: arrayOf(schemaRef("Pizza")), Errors: []int{401, 403}},
+
+		// Authentication
+		{Method: "GET", Path: "/auth/token", Summary: "Obtain a user access token", Tag: "Authentication", Auth: passwordAuth, Headers: []apiParameter{twoFactorCodeParameter}, Status: http.StatusOK, Response: schemaRef("Token"), Errors: []int{401, 403, 429}},
+		{Method: "POST", Path: "/auth/refresh", Summary: "Refresh an access token", Tag: "Authentication", Body: schemaRef("RefreshTokenRequest"), Status: http.StatusOK, Response: schemaRef("Token"), Errors: []int{400, 401}},
+		{Method: "POST", Path: "/auth/logout", Summary: "Log out", Tag: "Authentication", Auth: userAuth, Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{401}},
+		{Method: "POST", Path: "/auth/sessions/revoke", Summary: "Revoke all sessions", Tag: "Authentication", Auth: userAuth, Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{401}},
+		{Method: "POST", Path: "/auth/password/forgot", Summary: "Request a password reset", Tag: "Authentication", Body: schemaRef("ForgotPassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 429}},
+		{Method: "POST", Path: "/auth/password/reset", Summary: "Reset the password", Tag: "Authentication", Body: schemaRef("ResetPassword"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 422}},
+		{Method: "POST", Path: "/auth/keys/rotate", Summary: "Rotate the token signing key", Tag: "Authentication", Auth: userAuth, Roles: []string{roleAdmin}, Status: http.StatusOK, Response: schemaRef("SigningKeyRotation"), Errors: []int{400, 401, 403, 409}},
+		{Method: "GET", Path: "/.well-known/jwks.json", Summary: "Public keys to verify tokens", Tag: "Authentication", Status: http.StatusOK, Response: schemaRef("JWKS")},
+		{Method: "POST", Path: "/customer/totp/enroll", Summary: "Enroll in two-factor authentication", Tag: "Authentication", Auth: userAuth, Status: http.StatusOK, Response: schemaRef("TwoFactorEnrollment"), Errors: []int{401, 409}},
+		{Method: "POST", Path: "/customer/totp/confirm", Summary: "Confirm two-factor authentication", Tag: "Authentication", Auth: userAuth, Body: schemaRef("TwoFactorCode"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 409, 429}},
+		{Method: "DELETE", Path: "/customer/totp", Summary: "Disable two-factor authentication", Tag: "Authentication", Auth: userAuth, Body: schemaRef("TwoFactorCode"), Status: http.StatusOK, Response: schemaRef("Message"), Errors: []int{400, 401, 429}},
+		{Method: "PUT", Path: "/customer/totp/require", Summary: "Require two-factor authentication", Tag: "Authentication", Auth: userAuth, Roles: supportRoles, Body: schemaRef("TwoFactorRequirement"), Status: http.StatusOK, Response: schemaRef("TwoFactorRequirement"), Errors: []int{400, 401, 403, 404}},
+
+		// API keys
+		{Method: "POST", Path: "/apikey/add", Summary: "Create an API key", Tag: "API keys", Auth: userAuth, Roles: []string{roleAdmin}, Body: schemaRef("NewAPIKey"), Status: http.StatusCreated, Response: schemaRef("NewAPIKeyResult"), Errors: []int{400, 401, 403, 404, 422}},
+		{Method: "GET", Path: "/apikey/show", Summary: "Show API keys", Tag: "API keys", Auth: userAuth, Roles: []string{roleAdmin}, Status: http.StatusOK, Response: arrayOf(schemaRef("APIKey")), Errors: []int{401, 403}},
+		{Method: "DELETE", Path: "/apikey/{keyId}", Summary: "Revoke an API key", Tag: "API keys", Auth: userAuth, Roles: []string{roleAdmin}, Status: http.StatusOK, Response: schemaRef("RevokedAPIKey"), Errors: []int{401, 403, 404}},
+
+		// Documentation
+		{Method: "GET", Path: "/openapi.json", Summary: "OpenAPI document of the service", Tag: "Documentation", Status: http.StatusOK, Response: map[string]interface{}{"type": "object"}},
+		{Method: "GET", Path: "/docs", Summary: "API documentation page", Tag: "Documentation", Status: http.StatusOK, ContentType: "text/html"},
+	}
+}
+
+// Matches the variables of a path template (e.g. "{orderId}", or "{orderId:[0-9]+}" in a mux route)
+var pathVariablePattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)(:[^}]*)?\}`)
+
+// Turns a path into the suffix of an operationId (e.g. "/v1/orders/{orderId}" into "_v1_orders_orderId")
+var operationIDReplacer = strings.NewReplacer("/", "_", "{", "", "}", "", ".", "", "-", "_")
+
+// Builds the OpenAPI 3 document of the service
+func openAPIDocument() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, op := range openAPIOperations() {
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = op.document()
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Pizza API Service",
+			"version":     "1.0.0",
+			"description": "Pizza ordering API. Errors are returned as problem details (application/problem+json) with a stable error code.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/"}},
+		"tags": []interface{}{
+			map[string]interface{}{"name": "Customers"},
+			map[string]interface{}{"name": "Orders"},
+			map[string]interface{}{"name": "Pizzas"},
+			map[string]interface{}{"name": "Authentication"},
+			map[string]interface{}{"name": "API keys"},
+			map[string]interface{}{"name": "Documentation"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": openAPISchemas(),
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic", "description": "Username and password"},
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "Access token obtained from /auth/token"},
+				"apiKeyAuth": map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader, "description": "API key of a partner or kiosk integration, limited to its scopes"},
+			},
+		},
+	}
+}
+
+// Builds the OpenAPI operation object
+func (op apiOperation) document() map[string]interface{} {
+	doc := map[string]interface{}{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": strings.ToLower(op.Method) + operationIDReplacer.Replace(op.Path),
+	}
+
+	var notes []string
+	if op.Deprecated {
+		doc["deprecated"] = true
+		notes = append(notes, "Deprecated alias of a /v1 route, responses carry the 'Deprecation' header.")
+	}
+	if len(op.Roles) > 0 {
+		notes = append(notes, "Requires one of the roles: "+strings.Join(op.Roles, ", ")+".")
+	}
+	if op.Scope != "" {
+		doc["x-api-key-scope"] = op.Scope
+		notes = append(notes, "API keys need the '"+op.Scope+"' scope.")
+	}
+	if len(notes) > 0 {
+		doc["description"] = strings.Join(notes, " ")
+	}
+
+	// An operation without security schemes is open
+	security := []interface{}{}
+	for _, scheme := range op.Auth {
+		security = append(security, map[string]interface{}{scheme: []string{}})
+	}
+	doc["security"] = security
+
+	parameters := []interface{}{}
+	for _, match := range pathVariablePattern.FindAllStringSubmatch(op.Path, -1) {
+		schema := integerSchema
+		if !strings.HasSuffix(match[1], "Id") || match[1] == "keyId" {
+			schema = stringSchema
+		}
+		parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, p := range op.Query {
+		parameters = append(parameters, map[string]interface{}{"name": p.Name, "in": "query", "required": p.Required, "description": p.Description, "schema": stringSchema})
+	}
+	for _, p := range op.Headers {
+		parameters = append(parameters, map[string]interface{}{"name": p.Name, "in": "header", "required": p.Required, "description": p.Description, "schema": stringSchema})
+	}
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+
+	if op.Body != nil {
+		doc["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": op.Body}},
+		}
+	}
+
+	responses := map[string]interface{}{}
+	success := map[string]interface{}{"description": http.StatusText(op.Status)}
+	switch {
+	case op.ContentType != "" && op.Response != nil:
+		success["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{"schema": op.Response}}
+	case op.ContentType != "":
+		success["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{}}
+	case op.Response != nil:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": op.Response}}
+	}
+	responses[fmt.Sprint(op.Status)] = success
+	for _, code := range op.Errors {
+		responses[fmt.Sprint(code)] = problemResponse(code)
+	}
+	responses["default"] = problemResponse(http.StatusInternalServerError)
+	doc["responses"] = responses
+
+	return doc
+}
+
+// Returns an error response described by the problem details schema
+func problemResponse(code int) map[string]interface{} {
+	description := http.StatusText(code)
+	if code == http.StatusInternalServerError {
+		description = "Unexpected error"
+	}
+
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"application/problem+json": map[string]interface{}{"schema": schemaRef("Problem")}},
+	}
+}
+
+// Checks that every route of the router is described by the OpenAPI document, and the other way around
+// Routes registered without a method only need their path to be described.
+func checkOpenAPICoverage(router *mux.Router) error {
+	described := map[string]bool{}
+	for _, op := range openAPIOperations() {
+		described[op.Method+" "+op.Path] = true
+		described[op.Path] = true
+	}
+
+	var missing []string
+	routed := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := pathVariablePattern.ReplaceAllString(template, "{$1}")
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			// The route matches every method
+			routed[path] = true
+			if !described[path] {
+				missing = append(missing, path)
+			}
+			return nil
+		}
+		for _, method := range methods {
+			routed[method+" "+path] = true
+			routed[path] = true
+			if !described[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, op := range openAPIOperations() {
+		if !routed[op.Method+" "+op.Path] && !routed[op.Path] {
+			missing = append(missing, op.Method+" "+op.Path+" (described but not routed)")
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("OpenAPI document is out of date with the routes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Handler to serve the OpenAPI document
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, openAPIDocument())
+}
+
+// Handler to serve the documentation page, it renders '/openapi.json' without loading anything else
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+}
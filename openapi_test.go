@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Every route of the router must be described by the served OpenAPI document, and every described operation routed
+func TestOpenAPIDocumentDescribesEveryRoute(t *testing.T) {
+	res, b := testRequest(t, "GET", "/openapi.json", "", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	decodeTestJSON(t, b, &doc)
+
+	routed := map[string]bool{}
+	err := testApp.Router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := pathVariablePattern.ReplaceAllString(template, "{$1}")
+
+		operations, ok := doc.Paths[path]
+		if !ok {
+			t.Errorf("%s is routed but not described", path)
+			return nil
+		}
+
+		// Routes registered without a method only need their path to be described
+		methods, err := route.GetMethods()
+		if err != nil {
+			routed[path] = true
+			return nil
+		}
+		for _, method := range methods {
+			routed[method+" "+path] = true
+			if _, ok := operations[strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is routed but not described", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if !routed[strings.ToUpper(method)+" "+path] && !routed[path] {
+				t.Errorf("%s %s is described but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestCheckOpenAPICoverage(t *testing.T) {
+	if err := checkOpenAPICoverage(testApp.Router); err != nil {
+		t.Fatal(err)
+	}
+
+	// A route left out of the document is reported
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/undocumented", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	err := checkOpenAPICoverage(router)
+	if err == nil || !strings.Contains(err.Error(), "GET /v1/undocumented") {
+		t.Errorf("expected the undocumented route to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Interval of the comments that keep an idle event stream open through proxies
+const orderEventsHeartbeat = time.Second * 15
+
+// Delay before a client reconnects to a dropped event stream
+const orderEventsRetry = time.Second * 3
+
+// Types of the events published by the broker
+const (
+	orderCreatedEvent       = "orderCreated"
+	orderStatusChangedEvent = "statusChanged"
+)
+
+// Subscription to the events of every order (order IDs start at 1)
+const allOrders = 0
+
+// Create a struct that holds a new order or an order status change published by the broker
+type orderEvent struct {
+	Type           string
+	OrderID        int
+	OrderStatus    string
+	PreviousStatus string
+	ChangedBy      string
+	ChangedAt      time.Time
+}
+
+// In-process broker that fans new orders and order status changes out to the open event streams and kitchen feeds
+// Subscribers only receive the changes made by this instance, the status history in the DB is the source of truth.
+type orderBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan orderEvent]bool
+}
+
+func newOrderBroker() *orderBroker {
+	return &orderBroker{subscribers: map[int]map[chan orderEvent]bool{}}
+}
+
+// Subscribes to the events of an order, or of every order with 'allOrders'
+// The returned function unsubscribes, it must be called once the stream is closed.
+func (b *orderBroker) Subscribe(orderID int) (<-chan orderEvent, func()) {
+	ch := make(chan orderEvent, 32)
+
+	b.mu.Lock()
+	if b.subscribers[orderID] == nil {
+		b.subscribers[orderID] = map[chan orderEvent]bool{}
+	}
+	b.subscribers[orderID][ch] = true
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subscribers[orderID], ch)
+		if len(b.subscribers[orderID]) == 0 {
+			delete(b.subscribers, orderID)
+		}
+	}
+}
+
+// Publishes an event to the subscribers of the order and of every order
+// A subscriber that is falling behind misses the event, so publishing never blocks the request that made the change.
+func (b *orderBroker) Publish(e orderEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, orderID := range []int{e.OrderID, allOrders} {
+		for ch := range b.subscribers[orderID] {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+// Handler to stream the status changes of an order as Server-Sent Events
+// Each change of the status history is an event whose id is its position in the history, so a client
+// that reconnects with 'Last-Event-ID' receives the changes it missed. A new stream starts with the current status.
+// The stream ends once the order is picked up or canceled, and a reconnect after the final status responds with 204.
+func (a *App) orderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'orderId' from a Request URL
+	orderID, err := strconv.Atoi(mux.Vars(r)["orderId"])
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	// Customers may only follow their own orders
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		orderStatusErrorHandler(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		responseErrorHandler(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	lastEventID := -1
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if lastEventID, err = strconv.Atoi(id); err != nil || lastEventID < 0 {
+			responseErrorHandler(w, http.StatusBadRequest, "Last-Event-ID must be an event id of this stream")
+			return
+		}
+	}
+
+	// Subscribe before reading the history, so no change is lost in between
+	events, unsubscribe := a.Events.Subscribe(orderID)
+	defer unsubscribe()
+
+	timeline, err := a.Store.GetOrderTimeline(orderID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	statusName, err := a.Store.GetOrderStatus(orderID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Nothing left to send to a client that has seen the final status
+	if lastEventID >= len(timeline) && isFinalStatus(statusName) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", orderEventsRetry.Milliseconds())
+
+	// A new stream starts with the current status, a resumed stream with the changes it missed
+	sent := lastEventID
+	if sent < 0 {
+		writeOrderEvent(w, len(timeline), map[string]interface{}{
+			"orderId":     orderID,
+			"orderStatus": statusName,
+		})
+		sent = len(timeline)
+	}
+	sent = writeOrderChanges(w, orderID, timeline, sent)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(orderEventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for !isFinalStatus(statusName) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case e := <-events:
+			// Read the history again, it also holds the changes a slow subscriber missed
+			timeline, err = a.Store.GetOrderTimeline(orderID)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			sent = writeOrderChanges(w, orderID, timeline, sent)
+			statusName = e.OrderStatus
+			if len(timeline) > 0 {
+				statusName = timeline[len(timeline)-1].NewStatus
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Writes the changes of the status history after the event id 'sent', and returns the id of the last event written
+func writeOrderChanges(w http.ResponseWriter, orderID int, timeline []statusChange, sent int) int {
+	for i := sent; i < len(timeline); i++ {
+		c := timeline[i]
+		writeOrderEvent(w, i+1, map[string]interface{}{
+			"orderId":        orderID,
+			"orderStatus":    c.NewStatus,
+			"previousStatus": c.PreviousStatus,
+			"changedAt":      c.ChangedAt,
+			"changedBy":      c.ChangedBy,
+		})
+	}
+
+	if sent < len(timeline) {
+		return len(timeline)
+	}
+	return sent
+}
+
+// Writes a 'status' event in the Server-Sent Events format
+func writeOrderEvent(w http.ResponseWriter, id int, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", id, data)
+}
+
+// Reports whether no transition leaves the status (e.g. 'Picked Up' or 'Canceled')
+func isFinalStatus(statusName string) bool {
+	next, ok := orderStatusTransitions[statusName]
+	return ok && len(next) == 0
+}
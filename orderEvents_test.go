@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a struct that holds an event read from a Server-Sent Events stream
+type testEvent struct {
+	ID   int
+	Type string
+	Data map[string]interface{}
+}
+
+// Opens the event stream of an order, the stream is closed at the end of the test
+func openTestEventStream(t *testing.T, auth string, orderID int, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/orders/%d/events", testServer.URL, orderID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", auth)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		res.Body.Close()
+	})
+	return res, bufio.NewReader(res.Body)
+}
+
+// Reads the next event of a stream, skipping the 'retry' field and the comments
+// Returns false once the stream has ended.
+func readTestEvent(t *testing.T, br *bufio.Reader) (testEvent, bool) {
+	t.Helper()
+
+	var e testEvent
+	fields := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if fields > 0 {
+				t.Fatalf("stream ended in the middle of an event: %v", err)
+			}
+			return e, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if fields > 0 {
+				return e, true
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.ID, err = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+			if err != nil {
+				t.Fatalf("invalid event id %q", line)
+			}
+			fields++
+		case strings.HasPrefix(line, "event: "):
+			e.Type = strings.TrimPrefix(line, "event: ")
+			fields++
+		case strings.HasPrefix(line, "data: "):
+			decodeTestJSON(t, []byte(strings.TrimPrefix(line, "data: ")), &e.Data)
+			fields++
+		}
+	}
+}
+
+// Reads the next event of a stream and checks its id and status
+func expectTestEvent(t *testing.T, br *bufio.Reader, id int, statusName string) testEvent {
+	t.Helper()
+
+	e, ok := readTestEvent(t, br)
+	if !ok {
+		t.Fatalf("expected event %d, the stream has ended", id)
+	}
+	if e.ID != id || e.Type != "status" || e.Data["orderStatus"] != statusName {
+		t.Fatalf("expected event %d with status %s, got %+v", id, statusName, e)
+	}
+	return e
+}
+
+func TestOrderEventsStreamTheStatusChanges(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	orderID := createTestOrder(t, customer)
+
+	res, br := openTestEventStream(t, customer, orderID, "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	// A new stream starts with the current status, whose id is the length of the history
+	expectTestEvent(t, br, 0, statusOrderReceived)
+
+	updateTestOrderStatus(t, employee, orderID, 2)
+	e := expectTestEvent(t, br, 1, statusMakingPizza)
+	if e.Data["previousStatus"] != statusOrderReceived || e.Data["changedBy"] == "" {
+		t.Errorf("expected the previous status and the author of the change, got %v", e.Data)
+	}
+
+	// The stream ends with the final status
+	updateTestOrderStatus(t, employee, orderID, 3)
+	expectTestEvent(t, br, 2, statusReadyForPickUp)
+	updateTestOrderStatus(t, employee, orderID, 4)
+	expectTestEvent(t, br, 3, statusPickedUp)
+	if e, ok := readTestEvent(t, br); ok {
+		t.Fatalf("expected the stream to end, got %+v", e)
+	}
+}
+
+func TestOrderEventsResumeFromLastEventID(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	orderID := createTestOrder(t, customer)
+
+	updateTestOrderStatus(t, employee, orderID, 2)
+	updateTestOrderStatus(t, employee, orderID, 3)
+
+	// A client that saw the first change receives the changes it missed, without the current status
+	_, br := openTestEventStream(t, customer, orderID, "1")
+	expectTestEvent(t, br, 2, statusReadyForPickUp)
+
+	updateTestOrderStatus(t, employee, orderID, 5)
+	expectTestEvent(t, br, 3, statusCanceled)
+	if e, ok := readTestEvent(t, br); ok {
+		t.Fatalf("expected the stream to end, got %+v", e)
+	}
+
+	// Nothing is left to send after the final status
+	if res, _ := openTestEventStream(t, customer, orderID, "3"); res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 after the final status, got %d", res.StatusCode)
+	}
+
+	// A client that reconnects before seeing the final status still receives it
+	_, br = openTestEventStream(t, customer, orderID, "2")
+	expectTestEvent(t, br, 3, statusCanceled)
+}
+
+func TestOrderEventsErrors(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	other := testToken(t, newTestCustomer(t, roleCustomer))
+	orderID := createTestOrder(t, customer)
+
+	if res, _ := openTestEventStream(t, customer, orderID, "abc"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid Last-Event-ID, got %d", res.StatusCode)
+	}
+	if res, _ := openTestEventStream(t, other, orderID, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for the order of another customer, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Order status names, as stored in 'ORDER_STATUS_CODES'
+// Status codes are resolved by name so the flow does not depend on the statusId values
+const (
+	statusOrderReceived  = "Order Received"
+	statusMakingPizza    = "Making Your Pizza"
+	statusReadyForPickUp = "Ready for Pick Up"
+	statusPickedUp       = "Picked Up"
+	statusCanceled       = "Canceled"
+)
+
+// Allowed order status transitions
+// 'Picked Up' and 'Canceled' are final, an order can be canceled until it has been picked up
+var orderStatusTransitions = map[string][]string{
+	statusOrderReceived:  {statusMakingPizza, statusCanceled},
+	statusMakingPizza:    {statusReadyForPickUp, statusCanceled},
+	statusReadyForPickUp: {statusPickedUp, statusCanceled},
+	statusPickedUp:       {},
+	statusCanceled:       {},
+}
+
+// Returned when the requested status code does not exist
+var errUnknownStatus = errors.New("orderStatus must be a valid order status code")
+
+// Returned when an order cannot move from its current status to the requested one
+type statusTransitionError struct {
+	CurrentStatus   string
+	RequestedStatus string
+}
+
+func (e *statusTransitionError) Error() string {
+	return fmt.Sprintf("order cannot move from '%s' to '%s'", e.CurrentStatus, e.RequestedStatus)
+}
+
+// Reports whether an order in status 'from' may move to status 'to'
+func canTransition(from, to string) bool {
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Retrieves the status codes keyed by status name
+func (a *App) statusCodesByName() (map[string]status, error) {
+	statuses, err := a.Store.GetStatusCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]status{}
+	for _, s := range statuses {
+		byName[s.StatusName] = s
+	}
+
+	return byName, nil
+}
+
+// Resolves a statusId to its status name
+func (a *App) statusNameByID(statusID int) (string, error) {
+	statuses, err := a.Store.GetStatusCodes()
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range statuses {
+		if s.StatusID == statusID {
+			return s.StatusName, nil
+		}
+	}
+
+	return "", errUnknownStatus
+}
+
+// Moves an order to the requested status on behalf of 'actor' (customer 'actorID') if the transition graph allows it,
+// and returns the new status name
+// The update only applies if the order is still in the status that was checked,
+// so a concurrent change results in a statusTransitionError instead of skipping the check
+func (a *App) transitionOrderStatus(orderID int, requested, actor string, actorID int) (string, error) {
+	codes, err := a.statusCodesByName()
+	if err != nil {
+		return "", err
+	}
+	to, ok := codes[requested]
+	if !ok {
+		return "", errUnknownStatus
+	}
+
+	current, err := a.Store.GetOrderStatus(orderID)
+	if err != nil {
+		return "", err
+	}
+	from, ok := codes[current]
+	if !ok || !canTransition(current, requested) {
+		return "", &statusTransitionError{CurrentStatus: current, RequestedStatus: requested}
+	}
+
+	statusName, err := a.Store.UpdateOrderStatus(orderID, from.StatusID, to.StatusID, actor, actorID)
+	if err != nil {
+		return "", err
+	}
+	if statusName != requested {
+		return "", &statusTransitionError{CurrentStatus: statusName, RequestedStatus: requested}
+	}
+
+	// Notify the open event streams of the order and the kitchen feed
+	a.Events.Publish(orderEvent{Type: orderStatusChangedEvent, OrderID: orderID, OrderStatus: statusName, PreviousStatus: current, ChangedBy: actor, ChangedAt: a.Clock()})
+
+	return statusName, nil
+}
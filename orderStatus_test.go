@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Places an order of two cheese pizzas as the given user and returns its orderId
+func createTestOrder(t *testing.T, auth string) int {
+	t.Helper()
+
+	res, b := testRequest(t, "POST", "/v1/orders", auth, `{"items":[{"pizzaId":1,"quantity":2}],"customerPhoneNumber":"8125984475"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating an order: %d %s", res.StatusCode, b)
+	}
+
+	var o order
+	decodeTestJSON(t, b, &o)
+	return o.OrderID
+}
+
+// Changes the status of an order as the given user and returns the response along with the problem details, if any
+func updateTestOrderStatus(t *testing.T, auth string, orderID, statusID int) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	res, b := testRequest(t, "PATCH", fmt.Sprintf("/v1/orders/%d", orderID), auth, fmt.Sprintf(`{"orderStatus":%d}`, statusID))
+	payload := map[string]interface{}{}
+	decodeTestJSON(t, b, &payload)
+	return res, payload
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{statusOrderReceived, statusMakingPizza, true},
+		{statusOrderReceived, statusReadyForPickUp, false},
+		{statusOrderReceived, statusCanceled, true},
+		{statusMakingPizza, statusReadyForPickUp, true},
+		{statusMakingPizza, statusOrderReceived, false},
+		{statusReadyForPickUp, statusPickedUp, true},
+		{statusReadyForPickUp, statusCanceled, true},
+		{statusPickedUp, statusCanceled, false},
+		{statusPickedUp, statusOrderReceived, false},
+		{statusCanceled, statusMakingPizza, false},
+		{"Unknown", statusMakingPizza, false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("%s -> %s: expected %v, got %v", tt.from, tt.to, tt.allowed, got)
+		}
+	}
+}
+
+func TestOrderStatusFollowsTheTransitionGraph(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	orderID := createTestOrder(t, customer)
+
+	// Skipping 'Making Your Pizza' is refused, along with the current and the requested status
+	res, payload := updateTestOrderStatus(t, employee, orderID, 3)
+	if res.StatusCode != http.StatusConflict || payload["code"] != codeInvalidStatusTransition {
+		t.Fatalf("expected 409 %s, got %d %v", codeInvalidStatusTransition, res.StatusCode, payload)
+	}
+	if payload["currentStatus"] != statusOrderReceived || payload["requestedStatus"] != statusReadyForPickUp {
+		t.Errorf("unexpected statuses in %v", payload)
+	}
+
+	for _, next := range []struct {
+		statusID   int
+		statusName string
+	}{{2, statusMakingPizza}, {3, statusReadyForPickUp}, {4, statusPickedUp}} {
+		res, payload := updateTestOrderStatus(t, employee, orderID, next.statusID)
+		if res.StatusCode != http.StatusOK || payload["orderStatus"] != next.statusName {
+			t.Fatalf("moving to %s: expected 200, got %d %v", next.statusName, res.StatusCode, payload)
+		}
+	}
+
+	// 'Picked Up' is final, the order can no longer be canceled
+	if res, payload := updateTestOrderStatus(t, employee, orderID, 5); res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 after the final status, got %d %v", res.StatusCode, payload)
+	}
+
+	// Every change is recorded in the timeline along with who made it
+	res, b := testRequest(t, "GET", fmt.Sprintf("/v1/orders/%d/timeline", orderID), customer, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	var timeline []statusChange
+	decodeTestJSON(t, b, &timeline)
+	if len(timeline) != 3 || timeline[2].NewStatus != statusPickedUp || timeline[2].ChangedBy == "" {
+		t.Errorf("expected three changes ending with %s, got %s", statusPickedUp, b)
+	}
+}
+
+func TestOrderStatusChangeErrors(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	orderID := createTestOrder(t, customer)
+
+	if res, payload := updateTestOrderStatus(t, customer, orderID, 2); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer, got %d %v", res.StatusCode, payload)
+	}
+	if res, payload := updateTestOrderStatus(t, employee, orderID, 99); res.StatusCode != http.StatusBadRequest || payload["code"] != codeUnknownStatus {
+		t.Errorf("expected 400 %s, got %d %v", codeUnknownStatus, res.StatusCode, payload)
+	}
+	if res, payload := updateTestOrderStatus(t, employee, 999999, 2); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown order, got %d %v", res.StatusCode, payload)
+	}
+}
+
+func TestCanceledOrderCannotMoveOn(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	orderID := createTestOrder(t, customer)
+
+	res, b := testRequest(t, "POST", fmt.Sprintf("/v1/orders/%d/cancel", orderID), customer, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	if res, payload := updateTestOrderStatus(t, employee, orderID, 2); res.StatusCode != http.StatusConflict || payload["currentStatus"] != statusCanceled {
+		t.Errorf("expected 409 from %s, got %d %v", statusCanceled, res.StatusCode, payload)
+	}
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/orders/%d/cancel", orderID), customer, ""); res.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 when canceling twice, got %d %s", res.StatusCode, b)
+	}
+}
+
+// Fetches the status timeline of an order
+func getTestTimeline(t *testing.T, auth, path string) []statusChange {
+	t.Helper()
+
+	res, b := testRequest(t, "GET", path, auth, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d %s", path, res.StatusCode, b)
+	}
+	var timeline []statusChange
+	decodeTestJSON(t, b, &timeline)
+	return timeline
+}
+
+func TestOrderTimelineRecordsEveryChange(t *testing.T) {
+	customerName := newTestCustomer(t, roleCustomer)
+	employeeName := newTestCustomer(t, roleEmployee)
+	customer := testToken(t, customerName)
+	employee := testToken(t, employeeName)
+	orderID := createTestOrder(t, customer)
+	path := fmt.Sprintf("/v1/orders/%d/timeline", orderID)
+
+	if timeline := getTestTimeline(t, customer, path); len(timeline) != 0 {
+		t.Errorf("expected a new order to have no changes, got %v", timeline)
+	}
+
+	// A refused change is not recorded
+	updateTestOrderStatus(t, employee, orderID, 2)
+	updateTestOrderStatus(t, employee, orderID, 4)
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/orders/%d/cancel", orderID), customer, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	want := []statusChange{
+		{ChangedBy: employeeName, PreviousStatus: statusOrderReceived, NewStatus: statusMakingPizza},
+		{ChangedBy: customerName, PreviousStatus: statusMakingPizza, NewStatus: statusCanceled},
+	}
+	timeline := getTestTimeline(t, customer, path)
+	if len(timeline) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), timeline)
+	}
+	for i, change := range timeline {
+		if change.ChangedBy != want[i].ChangedBy || change.PreviousStatus != want[i].PreviousStatus || change.NewStatus != want[i].NewStatus {
+			t.Errorf("change %d: expected %+v, got %+v", i, want[i], change)
+		}
+		if change.ChangedAt.IsZero() || (i > 0 && change.ChangedAt.Before(timeline[i-1].ChangedAt)) {
+			t.Errorf("change %d: expected the changes oldest first, got %v", i, timeline)
+		}
+	}
+
+	// The deprecated route and the store employees see the same timeline
+	for _, tc := range []struct{ auth, path string }{
+		{customer, fmt.Sprintf("/order/%d/timeline", orderID)},
+		{employee, path},
+	} {
+		if got := getTestTimeline(t, tc.auth, tc.path); fmt.Sprint(got) != fmt.Sprint(timeline) {
+			t.Errorf("GET %s: expected %v, got %v", tc.path, timeline, got)
+		}
+	}
+
+	if res, b := testRequest(t, "GET", "/v1/orders/999999/timeline", employee, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown order, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/shaj13/go-guardian/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Lifetime of a password reset token
+const passwordResetLifetime = time.Minute * 30
+
+// Handler to request a password reset
+// Sends a single use reset token to the customer through the configured Sender.
+// The response is the same whether or not the username exists, and takes the same work: a token is generated
+// and DB is written in both cases, and the token is delivered in the background.
+// Too many requests for the same username or from the same IP address are rejected with status code 429.
+func (a *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil || req.Username == "" {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Slow down the requests for the same username or from the same IP address, every request sends a message
+	ip := clientIP(r)
+	if delay := loginAttempts.PasswordResetDelay(req.Username, ip); delay > 0 {
+		setRetryAfter(w, delay)
+		responseErrorHandler(w, http.StatusTooManyRequests, "Too many password reset requests, try again later")
+		return
+	}
+	loginAttempts.PasswordResetRequested(req.Username, ip)
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "If the account exists, a password reset token has been sent",
+	}
+
+	// Generate the token before the username is looked up, so an unknown username costs the same
+	token, err := newSecretToken()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	tokenHash := hashSecretToken(token)
+
+	// Fetch the customerId from the DB given the username
+	creds, err := a.Store.GetCustomerCredentials(req.Username)
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	if err == sql.ErrNoRows {
+		// Make the same write to DB as a stored reset, the hash of a new token matches no reset
+		if _, err := a.Store.UsePasswordReset(tokenHash); err != nil && err != sql.ErrNoRows {
+			errorHandler(w, err)
+			return
+		}
+		log.Println("Password reset requested for a username that does not exist")
+		responseWriter(w, http.StatusAccepted, payload)
+		return
+	}
+
+	// Write the password reset to DB, only the hash of the token is stored
+	reset := passwordReset{
+		TokenHash:  tokenHash,
+		CustomerID: creds.CustomerID,
+		Username:   req.Username,
+		ExpiresAt:  time.Now().Add(passwordResetLifetime),
+	}
+	if err := a.Store.CreatePasswordReset(reset); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Deliver the token in the background, so the time taken by the delivery does not reveal the account exists
+	go a.sendPasswordReset(req.Username, token)
+
+	// Write HTTP response
+	responseWriter(w, http.StatusAccepted, payload)
+}
+
+// Delivers a password reset token, a failed delivery is only logged
+func (a *App) sendPasswordReset(userName, token string) {
+	err := a.Sender.Send(notification{
+		To:      userName,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use the reset token %s with 'POST /auth/password/reset' within %d minutes.\n"+
+			"If you did not ask to reset your password, ignore this message.", token, int(passwordResetLifetime.Minutes())),
+		SentAt: time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Handler to reset a password given a reset token
+// The token can only be used once. Every session of the customer is revoked after the reset.
+func (a *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil || req.Token == "" {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate the new password
+	if err := validatePassword(req.Password); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Mark the reset token as used
+	reset, err := a.Store.UsePasswordReset(hashSecretToken(req.Token))
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	if err == sql.ErrNoRows || time.Now().After(reset.ExpiresAt) {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid or expired reset token")
+		return
+	}
+
+	if err := a.setPassword(r, reset.CustomerID, reset.Username, req.Password); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s reset the password\n", reset.Username)
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Password has been reset",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to change the password of the authenticated user
+// Takes the current password and the new password. Every session of the user is revoked after the change.
+func (a *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate the new password
+	if err := validatePassword(req.Password); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Fetch hashed password from the DB and compare it with the current password that was received
+	user := auth.User(r)
+	creds, err := a.Store.GetCustomerCredentials(user.UserName())
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(creds.Password), []byte(req.CurrentPassword)); err != nil {
+		responseErrorHandler(w, http.StatusForbidden, "Current password does not match")
+		return
+	}
+
+	// The access token of the request is revoked along with the sessions
+	if err := a.denyAccessToken(user); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.setPassword(r, creds.CustomerID, user.UserName(), req.Password); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s changed the password\n", user.UserName())
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Password has been changed, obtain a new token",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Hashes and stores a new password, then revokes every session of the customer
+// The cached username and password of the customer are evicted as well, so the old password stops working right away
+func (a *App) setPassword(r *http.Request, customerID int, userName, password string) error {
+	// Salt and hash the password using the 'bcrypt' algorithm with salt of 10 rounds (bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := a.Store.SetCustomerPassword(customerID, string(hashedPassword)); err != nil {
+		return err
+	}
+
+	loginAttempts.Reset(userName)
+	return a.revokeAllSessions(r, customerID, userName)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sender that keeps the notifications, so the tests can read the reset tokens
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []notification
+}
+
+func (s *recordingSender) Send(n notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+// Waits until 'n' notifications have been sent, the reset tokens are delivered in the background
+func (s *recordingSender) waitFor(t *testing.T, n int) []notification {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+		s.mu.Lock()
+		sent := append([]notification(nil), s.sent...)
+		s.mu.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+	}
+	t.Fatalf("expected %d notifications, got %v", n, s.sent)
+	return nil
+}
+
+// Replaces the sender of the test application until the end of the test
+func setRecordingSender(t *testing.T) *recordingSender {
+	previous := testApp.Sender
+	sender := &recordingSender{}
+	testApp.Sender = sender
+	t.Cleanup(func() { testApp.Sender = previous })
+
+	return sender
+}
+
+// Matches the reset token in the body of a password reset notification
+var resetTokenPattern = regexp.MustCompile(`reset token (\S+) `)
+
+// Requests a token with the given password and returns the status code
+func tokenStatusWithPassword(t *testing.T, userName, password string) int {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", testServer.URL+"/auth/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(userName, password)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestPasswordReset(t *testing.T) {
+	resetLoginAttempts(t)
+	sender := setRecordingSender(t)
+	userName := newTestCustomer(t, roleCustomer)
+	bearer := testToken(t, userName)
+
+	// An unknown username gets the same response, and nothing is sent
+	res, unknown := testRequest(t, "POST", "/auth/password/forgot", "", `{"username":"nobody"}`)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", res.StatusCode, unknown)
+	}
+	res, known := testRequest(t, "POST", "/auth/password/forgot", "", fmt.Sprintf(`{"username":"%s"}`, userName))
+	if res.StatusCode != http.StatusAccepted || string(known) != string(unknown) {
+		t.Fatalf("expected the same 202 response, got %d %s", res.StatusCode, known)
+	}
+	sent := sender.waitFor(t, 1)
+	if len(sent) != 1 || sent[0].To != userName {
+		t.Fatalf("expected one notification to %s, got %v", userName, sent)
+	}
+	match := resetTokenPattern.FindStringSubmatch(sent[0].Body)
+	if match == nil {
+		t.Fatalf("no reset token in %q", sent[0].Body)
+	}
+	token := match[1]
+
+	// A weak password is refused without using the token
+	if res, b := testRequest(t, "POST", "/auth/password/reset", "", fmt.Sprintf(`{"token":"%s","password":"short"}`, token)); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a weak password, got %d %s", res.StatusCode, b)
+	}
+
+	// A backing off username can log in with the new password right away
+	for i := 0; i < userBackoffThreshold; i++ {
+		tokenStatusWithPassword(t, userName, "Wr0ngPassword")
+	}
+
+	body := fmt.Sprintf(`{"token":"%s","password":"N3wPassw0rd"}`, token)
+	if res, b := testRequest(t, "POST", "/auth/password/reset", "", body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "POST", "/auth/password/reset", "", body); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 when the token is used again, got %d %s", res.StatusCode, b)
+	}
+
+	if status := tokenStatusWithPassword(t, userName, "N3wPassw0rd"); status != http.StatusOK {
+		t.Errorf("expected the new password to work, got %d", status)
+	}
+	if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusUnauthorized {
+		t.Errorf("expected the old password to be refused, got %d", status)
+	}
+	if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the sessions to be revoked, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+	bearer := testToken(t, userName)
+
+	if res, b := testRequest(t, "PUT", "/v1/customers/me/password", bearer, `{"currentPassword":"Wr0ngPassword","password":"N3wPassw0rd"}`); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong current password, got %d %s", res.StatusCode, b)
+	}
+
+	body := fmt.Sprintf(`{"currentPassword":"%s","password":"N3wPassw0rd"}`, testPassword)
+	if res, b := testRequest(t, "PUT", "/v1/customers/me/password", bearer, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	// The token of the request is revoked along with the old password
+	if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token to be revoked, got %d %s", res.StatusCode, b)
+	}
+	if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusUnauthorized {
+		t.Errorf("expected the old password to be refused, got %d", status)
+	}
+	if status := tokenStatusWithPassword(t, userName, "N3wPassw0rd"); status != http.StatusOK {
+		t.Errorf("expected the new password to work, got %d", status)
+	}
+}
+
+// Store that counts the password reset writes
+type countingResetStore struct {
+	Store
+	mu     sync.Mutex
+	writes int
+}
+
+func (s *countingResetStore) CreatePasswordReset(p passwordReset) error {
+	s.count()
+	return s.Store.CreatePasswordReset(p)
+}
+
+func (s *countingResetStore) UsePasswordReset(tokenHash string) (passwordReset, error) {
+	s.count()
+	return s.Store.UsePasswordReset(tokenHash)
+}
+
+func (s *countingResetStore) count() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+}
+
+// Sender that holds the deliveries until released
+type blockedSender struct {
+	release chan struct{}
+}
+
+func (s *blockedSender) Send(n notification) error {
+	<-s.release
+	return nil
+}
+
+func TestForgotPasswordTakesTheSameWorkForUnknownUsernames(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+
+	store := &countingResetStore{Store: testApp.Store}
+	sender := &blockedSender{release: make(chan struct{})}
+	previousStore, previousSender := testApp.Store, testApp.Sender
+	testApp.Store, testApp.Sender = store, sender
+	t.Cleanup(func() { testApp.Store, testApp.Sender = previousStore, previousSender })
+	defer close(sender.release)
+
+	for _, name := range []string{userName, "nobody"} {
+		writes := store.writes
+
+		// The response does not wait for the delivery
+		done := make(chan int, 1)
+		go func() {
+			res, _ := testRequest(t, "POST", "/auth/password/forgot", "", fmt.Sprintf(`{"username":"%s"}`, name))
+			done <- res.StatusCode
+		}()
+		select {
+		case status := <-done:
+			if status != http.StatusAccepted {
+				t.Errorf("%s: expected 202, got %d", name, status)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%s: the response waited for the delivery", name)
+		}
+
+		if store.writes != writes+1 {
+			t.Errorf("%s: expected one write to DB, got %d", name, store.writes-writes)
+		}
+	}
+}
+
+func TestForgotPasswordIsThrottled(t *testing.T) {
+	resetLoginAttempts(t)
+	setRecordingSender(t)
+	userName := newTestCustomer(t, roleCustomer)
+
+	// A known and an unknown username are limited alike
+	for _, name := range []string{userName, "nobody"} {
+		body := fmt.Sprintf(`{"username":"%s"}`, name)
+		for i := 0; i < userResetThreshold; i++ {
+			if res, b := testRequest(t, "POST", "/auth/password/forgot", "", body); res.StatusCode != http.StatusAccepted {
+				t.Fatalf("%s request %d: expected 202, got %d %s", name, i+1, res.StatusCode, b)
+			}
+		}
+		res, b := testRequest(t, "POST", "/auth/password/forgot", "", body)
+		if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+			t.Fatalf("%s: expected 429 with Retry-After, got %d %s", name, res.StatusCode, b)
+		}
+	}
+
+	// The reset requests do not slow down the logins
+	if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusOK {
+		t.Errorf("expected the login to work, got %d", status)
+	}
+
+	// The requests are accepted again once the delay has passed
+	skipLoginBackoff()
+	if res, b := testRequest(t, "POST", "/auth/password/forgot", "", fmt.Sprintf(`{"username":"%s"}`, userName)); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 after the delay, got %d %s", res.StatusCode, b)
+	}
+
+	// An IP address sending requests for many usernames is limited as well
+	resetLoginAttempts(t)
+	for i := 0; i < ipResetThreshold; i++ {
+		testRequest(t, "POST", "/auth/password/forgot", "", fmt.Sprintf(`{"username":"nobody%d"}`, i))
+	}
+	if res, b := testRequest(t, "POST", "/auth/password/forgot", "", `{"username":"somebody"}`); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for the IP address, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Placeholders that replace the personal data of an erased customer
+// The phone number is in E.164 like every stored number, +999 is a calling code that the ITU has not assigned.
+const (
+	erasedName        = "Erased"
+	erasedPhoneNumber = "+99900000000"
+)
+
+// Returns the username that replaces the username of an erased customer
+// Usernames cannot hold a colon, so nobody can sign up with it before the customer is erased.
+func erasedUsername(customerID int) string {
+	return fmt.Sprintf("erased:%d", customerID)
+}
+
+// Handler to export everything held about the authenticated user as a JSON archive
+func (a *App) exportMyDataHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeCustomerExport(w, authenticatedCustomerID(r))
+}
+
+// Handler to export everything held about a customer as a JSON archive (Used by admins)
+// Closed and erased accounts can be exported as well.
+func (a *App) exportCustomerDataHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'customerId' from a Request URL
+	customerID, err := strconv.Atoi(mux.Vars(r)["customerId"])
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid customer ID")
+		return
+	}
+
+	log.Printf("User %s exported the personal data of customer %d\n", authenticatedUserName(r), customerID)
+	a.writeCustomerExport(w, customerID)
+}
+
+// Handler to erase the personal data of a customer (Used by admins)
+// The customer and order rows are anonymized rather than deleted, so the sales figures stay intact.
+// The account is closed and every session and API key of the account is revoked.
+func (a *App) eraseCustomerDataHandler(w http.ResponseWriter, r *http.Request) {
+	// Create route variable and retrieve 'customerId' from a Request URL
+	customerID, err := strconv.Atoi(mux.Vars(r)["customerId"])
+	if err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid customer ID")
+		return
+	}
+
+	// The username is needed to evict the cached decisions once it has been erased
+	c, err := a.Store.GetCustomer(customerID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// Anonymize the customer data in DB
+	if err := a.Store.EraseCustomer(customerID, a.Clock()); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.revokeAllSessions(r, customerID, c.Username); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	loginAttempts.Reset(c.Username)
+	log.Printf("User %s erased the personal data of customer %d\n", authenticatedUserName(r), customerID)
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"customerId": customerID,
+		"message":    "Personal data erased",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Collects everything held about a customer and writes it as a downloadable JSON archive
+func (a *App) writeCustomerExport(w http.ResponseWriter, customerID int) {
+	// Get customer data from DB
+	c, err := a.Store.GetCustomer(customerID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+	export := customerExport{
+		ExportedAt: a.Clock(),
+		Customer:   c,
+		Orders:     []orderExport{},
+		APIKeys:    []apiKey{},
+	}
+
+	// Attach the orders along with their status history
+	orders, err := a.Store.GetCustomerOrders(customerID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	for _, o := range orders {
+		timeline, err := a.Store.GetOrderTimeline(o.OrderID)
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+		export.Orders = append(export.Orders, orderExport{order: o, Timeline: timeline})
+	}
+
+	// Attach the two-factor authentication settings, without the secret
+	tf, err := a.Store.GetTwoFactor(customerID)
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	export.TwoFactor = twoFactorExport{Enabled: tf.Confirmed, Required: tf.Required}
+
+	// Attach the API keys acting on behalf of the customer
+	keys, err := a.Store.GetAPIKeys()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	for _, k := range keys {
+		if k.CustomerID == customerID {
+			export.APIKeys = append(export.APIKeys, k)
+		}
+	}
+
+	// Attach the lockouts of the account, they hold the IP addresses of the failed attempts
+	// The lockouts recorded under a previous username are matched on the customerId.
+	lockouts, err := a.Store.GetAccountLockouts("")
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	export.AccountLockouts = []accountLockout{}
+	for _, l := range lockouts {
+		if l.CustomerID == customerID {
+			export.AccountLockouts = append(export.AccountLockouts, l)
+		}
+	}
+
+	// Write HTTP response
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"customer-%d-export.json\"", customerID))
+	responseWriter(w, http.StatusOK, export)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a struct that holds a customer with data in every table that erasure anonymizes
+type erasureTestCustomer struct {
+	CustomerID  int
+	OldUsername string
+	Username    string
+	Bearer      string
+	APIKey      string
+	ResetToken  string
+}
+
+// Creates a customer that canceled an order and was locked out under a previous username, and then
+// holds a session, an API key, a password reset token, and two-factor authentication under the current one
+func newErasureTestCustomer(t *testing.T, admin string) erasureTestCustomer {
+	t.Helper()
+
+	now := time.Now()
+	setTestClock(t, now)
+	resetLoginAttempts(t)
+	sender := setRecordingSender(t)
+
+	c := erasureTestCustomer{OldUsername: newTestCustomer(t, roleCustomer)}
+	creds, err := testApp.Store.GetCustomerCredentials(c.OldUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CustomerID = creds.CustomerID
+	bearer := testToken(t, c.OldUsername)
+
+	orderID := createTestOrder(t, bearer)
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/orders/%d/cancel", orderID), bearer, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: %d %s", res.StatusCode, b)
+	}
+	for i := 0; i < lockoutThreshold; i++ {
+		skipLoginBackoff()
+		wrongPasswordRequest(t, c.OldUsername)
+	}
+	skipLoginBackoff()
+
+	c.Username = c.OldUsername + "-renamed"
+	if res, b := testRequest(t, "PATCH", "/v1/customers/me", bearer, fmt.Sprintf(`{"username":"%s"}`, c.Username)); res.StatusCode != http.StatusOK {
+		t.Fatalf("rename: %d %s", res.StatusCode, b)
+	}
+	res, b := testRequest(t, "POST", "/apikey/add", admin, fmt.Sprintf(`{"name":"kiosk","username":"%s","scopes":["%s"]}`, c.Username, scopeOrdersRead))
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("api key: %d %s", res.StatusCode, b)
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	decodeTestJSON(t, b, &created)
+	c.APIKey = created.Key
+
+	if res, b := testRequest(t, "POST", "/auth/password/forgot", "", fmt.Sprintf(`{"username":"%s"}`, c.Username)); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("forgot: %d %s", res.StatusCode, b)
+	}
+	sent := sender.waitFor(t, 1)
+	match := resetTokenPattern.FindStringSubmatch(sent[len(sent)-1].Body)
+	if match == nil {
+		t.Fatalf("no reset token in %v", sent)
+	}
+	c.ResetToken = match[1]
+
+	// Enrolling revokes the sessions, the token is obtained with the code of the next time step
+	secret := enrollTestTwoFactor(t, c.Username, now)
+	now = now.Add(time.Second * totpPeriod)
+	setTestClock(t, now)
+	res, b = testRequest(t, "POST", "/auth/token", c.Username, "", twoFactorHeader, testTOTPCode(t, secret, now, 0))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("token: %d %s", res.StatusCode, b)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	decodeTestJSON(t, b, &token)
+	c.Bearer = "Bearer " + token.AccessToken
+
+	return c
+}
+
+// Retrieves the personal data export of a customer as an admin
+func exportTestCustomer(t *testing.T, admin string, customerID int) customerExport {
+	t.Helper()
+
+	res, b := testRequest(t, "GET", fmt.Sprintf("/v1/customers/%d/export", customerID), admin, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("export: %d %s", res.StatusCode, b)
+	}
+	var export customerExport
+	decodeTestJSON(t, b, &export)
+	return export
+}
+
+func TestExportHoldsEverythingAboutTheCustomer(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	c := newErasureTestCustomer(t, admin)
+
+	export := exportTestCustomer(t, admin, c.CustomerID)
+	if export.Customer.CustomerID != c.CustomerID || export.Customer.Username != c.Username || export.Customer.CustomerPhoneNumber != "+18125984475" {
+		t.Errorf("expected the profile of the customer, got %+v", export.Customer)
+	}
+	if len(export.Orders) != 1 || len(export.Orders[0].Timeline) != 1 || export.Orders[0].Timeline[0].ChangedBy != c.OldUsername {
+		t.Errorf("expected the order along with the cancellation, got %+v", export.Orders)
+	}
+	if !export.TwoFactor.Enabled {
+		t.Errorf("expected two-factor authentication to be enabled, got %+v", export.TwoFactor)
+	}
+	if len(export.APIKeys) != 1 || export.APIKeys[0].Name != "kiosk" {
+		t.Errorf("expected the API key of the customer, got %+v", export.APIKeys)
+	}
+
+	// The lockout recorded under the previous username belongs to the customer
+	if len(export.AccountLockouts) != 1 || export.AccountLockouts[0].Username != c.OldUsername || export.AccountLockouts[0].CustomerID != c.CustomerID {
+		t.Errorf("expected the lockout of the previous username, got %+v", export.AccountLockouts)
+	}
+
+	// The customer receives the same archive
+	res, b := testRequest(t, "GET", "/v1/customers/me/export", c.Bearer, "")
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Disposition"), fmt.Sprintf("customer-%d-export.json", c.CustomerID)) {
+		t.Fatalf("expected the archive of the customer, got %d %v %s", res.StatusCode, res.Header, b)
+	}
+	var own customerExport
+	decodeTestJSON(t, b, &own)
+	if own.Customer.CustomerID != c.CustomerID || len(own.Orders) != 1 || len(own.AccountLockouts) != 1 {
+		t.Errorf("expected the same data as the admin export, got %+v", own)
+	}
+}
+
+func TestErasureAnonymizesEveryTable(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	c := newErasureTestCustomer(t, admin)
+
+	res, b := testRequest(t, "POST", fmt.Sprintf("/v1/customers/%d/erase", c.CustomerID), admin, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	// CUSTOMERS and ORDERS
+	export := exportTestCustomer(t, admin, c.CustomerID)
+	erased := customer{
+		CustomerID:          c.CustomerID,
+		FirstName:           erasedName,
+		LastName:            erasedName,
+		CustomerPhoneNumber: erasedPhoneNumber,
+		Username:            erasedUsername(c.CustomerID),
+		Role:                roleCustomer,
+		Closed:              true,
+	}
+	if export.Customer != erased {
+		t.Errorf("expected %+v, got %+v", erased, export.Customer)
+	}
+	if len(export.Orders) != 1 || export.Orders[0].CustomerPhoneNumber != erasedPhoneNumber || len(export.Orders[0].Items) != 1 {
+		t.Fatalf("expected the order to keep its items without the phone number, got %+v", export.Orders)
+	}
+
+	// ORDER_STATUS_HISTORY, written under the previous username
+	if changedBy := export.Orders[0].Timeline[0].ChangedBy; changedBy != erasedUsername(c.CustomerID) {
+		t.Errorf("expected the status change to be anonymized, got %s", changedBy)
+	}
+
+	// ACCOUNT_LOCKOUTS, written under the previous username
+	if len(export.AccountLockouts) != 0 {
+		t.Errorf("expected the lockouts to be deleted, got %+v", export.AccountLockouts)
+	}
+	if res, b := testRequest(t, "GET", "/customer/lockouts?username="+c.OldUsername, admin, ""); res.StatusCode != http.StatusOK || string(b) != "[]" {
+		t.Errorf("expected no lockout of the previous username, got %d %s", res.StatusCode, b)
+	}
+
+	// TWO_FACTOR and TWO_FACTOR_RECOVERY_CODES
+	if export.TwoFactor.Enabled {
+		t.Errorf("expected two-factor authentication to be deleted")
+	}
+	store := testApp.Store.(*memoryStore)
+	store.mu.Lock()
+	for _, rc := range store.recoveryCodes {
+		if rc.CustomerID == c.CustomerID {
+			t.Errorf("expected the recovery codes to be deleted")
+			break
+		}
+	}
+	store.mu.Unlock()
+
+	// API_KEYS
+	if len(export.APIKeys) != 1 || export.APIKeys[0].Name != erasedUsername(c.CustomerID) || export.APIKeys[0].RevokedAt == nil {
+		t.Errorf("expected the API key to be renamed and revoked, got %+v", export.APIKeys)
+	}
+
+	// PASSWORD_RESETS
+	if res, b := testRequest(t, "POST", "/auth/password/reset", "", fmt.Sprintf(`{"token":"%s","password":"N3wPassw0rd"}`, c.ResetToken)); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the reset token to be deleted, got %d %s", res.StatusCode, b)
+	}
+
+	// AUTH_SESSIONS
+	if res, b := testRequest(t, "GET", "/v1/customers/me", c.Bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the session to be revoked, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestErasedAccountCannotAuthenticate(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	c := newErasureTestCustomer(t, admin)
+
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/customers/%d/erase", c.CustomerID), admin, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	for _, userName := range []string{c.Username, c.OldUsername} {
+		skipLoginBackoff()
+		if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusUnauthorized {
+			t.Errorf("expected 401 for the password of %s, got %d", userName, status)
+		}
+	}
+	if res, b := testRequest(t, "GET", "/v1/customers/me", c.Bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the bearer token, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/pizzas", "", "", apiKeyHeader, c.APIKey); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the API key, got %d %s", res.StatusCode, b)
+	}
+}
+
+// Erasure must not fail, or leave two accounts with the same username, when the placeholder looks like a username
+func TestErasedUsernameCannotBeTaken(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	userName := newTestCustomer(t, roleCustomer)
+	creds, err := testApp.Store.GetCustomerCredentials(userName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signup := `{"firstName":"Test","lastName":"Customer","customerPhoneNumber":"8125984475","username":"%s","password":"%s"}`
+	placeholder := erasedUsername(creds.CustomerID)
+	if res, b := testRequest(t, "POST", "/v1/customers", "", fmt.Sprintf(signup, placeholder, testPassword)); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for the placeholder, got %d %s", res.StatusCode, b)
+	}
+	bearer := testToken(t, newTestCustomer(t, roleCustomer))
+	if res, b := testRequest(t, "PATCH", "/v1/customers/me", bearer, fmt.Sprintf(`{"username":"%s"}`, placeholder)); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 when renaming to the placeholder, got %d %s", res.StatusCode, b)
+	}
+
+	// A look-alike username is taken before the erasure
+	lookAlike := fmt.Sprintf("erased-%d", creds.CustomerID)
+	if res, b := testRequest(t, "POST", "/v1/customers", "", fmt.Sprintf(signup, lookAlike, testPassword)); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d %s", res.StatusCode, b)
+	}
+
+	if res, b := testRequest(t, "POST", fmt.Sprintf("/v1/customers/%d/erase", creds.CustomerID), admin, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if status := tokenStatusWithPassword(t, lookAlike, testPassword); status != http.StatusOK {
+		t.Errorf("expected the look-alike account to keep working, got %d", status)
+	}
+	if export := exportTestCustomer(t, admin, creds.CustomerID); export.Customer.Username != placeholder {
+		t.Errorf("expected %s, got %s", placeholder, export.Customer.Username)
+	}
+}
+
+func TestErasedPhoneNumberIsE164(t *testing.T) {
+	if number, err := normalizePhoneNumber(erasedPhoneNumber, "US"); err != nil || number != erasedPhoneNumber {
+		t.Errorf("expected %s to be normalized to itself, got %q %v", erasedPhoneNumber, number, err)
+	}
+}
+
+func TestPersonalDataRequestErrors(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	userName := newTestCustomer(t, roleCustomer)
+	creds, err := testApp.Store.GetCustomerCredentials(userName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/v1/customers/%d/export"},
+		{"POST", "/v1/customers/%d/erase"},
+		{"GET", "/customer/%d/export"},
+		{"POST", "/customer/%d/erase"},
+	} {
+		if res, b := testRequest(t, route.method, fmt.Sprintf(route.path, 999999), admin, ""); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404 for an unknown customer, got %d %s", route.method, route.path, res.StatusCode, b)
+		}
+		if res, b := testRequest(t, route.method, fmt.Sprintf(route.path, creds.CustomerID), customer, ""); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 for a customer, got %d %s", route.method, route.path, res.StatusCode, b)
+		}
+	}
+
+	// The customer was left untouched
+	if _, err := testApp.Store.GetCustomerCredentials(userName); err != nil {
+		t.Errorf("expected the account to be kept: %v", err)
+	}
+}
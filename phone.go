@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Setup global region used for phone numbers that are not written in the international format (e.g. "(555) 123-4567")
+var defaultPhoneRegion = strings.ToUpper(getEnv("PHONE_DEFAULT_REGION", "US"))
+
+// Create a struct that holds the numbering plan of a region
+// 'MinLength' and 'MaxLength' bound the national number, without the trunk prefix
+type phoneRegion struct {
+	CallingCode string
+	TrunkPrefix string
+	MinLength   int
+	MaxLength   int
+}
+
+// Numbering plans of the regions that can be used as the default region, keyed by ISO 3166-1 alpha-2 code
+// Numbers in the international format are accepted for any calling code.
+var phoneRegions = map[string]phoneRegion{
+	"AU": {"61", "0", 9, 9},
+	"BR": {"55", "0", 10, 11},
+	"CA": {"1", "1", 10, 10},
+	"CN": {"86", "0", 10, 11},
+	"DE": {"49", "0", 6, 13},
+	"ES": {"34", "", 9, 9},
+	"FR": {"33", "0", 9, 9},
+	"GB": {"44", "0", 9, 10},
+	"IE": {"353", "0", 7, 9},
+	"IN": {"91", "0", 10, 10},
+	"IT": {"39", "", 6, 11},
+	"JP": {"81", "0", 9, 10},
+	"KR": {"82", "0", 8, 10},
+	"MX": {"52", "", 10, 10},
+	"NL": {"31", "0", 9, 9},
+	"NZ": {"64", "0", 8, 10},
+	"PH": {"63", "0", 10, 10},
+	"US": {"1", "1", 10, 10},
+	"ZA": {"27", "0", 9, 9},
+}
+
+// Error returned when a phone number cannot be normalized
+var errInvalidPhoneNumber = errors.New("must be a valid phone number")
+
+// Checks that the default region is one of the known regions
+func validateDefaultPhoneRegion() error {
+	if _, ok := phoneRegions[defaultPhoneRegion]; ok {
+		return nil
+	}
+
+	known := []string{}
+	for code := range phoneRegions {
+		known = append(known, code)
+	}
+	sort.Strings(known)
+	return fmt.Errorf("PHONE_DEFAULT_REGION %q is not supported, must be one of %s", defaultPhoneRegion, strings.Join(known, ", "))
+}
+
+// Parses a phone number and normalizes it to E.164 (e.g. "+15551234567")
+// Numbers starting with '+' or an international call prefix ('00', or '011' in North America) are read as international,
+// other numbers are read as national numbers of the region.
+// Spaces, dashes, dots, slashes, and parentheses are ignored.
+func normalizePhoneNumber(number, region string) (string, error) {
+	plan, ok := phoneRegions[region]
+	if !ok {
+		return "", fmt.Errorf("unknown phone region %q", region)
+	}
+
+	number = strings.TrimSpace(number)
+	international := strings.HasPrefix(number, "+")
+	if international {
+		// A trunk prefix written as "(0)" after the calling code is not dialed from abroad
+		number = strings.Replace(number[1:], "(0)", "", 1)
+	}
+
+	// Keep the digits and drop the formatting
+	var digits strings.Builder
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case strings.ContainsRune(" -./()", r):
+		default:
+			return "", errInvalidPhoneNumber
+		}
+	}
+	national := digits.String()
+
+	if !international {
+		switch {
+		case plan.CallingCode == "1" && strings.HasPrefix(national, "011"):
+			national, international = national[3:], true
+		case plan.CallingCode != "1" && strings.HasPrefix(national, "00"):
+			national, international = national[2:], true
+		}
+	}
+	if international {
+		return normalizeInternationalNumber(national)
+	}
+
+	if plan.TrunkPrefix != "" && strings.HasPrefix(national, plan.TrunkPrefix) {
+		national = national[len(plan.TrunkPrefix):]
+	}
+	if !validNationalNumber(plan, national) {
+		return "", errInvalidPhoneNumber
+	}
+	return "+" + plan.CallingCode + national, nil
+}
+
+// Normalizes the digits of a number in the international format, starting with the calling code
+// The national number is checked against the numbering plan when the calling code is known
+func normalizeInternationalNumber(digits string) (string, error) {
+	// E.164 numbers hold at most 15 digits and calling codes never start with 0
+	if len(digits) < 7 || len(digits) > 15 || digits[0] == '0' {
+		return "", errInvalidPhoneNumber
+	}
+
+	// Calling codes are prefix-free, so at most one of the known calling codes matches
+	for _, plan := range phoneRegions {
+		if !strings.HasPrefix(digits, plan.CallingCode) {
+			continue
+		}
+		national := digits[len(plan.CallingCode):]
+		if plan.TrunkPrefix != "" && plan.TrunkPrefix != "1" && strings.HasPrefix(national, plan.TrunkPrefix) {
+			national = national[len(plan.TrunkPrefix):]
+		}
+		if !validNationalNumber(plan, national) {
+			return "", errInvalidPhoneNumber
+		}
+		return "+" + plan.CallingCode + national, nil
+	}
+
+	return "+" + digits, nil
+}
+
+// Checks the length of a national number against the numbering plan
+// North American area codes never start with 0 or 1.
+func validNationalNumber(plan phoneRegion, national string) bool {
+	if len(national) < plan.MinLength || len(national) > plan.MaxLength {
+		return false
+	}
+	if plan.CallingCode == "1" && (national[0] == '0' || national[0] == '1') {
+		return false
+	}
+	return true
+}
+
+// Rewrites the phone numbers stored before they were kept in E.164, with the rules applied to new numbers
+// Numbers that cannot be normalized in the default region are left as they are, and their rows are logged
+// so they can be fixed by hand.
+func normalizeLegacyPhoneNumbers(tx *sql.Tx) error {
+	if err := validateDefaultPhoneRegion(); err != nil {
+		return err
+	}
+
+	for _, table := range []struct{ name, key string }{{"CUSTOMERS", "customerId"}, {"ORDERS", "orderId"}} {
+		// Read every row before rewriting them, the connection serves one query at a time
+		rows, err := tx.Query(`SELECT ` + table.key + `, customerPhoneNumber FROM ` + table.name + ` WHERE customerPhoneNumber !~ '^\+[1-9][0-9]{6,14}$'`)
+		if err != nil {
+			return err
+		}
+		legacy := map[int]string{}
+		for rows.Next() {
+			var id int
+			var number string
+			if err := rows.Scan(&id, &number); err != nil {
+				rows.Close()
+				return err
+			}
+			legacy[id] = number
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		skipped := 0
+		for id, number := range legacy {
+			normalized, err := normalizePhoneNumber(number, defaultPhoneRegion)
+			if err != nil {
+				log.Printf("%s %s %d: phone number cannot be normalized in region %s, left as is\n", table.name, table.key, id, defaultPhoneRegion)
+				skipped++
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE `+table.name+` SET customerPhoneNumber = $2 WHERE `+table.key+` = $1`, id, normalized); err != nil {
+				return err
+			}
+		}
+		log.Printf("%s: normalized %d phone numbers to E.164, %d left as is\n", table.name, len(legacy)-skipped, skipped)
+	}
+
+	return nil
+}
+
+// Validation rule that accepts the phone numbers that can be normalized in the default region
+func isPhoneNumber(value interface{}) error {
+	number, _ := value.(string)
+	if number == "" {
+		return nil
+	}
+
+	_, err := normalizePhoneNumber(number, defaultPhoneRegion)
+	if err != nil {
+		return errInvalidPhoneNumber
+	}
+	return nil
+}
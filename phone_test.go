@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A number of every region, written as it is dialed in the region, along with its E.164 form
+var phoneRegionNumbers = []struct {
+	region   string
+	national string
+	want     string
+}{
+	{"AU", "(02) 1234 5678", "+61212345678"},
+	{"BR", "0 11 91234-5678", "+5511912345678"},
+	{"CA", "1 (416) 555-0199", "+14165550199"},
+	{"CN", "010 1234 5678", "+861012345678"},
+	{"DE", "030 123456", "+4930123456"},
+	{"ES", "912 345 678", "+34912345678"},
+	{"FR", "01 23 45 67 89", "+33123456789"},
+	{"GB", "020 7946 0958", "+442079460958"},
+	{"IE", "01 234 5678", "+35312345678"},
+	{"IN", "098765 43210", "+919876543210"},
+	{"IT", "06 1234 5678", "+390612345678"},
+	{"JP", "03-1234-5678", "+81312345678"},
+	{"KR", "02-123-4567", "+8221234567"},
+	{"MX", "55 1234 5678", "+525512345678"},
+	{"NL", "020 123 4567", "+31201234567"},
+	{"NZ", "09 123 4567", "+6491234567"},
+	{"PH", "0917 123 4567", "+639171234567"},
+	{"US", "(812) 598-4475", "+18125984475"},
+	{"ZA", "021 123 4567", "+27211234567"},
+}
+
+func TestNormalizePhoneNumberInEveryRegion(t *testing.T) {
+	covered := map[string]bool{}
+	for _, tc := range phoneRegionNumbers {
+		covered[tc.region] = true
+		plan := phoneRegions[tc.region]
+		digits := tc.want[1+len(plan.CallingCode):]
+
+		valid := map[string]string{
+			"national":              tc.national,
+			"without separators":    strings.Map(keepDigits, tc.national),
+			"international":         tc.want,
+			"international spacing": "+" + plan.CallingCode + " " + digits[:2] + "-" + digits[2:],
+		}
+		if plan.TrunkPrefix != "" {
+			valid["without trunk prefix"] = strings.TrimPrefix(strings.Map(keepDigits, tc.national), plan.TrunkPrefix)
+		}
+		if plan.TrunkPrefix == "0" {
+			valid["trunk prefix after the calling code"] = "+" + plan.CallingCode + " 0" + digits
+			valid["trunk prefix in parentheses"] = "+" + plan.CallingCode + " (0)" + digits
+		}
+		if plan.CallingCode == "1" {
+			valid["international call prefix"] = "011 " + plan.CallingCode + digits
+		} else {
+			valid["international call prefix"] = "00 " + plan.CallingCode + digits
+		}
+
+		for name, number := range valid {
+			if got, err := normalizePhoneNumber(number, tc.region); err != nil || got != tc.want {
+				t.Errorf("%s %s %q: expected %s, got %q %v", tc.region, name, number, tc.want, got, err)
+			}
+		}
+
+		// A number in the international format is read the same in every region
+		for region := range phoneRegions {
+			if got, err := normalizePhoneNumber(tc.want, region); err != nil || got != tc.want {
+				t.Errorf("%s read in %s: expected %s, got %q %v", tc.want, region, tc.want, got, err)
+			}
+		}
+
+		invalid := map[string]string{
+			"too short":               digits[:plan.MinLength-1],
+			"too long":                digits + strings.Repeat("5", plan.MaxLength-len(digits)+1),
+			"international too short": "+" + plan.CallingCode + digits[:plan.MinLength-1],
+			"international too long":  "+" + plan.CallingCode + digits + strings.Repeat("5", plan.MaxLength-len(digits)+1),
+			"letters":                 tc.national[:len(tc.national)-1] + "x",
+		}
+		for name, number := range invalid {
+			if got, err := normalizePhoneNumber(number, tc.region); err == nil {
+				t.Errorf("%s %s %q: expected an error, got %s", tc.region, name, number, got)
+			}
+		}
+	}
+
+	for region := range phoneRegions {
+		if !covered[region] {
+			t.Errorf("no test number for region %s", region)
+		}
+	}
+}
+
+// Keeps the digits of a phone number, for use with strings.Map
+func keepDigits(r rune) rune {
+	if r >= '0' && r <= '9' {
+		return r
+	}
+	return -1
+}
+
+func TestNormalizePhoneNumberErrors(t *testing.T) {
+	for _, number := range []string{
+		"",
+		"+",
+		"812_598_4475",
+		"+0 812 598 4475",
+		"+123456",
+		"+1234567890123456",
+		"0812 598 4475",
+		"1812 598 447",
+		"(012) 598-4475",
+		"(112) 598-4475",
+		"00 44 20 7946 0958",
+	} {
+		if got, err := normalizePhoneNumber(number, "US"); err == nil {
+			t.Errorf("%q: expected an error, got %s", number, got)
+		}
+	}
+
+	// Calling codes without a numbering plan are accepted in the international format
+	if got, err := normalizePhoneNumber("+999 0000 0000", "US"); err != nil || got != "+99900000000" {
+		t.Errorf("expected +99900000000, got %q %v", got, err)
+	}
+
+	if _, err := normalizePhoneNumber("8125984475", "XX"); err == nil {
+		t.Errorf("expected an error for an unknown region")
+	}
+}
+
+func TestUnknownDefaultPhoneRegionIsRefused(t *testing.T) {
+	previous := defaultPhoneRegion
+	t.Cleanup(func() { defaultPhoneRegion = previous })
+
+	defaultPhoneRegion = "XX"
+	err := validateDefaultPhoneRegion()
+	if err == nil || !strings.Contains(err.Error(), "US") {
+		t.Errorf("expected the supported regions to be listed, got %v", err)
+	}
+
+	defaultPhoneRegion = "GB"
+	if err := validateDefaultPhoneRegion(); err != nil {
+		t.Errorf("expected GB to be supported, got %v", err)
+	}
+	if err := isPhoneNumber("020 7946 0958"); err != nil {
+		t.Errorf("expected a national number of the default region, got %v", err)
+	}
+	if err := isPhoneNumber("598-4475"); err != errInvalidPhoneNumber {
+		t.Errorf("expected a short number to be invalid in GB, got %v", err)
+	}
+}
+
+func TestInvalidPhoneNumberIsAValidationError(t *testing.T) {
+	body := `{"firstName":"Test","lastName":"Customer","customerPhoneNumber":"598-4475","username":"phone-tester","password":"Passw0rd1"}`
+	res, b := testRequest(t, "POST", "/v1/customers", "", body)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d %s", res.StatusCode, b)
+	}
+	var problem struct {
+		Errors map[string]string `json:"errors"`
+	}
+	decodeTestJSON(t, b, &problem)
+	if problem.Errors["customerPhoneNumber"] != errInvalidPhoneNumber.Error() {
+		t.Errorf("expected the phone number to be reported, got %v", problem.Errors)
+	}
+
+	// The number is stored in E.164
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	res, b = testRequest(t, "GET", "/v1/customers/me", customer, "")
+	var c struct {
+		CustomerPhoneNumber string `json:"customerPhoneNumber"`
+	}
+	decodeTestJSON(t, b, &c)
+	if res.StatusCode != http.StatusOK || c.CustomerPhoneNumber != "+18125984475" {
+		t.Errorf("expected +18125984475, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Store implementation backed by Postgres and the 'PAS_SP_*' stored procedures
+type postgresStore struct {
+	DB *sql.DB
+}
+
+// Create a Postgres store on top of an open DB connection
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{DB: db}
+}
+
+// Takes firstName, lastName, customerPhoneNumber, username, and hashedPassword and
+// creates a new row to 'CUSTOMERS' table with provided customer information, and sets the customerId
+func (s *postgresStore) CreateCustomer(c *customer, hashedPassword string) error {
+	// Calls the Stored Procedure and captures the customer id
+	err := s.DB.QueryRow("CALL PAS_SP_CREATE_CUSTOMER($1, $2, $3, $4, $5)", c.FirstName, c.LastName, c.CustomerPhoneNumber, c.Username, hashedPassword).Scan(&c.CustomerID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return errUsernameTaken
+	}
+	return err
+}
+
+// Retrieves the customerId, hashed password, and role given the username
+func (s *postgresStore) GetCustomerCredentials(username string) (credentials, error) {
+	var customerID sql.NullInt64
+	var password, role sql.NullString
+
+	// Calls the Stored Procedure 'PAS_SP_GET_CUSTOMER_CREDENTIALS'
+	if err := s.DB.QueryRow("CALL PAS_SP_GET_CUSTOMER_CREDENTIALS($1)", username).Scan(&customerID, &password, &role); err != nil {
+		return credentials{}, err
+	}
+
+	// The procedure returns NULL when the username does not exist
+	if !customerID.Valid {
+		return credentials{}, sql.ErrNoRows
+	}
+	return credentials{CustomerID: int(customerID.Int64), Password: password.String, Role: role.String}, nil
+}
+
+// Retrieves the profile of a customer given the customerId, closed accounts are flagged with 'Closed'
+func (s *postgresStore) GetCustomer(customerID int) (customer, error) {
+	var c customer
+	err := s.DB.QueryRow(
+		"SELECT customerId, firstName, lastName, customerPhoneNumber, username, role, isDeleted FROM CUSTOMERS WHERE customerId = $1", customerID).Scan(
+		&c.CustomerID, &c.FirstName, &c.LastName, &c.CustomerPhoneNumber, &c.Username, &c.Role, &c.Closed)
+	return c, err
+}
+
+// Updates the name, phone number, and username of a customer that is not closed
+func (s *postgresStore) UpdateCustomer(c customer) error {
+	var customerID sql.NullInt64
+
+	// Calls the Stored Procedure 'PAS_SP_UPDATE_CUSTOMER_PROFILE'
+	err := s.DB.QueryRow("CALL PAS_SP_UPDATE_CUSTOMER_PROFILE($1, $2, $3, $4, $5)", c.CustomerID, c.FirstName, c.LastName, c.CustomerPhoneNumber, c.Username).Scan(&customerID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return errUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	// The procedure returns NULL when the customer does not exist or is closed
+	if !customerID.Valid {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Closes the account of a customer, and revokes the API keys of the account
+func (s *postgresStore) CloseCustomer(customerID int, closedAt time.Time) error {
+	var closedID sql.NullInt64
+
+	// Calls the Stored Procedure 'PAS_SP_CLOSE_CUSTOMER'
+	if err := s.DB.QueryRow("CALL PAS_SP_CLOSE_CUSTOMER($1, $2)", customerID, closedAt).Scan(&closedID); err != nil {
+		return err
+	}
+
+	// The procedure returns NULL when the customer does not exist or is already closed
+	if !closedID.Valid {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Anonymizes the personal data of a customer and closes the account
+func (s *postgresStore) EraseCustomer(customerID int, erasedAt time.Time) error {
+	var erasedID sql.NullInt64
+
+	// Calls the Stored Procedure 'PAS_SP_ERASE_CUSTOMER'
+	if err := s.DB.QueryRow("CALL PAS_SP_ERASE_CUSTOMER($1, $2, $3)", customerID, erasedPhoneNumber, erasedAt).Scan(&erasedID); err != nil {
+		return err
+	}
+
+	// The procedure returns NULL when the customer does not exist
+	if !erasedID.Valid {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Changes the role of a customer given the username
+func (s *postgresStore) SetCustomerRole(username, role string) error {
+	var customerID sql.NullInt64
+
+	// Calls the Stored Procedure 'PAS_SP_UPDATE_CUSTOMER_ROLE'
+	if err := s.DB.QueryRow("CALL PAS_SP_UPDATE_CUSTOMER_ROLE($1, $2)", username, role).Scan(&customerID); err != nil {
+		return err
+	}
+
+	// The procedure returns NULL when the username does not exist
+	if !customerID.Valid {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Replaces the hashed password of a customer given the customerId
+func (s *postgresStore) SetCustomerPassword(customerID int, hashedPassword string) error {
+	var updated sql.NullInt64
+
+	// Calls the Stored Procedure 'PAS_SP_UPDATE_CUSTOMER_PASSWORD'
+	if err := s.DB.QueryRow("CALL PAS_SP_UPDATE_CUSTOMER_PASSWORD($1, $2)", customerID, hashedPassword).Scan(&updated); err != nil {
+		return err
+	}
+
+	// The procedure returns NULL when the customer does not exist
+	if !updated.Valid {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Adds a row to 'PASSWORD_RESETS' table, and marks the earlier rows of the customer as used
+func (s *postgresStore) CreatePasswordReset(p passwordReset) error {
+	_, err := s.DB.Exec(
+		"WITH superseded AS (UPDATE PASSWORD_RESETS SET usedAt = CURRENT_TIMESTAMP WHERE customerId = $2 AND usedAt IS NULL) INSERT INTO PASSWORD_RESETS (tokenHash, customerId, username, expiresAt) VALUES ($1, $2, $3, $4)",
+		p.TokenHash, p.CustomerID, p.Username, p.ExpiresAt)
+	return err
+}
+
+// Marks a password reset as used and returns it
+func (s *postgresStore) UsePasswordReset(tokenHash string) (passwordReset, error) {
+	p := passwordReset{TokenHash: tokenHash}
+	err := s.DB.QueryRow("UPDATE PASSWORD_RESETS SET usedAt = CURRENT_TIMESTAMP WHERE tokenHash = $1 AND usedAt IS NULL RETURNING customerId, username, expiresAt", tokenHash).Scan(&p.CustomerID, &p.Username, &p.ExpiresAt)
+	return p, err
+}
+
+// Takes customerPhoneNumber and the order items, and creates a new row to 'ORDERS' table
+// with a row to 'ORDER_ITEMS' table per item, and sets the orderId
+// The stored procedure runs as a single statement, so the order and its items are written atomically
+func (s *postgresStore) CreateOrder(o *order) error {
+	pizzaIDs := make([]int64, len(o.Items))
+	quantities := make([]int64, len(o.Items))
+	for i, item := range o.Items {
+		pizzaIDs[i] = int64(item.PizzaID)
+		quantities[i] = int64(item.Quantity)
+	}
+
+	// Calls the Stored Procedure and captures the order id
+	return s.DB.QueryRow("CALL PAS_SP_CREATE_ORDER($1, $2, $3, $4)", o.CustomerID, o.CustomerPhoneNumber, pq.Array(pizzaIDs), pq.Array(quantities)).Scan(&o.OrderID)
+}
+
+// Retrieves the customerId that placed an order, 0 if the order is not linked to a customer
+func (s *postgresStore) GetOrderCustomerID(orderID int) (int, error) {
+	var customerID int
+	err := s.DB.QueryRow("SELECT COALESCE(customerId, 0) FROM ORDERS WHERE orderId = $1", orderID).Scan(&customerID)
+	return customerID, err
+}
+
+// Retrieves the items of an order
+func (s *postgresStore) GetOrderItems(orderID int) ([]orderItem, error) {
+	items, err := s.getOrderItems([]int64{int64(orderID)})
+	if err != nil {
+		return nil, err
+	}
+
+	if items[orderID] == nil {
+		return []orderItem{}, nil
+	}
+	return items[orderID], nil
+}
+
+// Retrieves the items of several orders keyed by orderId
+func (s *postgresStore) getOrderItems(orderIDs []int64) (map[int][]orderItem, error) {
+	rows, err := s.DB.Query(
+		"SELECT orderId, pizzaId, quantity, unitPrice FROM ORDER_ITEMS WHERE orderId = ANY($1) ORDER BY orderItemId", pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := map[int][]orderItem{}
+	for rows.Next() {
+		var orderID int
+		var item orderItem
+		if err := rows.Scan(&orderID, &item.PizzaID, &item.Quantity, &item.UnitPrice); err != nil {
+			return nil, err
+		}
+		items[orderID] = append(items[orderID], item)
+	}
+
+	return items, rows.Err()
+}
+
+// Takes in the orderId and returns the order status from 'ORDERS' table
+func (s *postgresStore) GetOrderStatus(orderID int) (string, error) {
+	var statusName sql.NullString
+
+	// Calls the Stored Procedure 'PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER' and captures the order status
+	if err := s.DB.QueryRow("CALL PAS_SP_GET_ORDER_STATUS_BY_ORDERNUMBER($1)", orderID).Scan(&statusName); err != nil {
+		return "", err
+	}
+
+	// The procedure returns NULL when the order does not exist
+	if !statusName.Valid {
+		return "", sql.ErrNoRows
+	}
+	return statusName.String, nil
+}
+
+// Retrieves list of orders by specific phone number
+// Takes in the customerPhoneNumber and returns the list of orders by specific phone number,
+// limited to the orders placed by customerID unless it is 0
+func (s *postgresStore) GetOrders(customerPhoneNumber string, customerID int) ([]order, error) {
+	return s.queryOrders("WHERE customerPhoneNumber = $1 AND ($2 = 0 OR o.customerId = $2) AND o.isDeleted = FALSE", customerPhoneNumber, customerID)
+}
+
+// Retrieves the orders placed by a customer, oldest first
+func (s *postgresStore) GetCustomerOrders(customerID int) ([]order, error) {
+	return s.queryOrders("WHERE o.customerId = $1 AND o.isDeleted = FALSE ORDER BY o.orderTime, o.orderId", customerID)
+}
+
+// Runs a query on 'ORDERS' table and collects the resulting orders along with their items
+func (s *postgresStore) queryOrders(clause string, args ...interface{}) ([]order, error) {
+	rows, err := s.DB.Query(
+		"SELECT o.customerPhoneNumber, o.orderId, COALESCE(o.customerId, 0), o.orderTime, o.totalPrice, sc.statusName FROM ORDERS AS o INNER JOIN ORDER_STATUS_CODES AS sc ON o.statusId = sc.statusId "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'orders' list and append each resulting row to the 'orders' list
+	orders := []order{}
+	orderIDs := []int64{}
+	for rows.Next() {
+		var o order
+		if err := rows.Scan(&o.CustomerPhoneNumber, &o.OrderID, &o.CustomerID, &o.OrderTime, &o.TotalPrice, &o.OrderStatus); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+		orderIDs = append(orderIDs, int64(o.OrderID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Attach the items to each order
+	items, err := s.getOrderItems(orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		orders[i].Items = items[orders[i].OrderID]
+		if orders[i].Items == nil {
+			orders[i].Items = []orderItem{}
+		}
+	}
+
+	return orders, nil
+}
+
+// Retrieves the status history of an order, oldest change first
+func (s *postgresStore) GetOrderTimeline(orderID int) ([]statusChange, error) {
+	rows, err := s.DB.Query(
+		"SELECT h.changedAt, h.changedBy, fsc.statusName, tsc.statusName FROM ORDER_STATUS_HISTORY AS h INNER JOIN ORDER_STATUS_CODES AS fsc ON h.fromStatusId = fsc.statusId INNER JOIN ORDER_STATUS_CODES AS tsc ON h.toStatusId = tsc.statusId WHERE h.orderId = $1 ORDER BY h.changedAt, h.historyId", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'timeline' list and append each resulting row to the 'timeline' list
+	timeline := []statusChange{}
+	for rows.Next() {
+		var sc statusChange
+		if err := rows.Scan(&sc.ChangedAt, &sc.ChangedBy, &sc.PreviousStatus, &sc.NewStatus); err != nil {
+			return nil, err
+		}
+		timeline = append(timeline, sc)
+	}
+
+	return timeline, rows.Err()
+}
+
+// Retrieves the list of available pizzas
+func (s *postgresStore) GetAvailablePizzas() ([]pizza, error) {
+	rows, err := s.DB.Query(
+		"SELECT pizzaId, pizzaName, pizzaPrice FROM PIZZAS WHERE isDeleted = FALSE")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'pizzas' list and append each resulting row to the 'pizzas' list
+	pizzas := []pizza{}
+	for rows.Next() {
+		var p pizza
+		if err := rows.Scan(&p.PizzaID, &p.PizzaName, &p.PizzaPrice); err != nil {
+			return nil, err
+		}
+		pizzas = append(pizzas, p)
+	}
+
+	return pizzas, rows.Err()
+}
+
+// Retrieves the list of status code (used by the store employees)
+func (s *postgresStore) GetStatusCodes() ([]status, error) {
+	rows, err := s.DB.Query("SELECT statusId, statusName FROM ORDER_STATUS_CODES WHERE isDeleted = FALSE")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'statuses' list and append each resulting row to the 'statuses' list
+	statuses := []status{}
+	for rows.Next() {
+		var st status
+		if err := rows.Scan(&st.StatusID, &st.StatusName); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, st)
+	}
+
+	return statuses, rows.Err()
+}
+
+// Updates an OrderStatus for the specific order if it is still in status 'fromStatusID',
+// records the change in 'ORDER_STATUS_HISTORY' table, and returns the order status after the update.
+func (s *postgresStore) UpdateOrderStatus(orderID, fromStatusID, toStatusID int, changedBy string, changedByID int) (string, error) {
+	var statusName sql.NullString
+
+	// Calls the Stored Procedure 'PAS_SP_UPDATE_ORDER_STATUS'
+	if err := s.DB.QueryRow("CALL PAS_SP_UPDATE_ORDER_STATUS($1, $2, $3, $4, $5)", orderID, fromStatusID, toStatusID, changedBy, sql.NullInt64{Int64: int64(changedByID), Valid: changedByID != 0}).Scan(&statusName); err != nil {
+		return "", err
+	}
+
+	// The procedure returns NULL when the order does not exist
+	if !statusName.Valid {
+		return "", sql.ErrNoRows
+	}
+	return statusName.String, nil
+}
+
+// Creates a new row to 'AUTH_SESSIONS' table along with its first row to 'REFRESH_TOKENS' table
+func (s *postgresStore) CreateSession(session authSession, t refreshToken) error {
+	_, err := s.DB.Exec(
+		"WITH created AS (INSERT INTO AUTH_SESSIONS (sessionId, customerId, username) VALUES ($1, $2, $3) RETURNING sessionId) INSERT INTO REFRESH_TOKENS (tokenHash, sessionId, expiresAt) SELECT $4, sessionId, $5 FROM created",
+		session.SessionID, session.CustomerID, session.Username, t.TokenHash, t.ExpiresAt)
+	return err
+}
+
+// Retrieves a login session given the sessionId
+func (s *postgresStore) GetSession(sessionID string) (authSession, error) {
+	session := authSession{SessionID: sessionID}
+	err := s.DB.QueryRow("SELECT customerId, username, revokedAt IS NOT NULL FROM AUTH_SESSIONS WHERE sessionId = $1", sessionID).Scan(&session.CustomerID, &session.Username, &session.Revoked)
+	return session, err
+}
+
+// Adds a row to 'REFRESH_TOKENS' table for an existing session
+func (s *postgresStore) CreateRefreshToken(t refreshToken) error {
+	_, err := s.DB.Exec("INSERT INTO REFRESH_TOKENS (tokenHash, sessionId, expiresAt) VALUES ($1, $2, $3)", t.TokenHash, t.SessionID, t.ExpiresAt)
+	return err
+}
+
+// Marks a refresh token as used and returns it
+// The update only succeeds once per token, a token that exists but was used before revokes its whole session
+func (s *postgresStore) UseRefreshToken(tokenHash string) (refreshToken, error) {
+	t := refreshToken{TokenHash: tokenHash}
+	err := s.DB.QueryRow("UPDATE REFRESH_TOKENS SET usedAt = CURRENT_TIMESTAMP WHERE tokenHash = $1 AND usedAt IS NULL RETURNING sessionId, expiresAt", tokenHash).Scan(&t.SessionID, &t.ExpiresAt)
+	if err != sql.ErrNoRows {
+		return t, err
+	}
+
+	// Find out whether the token does not exist or was used before
+	if err := s.DB.QueryRow("SELECT sessionId FROM REFRESH_TOKENS WHERE tokenHash = $1", tokenHash).Scan(&t.SessionID); err != nil {
+		return refreshToken{}, err
+	}
+	if err := s.RevokeSession(t.SessionID); err != nil {
+		return refreshToken{}, err
+	}
+	return t, errRefreshTokenReused
+}
+
+// Revokes a login session
+func (s *postgresStore) RevokeSession(sessionID string) error {
+	var revoked string
+	return s.DB.QueryRow("UPDATE AUTH_SESSIONS SET revokedAt = COALESCE(revokedAt, CURRENT_TIMESTAMP) WHERE sessionId = $1 RETURNING sessionId", sessionID).Scan(&revoked)
+}
+
+// Revokes every login session of a customer
+func (s *postgresStore) RevokeCustomerSessions(customerID int) error {
+	_, err := s.DB.Exec("UPDATE AUTH_SESSIONS SET revokedAt = CURRENT_TIMESTAMP WHERE customerId = $1 AND revokedAt IS NULL", customerID)
+	return err
+}
+
+// Adds a row to 'DENIED_TOKENS' table, and drops the rows of the tokens that have expired
+func (s *postgresStore) DenyToken(tokenID string, expiresAt time.Time) error {
+	if _, err := s.DB.Exec("DELETE FROM DENIED_TOKENS WHERE expiresAt < CURRENT_TIMESTAMP"); err != nil {
+		return err
+	}
+
+	_, err := s.DB.Exec("INSERT INTO DENIED_TOKENS (tokenId, expiresAt) VALUES ($1, $2) ON CONFLICT (tokenId) DO NOTHING", tokenID, expiresAt)
+	return err
+}
+
+// Reports whether an access token id is on the denylist
+func (s *postgresStore) IsTokenDenied(tokenID string) (bool, error) {
+	var denied bool
+	err := s.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM DENIED_TOKENS WHERE tokenId = $1)", tokenID).Scan(&denied)
+	return denied, err
+}
+
+// Adds a row to 'ACCOUNT_LOCKOUTS' table, linked to the account holding the username, and sets the lockoutId and customerId
+func (s *postgresStore) CreateAccountLockout(l *accountLockout) error {
+	var customerID sql.NullInt64
+	err := s.DB.QueryRow(
+		"INSERT INTO ACCOUNT_LOCKOUTS (username, customerId, ipAddress, failedAttempts, lockedAt, lockedUntil) VALUES ($1, (SELECT customerId FROM CUSTOMERS WHERE username = $1), $2, $3, $4, $5) RETURNING lockoutId, customerId",
+		l.Username, l.IPAddress, l.FailedAttempts, l.LockedAt, l.LockedUntil).Scan(&l.LockoutID, &customerID)
+	l.CustomerID = int(customerID.Int64)
+	return err
+}
+
+// Retrieves the lockout of a username that is still in effect
+func (s *postgresStore) GetAccountLockout(username string) (accountLockout, error) {
+	lockouts, err := s.queryAccountLockouts(
+		"SELECT lockoutId, username, customerId, ipAddress, failedAttempts, lockedAt, lockedUntil, unlockedAt, unlockedBy FROM ACCOUNT_LOCKOUTS WHERE username = $1 AND unlockedAt IS NULL AND lockedUntil > CURRENT_TIMESTAMP ORDER BY lockedUntil DESC LIMIT 1", username)
+	if err != nil {
+		return accountLockout{}, err
+	}
+	if len(lockouts) == 0 {
+		return accountLockout{}, sql.ErrNoRows
+	}
+	return lockouts[0], nil
+}
+
+// Retrieves the lockouts of a username, most recent first
+func (s *postgresStore) GetAccountLockouts(username string) ([]accountLockout, error) {
+	return s.queryAccountLockouts(
+		"SELECT lockoutId, username, customerId, ipAddress, failedAttempts, lockedAt, lockedUntil, unlockedAt, unlockedBy FROM ACCOUNT_LOCKOUTS WHERE $1 = '' OR username = $1 ORDER BY lockedAt DESC, lockoutId DESC", username)
+}
+
+// Lifts the lockout of a username that is still in effect
+func (s *postgresStore) UnlockAccount(username, unlockedBy string) error {
+	res, err := s.DB.Exec(
+		"UPDATE ACCOUNT_LOCKOUTS SET unlockedAt = CURRENT_TIMESTAMP, unlockedBy = $2 WHERE username = $1 AND unlockedAt IS NULL AND lockedUntil > CURRENT_TIMESTAMP", username, unlockedBy)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// Adds a row to 'IDEMPOTENCY_KEYS' table unless the key is held, and drops the rows that have expired
+func (s *postgresStore) ReserveIdempotencyKey(rec idempotencyRecord) (bool, error) {
+	if _, err := s.DB.Exec("DELETE FROM IDEMPOTENCY_KEYS WHERE expiresAt <= $1", rec.CreatedAt); err != nil {
+		return false, err
+	}
+
+	res, err := s.DB.Exec(
+		"INSERT INTO IDEMPOTENCY_KEYS (scope, idempotencyKey, fingerprint, customerId, createdAt, expiresAt) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (scope, idempotencyKey) DO NOTHING",
+		rec.Scope, rec.Key, rec.Fingerprint, rec.CustomerID, rec.CreatedAt, rec.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Retrieves the row of an idempotency key that has not expired at 'now'
+func (s *postgresStore) GetIdempotencyRecord(scope, key string, now time.Time) (idempotencyRecord, error) {
+	var rec idempotencyRecord
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+
+	err := s.DB.QueryRow(
+		"SELECT scope, idempotencyKey, fingerprint, customerId, statusCode, contentType, body, createdAt, expiresAt FROM IDEMPOTENCY_KEYS WHERE scope = $1 AND idempotencyKey = $2 AND expiresAt > $3",
+		scope, key, now).Scan(&rec.Scope, &rec.Key, &rec.Fingerprint, &rec.CustomerID, &statusCode, &contentType, &rec.Body, &rec.CreatedAt, &rec.ExpiresAt)
+	rec.StatusCode = int(statusCode.Int64)
+	rec.ContentType = contentType.String
+	return rec, err
+}
+
+// Stores the response of the request holding an idempotency key
+func (s *postgresStore) CompleteIdempotencyKey(scope, key string, statusCode int, contentType string, body []byte) error {
+	var completed string
+	return s.DB.QueryRow(
+		"UPDATE IDEMPOTENCY_KEYS SET statusCode = $3, contentType = $4, body = $5 WHERE scope = $1 AND idempotencyKey = $2 RETURNING idempotencyKey",
+		scope, key, statusCode, contentType, body).Scan(&completed)
+}
+
+// Deletes the row of an idempotency key
+func (s *postgresStore) ReleaseIdempotencyKey(scope, key string) error {
+	_, err := s.DB.Exec("DELETE FROM IDEMPOTENCY_KEYS WHERE scope = $1 AND idempotencyKey = $2", scope, key)
+	return err
+}
+
+// Retrieves the current signing key and the keys retired after 'retiredAfter' from 'SIGNING_KEYS' table
+func (s *postgresStore) GetSigningKeys(retiredAfter time.Time) ([]signingKeyRecord, error) {
+	rows, err := s.DB.Query("SELECT kid, encryptedPrivateKey, createdAt, retiredAt FROM SIGNING_KEYS WHERE retiredAt IS NULL OR retiredAt > $1 ORDER BY createdAt", retiredAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []signingKeyRecord{}
+	for rows.Next() {
+		var k signingKeyRecord
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&k.KeyID, &k.EncryptedPrivateKey, &k.CreatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		k.RetiredAt = nullTime(retiredAt)
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// Makes a signing key the current one and retires the previous current key in a single transaction
+// A key that was retired before becomes current again
+// The expired keys are kept without their private key, so a key that was rotated away is still known
+func (s *postgresStore) RotateSigningKey(next signingKeyRecord, now, expiredBefore time.Time) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE SIGNING_KEYS SET encryptedPrivateKey = NULL WHERE retiredAt < $1", expiredBefore); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE SIGNING_KEYS SET retiredAt = $2 WHERE retiredAt IS NULL AND kid <> $1", next.KeyID, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO SIGNING_KEYS (kid, encryptedPrivateKey, createdAt) VALUES ($1, $2, $3) ON CONFLICT (kid) DO UPDATE SET encryptedPrivateKey = EXCLUDED.encryptedPrivateKey, retiredAt = NULL",
+		next.KeyID, next.EncryptedPrivateKey, next.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Checks whether a signing key was ever stored in 'SIGNING_KEYS' table, expired keys included
+func (s *postgresStore) SigningKeyExists(kid string) (bool, error) {
+	var exists bool
+	err := s.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM SIGNING_KEYS WHERE kid = $1)", kid).Scan(&exists)
+	return exists, err
+}
+
+// Runs a query on 'ACCOUNT_LOCKOUTS' table and collects the resulting rows
+func (s *postgresStore) queryAccountLockouts(query string, args ...interface{}) ([]accountLockout, error) {
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'lockouts' list and append each resulting row to the 'lockouts' list
+	lockouts := []accountLockout{}
+	for rows.Next() {
+		var l accountLockout
+		var customerID sql.NullInt64
+		var unlockedAt sql.NullTime
+		var unlockedBy sql.NullString
+		if err := rows.Scan(&l.LockoutID, &l.Username, &customerID, &l.IPAddress, &l.FailedAttempts, &l.LockedAt, &l.LockedUntil, &unlockedAt, &unlockedBy); err != nil {
+			return nil, err
+		}
+		l.CustomerID = int(customerID.Int64)
+		l.UnlockedAt = nullTime(unlockedAt)
+		l.UnlockedBy = unlockedBy.String
+		lockouts = append(lockouts, l)
+	}
+
+	return lockouts, rows.Err()
+}
+
+// Retrieves the two-factor authentication settings of a customer
+func (s *postgresStore) GetTwoFactor(customerID int) (twoFactor, error) {
+	tf := twoFactor{CustomerID: customerID}
+	var secret sql.NullString
+	err := s.DB.QueryRow("SELECT secret, confirmedAt IS NOT NULL, required, lastUsedStep FROM TWO_FACTOR WHERE customerId = $1", customerID).Scan(&secret, &tf.Confirmed, &tf.Required, &tf.LastUsedStep)
+	tf.Secret = secret.String
+	return tf, err
+}
+
+// Stores a new, unconfirmed, secret and the hashed recovery codes of a customer in a single transaction
+func (s *postgresStore) EnrollTwoFactor(customerID int, secret string, recoveryCodeHashes []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO TWO_FACTOR (customerId, secret) VALUES ($1, $2) ON CONFLICT (customerId) DO UPDATE SET secret = EXCLUDED.secret, confirmedAt = NULL, lastUsedStep = 0", customerID, secret); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM TWO_FACTOR_RECOVERY_CODES WHERE customerId = $1", customerID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO TWO_FACTOR_RECOVERY_CODES (codeHash, customerId) SELECT UNNEST($2::CHAR(64)[]), $1", customerID, pq.Array(recoveryCodeHashes)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Confirms the enrollment of a customer
+func (s *postgresStore) ConfirmTwoFactor(customerID int) error {
+	var confirmed int
+	return s.DB.QueryRow("UPDATE TWO_FACTOR SET confirmedAt = CURRENT_TIMESTAMP WHERE customerId = $1 AND secret IS NOT NULL RETURNING customerId", customerID).Scan(&confirmed)
+}
+
+// Removes the secret and the recovery codes of a customer
+func (s *postgresStore) DisableTwoFactor(customerID int) error {
+	if _, err := s.DB.Exec("UPDATE TWO_FACTOR SET secret = NULL, confirmedAt = NULL WHERE customerId = $1", customerID); err != nil {
+		return err
+	}
+
+	_, err := s.DB.Exec("DELETE FROM TWO_FACTOR_RECOVERY_CODES WHERE customerId = $1", customerID)
+	return err
+}
+
+// Requires, or no longer requires, a customer to use two-factor authentication
+func (s *postgresStore) SetTwoFactorRequired(customerID int, required bool) error {
+	_, err := s.DB.Exec(
+		"INSERT INTO TWO_FACTOR (customerId, required) VALUES ($1, $2) ON CONFLICT (customerId) DO UPDATE SET required = EXCLUDED.required", customerID, required)
+	return err
+}
+
+// Records the time step of a one-time password that was used, the update only succeeds for a later time step
+func (s *postgresStore) UseTwoFactorStep(customerID int, step int64) (bool, error) {
+	res, err := s.DB.Exec("UPDATE TWO_FACTOR SET lastUsedStep = $2 WHERE customerId = $1 AND lastUsedStep < $2", customerID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Marks a recovery code as used
+func (s *postgresStore) UseRecoveryCode(customerID int, codeHash string) (bool, error) {
+	res, err := s.DB.Exec("UPDATE TWO_FACTOR_RECOVERY_CODES SET usedAt = CURRENT_TIMESTAMP WHERE customerId = $1 AND codeHash = $2 AND usedAt IS NULL", customerID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Adds a row to 'API_KEYS' table
+func (s *postgresStore) CreateAPIKey(k apiKey) error {
+	_, err := s.DB.Exec(
+		"INSERT INTO API_KEYS (keyId, keyHash, name, customerId, scopes, createdBy, createdAt, expiresAt) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		k.KeyID, k.KeyHash, k.Name, k.CustomerID, pq.Array(k.Scopes), k.CreatedBy, k.CreatedAt, k.ExpiresAt)
+	return err
+}
+
+// Retrieves an API key given the keyId
+func (s *postgresStore) GetAPIKey(keyID string) (apiKey, error) {
+	keys, err := s.queryAPIKeys("WHERE k.keyId = $1", keyID)
+	if err != nil {
+		return apiKey{}, err
+	}
+	if len(keys) == 0 {
+		return apiKey{}, sql.ErrNoRows
+	}
+	return keys[0], nil
+}
+
+// Retrieves the list of API keys, most recent first
+func (s *postgresStore) GetAPIKeys() ([]apiKey, error) {
+	return s.queryAPIKeys("ORDER BY k.createdAt DESC")
+}
+
+// Revokes an API key
+func (s *postgresStore) RevokeAPIKey(keyID string, revokedAt time.Time) error {
+	var revoked string
+	return s.DB.QueryRow("UPDATE API_KEYS SET revokedAt = COALESCE(revokedAt, $2) WHERE keyId = $1 RETURNING keyId", keyID, revokedAt).Scan(&revoked)
+}
+
+// Records when an API key was last used
+// The row is written at most once a minute per key, so busy keys do not write on every request
+func (s *postgresStore) TouchAPIKey(keyID string, usedAt time.Time) error {
+	_, err := s.DB.Exec(
+		"UPDATE API_KEYS SET lastUsedAt = $2 WHERE keyId = $1 AND (lastUsedAt IS NULL OR lastUsedAt < $2 - INTERVAL '1 minute')", keyID, usedAt)
+	return err
+}
+
+// Runs a query on 'API_KEYS' table, joined with the owner username, and collects the resulting rows
+func (s *postgresStore) queryAPIKeys(clause string, args ...interface{}) ([]apiKey, error) {
+	rows, err := s.DB.Query(
+		"SELECT k.keyId, k.keyHash, k.name, k.customerId, c.username, k.scopes, k.createdBy, k.createdAt, k.expiresAt, k.lastUsedAt, k.revokedAt FROM API_KEYS AS k INNER JOIN CUSTOMERS AS c ON k.customerId = c.customerId "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create a 'keys' list and append each resulting row to the 'keys' list
+	keys := []apiKey{}
+	for rows.Next() {
+		var k apiKey
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&k.KeyID, &k.KeyHash, &k.Name, &k.CustomerID, &k.Username, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		k.ExpiresAt = nullTime(expiresAt)
+		k.LastUsedAt = nullTime(lastUsedAt)
+		k.RevokedAt = nullTime(revokedAt)
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// Converts a nullable timestamp to a pointer, nil when the timestamp is NULL
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/shaj13/go-guardian/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Error returned by the store when the new username belongs to another account
+var errUsernameTaken = errors.New("Username is already taken")
+
+// Handler to retrieve the profile of the authenticated user
+func (a *App) getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	// Get customer data from DB
+	c, err := a.Store.GetCustomer(authenticatedCustomerID(r))
+	if err == nil && c.Closed {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, c)
+}
+
+// Handler to update the name, phone number, or username of the authenticated user
+// Only the fields in the request body are changed. The past orders follow the new phone number.
+// Changing the username revokes every session, the user has to obtain a new token with the new username.
+func (a *App) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var req profileRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Unknown fields (e.g. 'password' or 'role') are rejected rather than silently ignored
+	decoder.DisallowUnknownFields()
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Get the current profile from DB and apply the changes
+	user := auth.User(r)
+	c, err := a.Store.GetCustomer(authenticatedCustomerID(r))
+	if err == nil && c.Closed {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+	if req.FirstName != nil {
+		c.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		c.LastName = *req.LastName
+	}
+	if req.CustomerPhoneNumber != nil {
+		c.CustomerPhoneNumber = *req.CustomerPhoneNumber
+	}
+	if req.Username != nil {
+		c.Username = *req.Username
+	}
+
+	// Validate the updated profile
+	if err := validateCustomerProfile(&c); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Write customer data to DB
+	if err := a.Store.UpdateCustomer(c); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// Sessions and cached decisions carry the username, revoke them when it changed
+	if c.Username != user.UserName() {
+		if err := a.revokeAllSessions(r, c.CustomerID, user.UserName()); err != nil {
+			errorHandler(w, err)
+			return
+		}
+		log.Printf("User %s changed the username to %s\n", user.UserName(), c.Username)
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, c)
+}
+
+// Handler to close the account of the authenticated user given the current password
+// The account is soft-deleted: its orders are kept, its sessions and API keys are revoked,
+// and it can no longer authenticate.
+func (a *App) closeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Fetch hashed password from the DB and compare it with the current password that was received
+	user := auth.User(r)
+	creds, err := a.Store.GetCustomerCredentials(user.UserName())
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(creds.Password), []byte(req.CurrentPassword)); err != nil {
+		responseErrorHandler(w, http.StatusForbidden, "Current password does not match")
+		return
+	}
+
+	// The access token of the request is revoked along with the sessions
+	if err := a.Store.CloseCustomer(creds.CustomerID, a.Clock()); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.denyAccessToken(user); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.revokeAllSessions(r, creds.CustomerID, user.UserName()); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s closed the account\n", user.UserName())
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Account closed",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestClosedAccountCannotLogIn(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+	bearer, refresh := testSession(t, userName)
+
+	// Cache the username and password, closing the account must evict them
+	if res, b := testRequest(t, "GET", "/v1/customers/me", userName, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	// The account is only closed with the current password
+	if res, b := testRequest(t, "DELETE", "/v1/customers/me", bearer, `{"currentPassword":"Wr0ngPassword"}`); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong password, got %d %s", res.StatusCode, b)
+	}
+	body := fmt.Sprintf(`{"currentPassword":"%s"}`, testPassword)
+	if res, b := testRequest(t, "DELETE", "/v1/customers/me", bearer, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the password, got %d", status)
+	}
+	if res, b := testRequest(t, "GET", "/v1/customers/me", userName, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the cached password to be rejected, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/customers/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, got %d %s", res.StatusCode, b)
+	}
+	if res, b := refreshTestSession(t, refresh); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be revoked, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/shaj13/go-guardian/auth"
+)
+
+// Account roles, stored in 'CUSTOMERS' table and carried as the groups of the authenticated user
+const (
+	roleCustomer = "customer"
+	roleEmployee = "employee"
+	roleManager  = "manager"
+	roleAdmin    = "admin"
+)
+
+// Every known role
+var roles = []interface{}{roleCustomer, roleEmployee, roleManager, roleAdmin}
+
+// Roles allowed to call the store only endpoints
+var storeRoles = []string{roleEmployee, roleManager, roleAdmin}
+
+// Roles allowed to look into and unlock the accounts of other users
+var supportRoles = []string{roleManager, roleAdmin}
+
+// Reports whether the user holds at least one of the given roles
+func hasRole(user auth.Info, allowed ...string) bool {
+	for _, group := range user.Groups() {
+		for _, role := range allowed {
+			if group == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Runs the 'role' command: role <username> <role>
+// Used to grant the first admin role, later changes can be made through 'PUT /customer/role'
+func runRoleCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: pizza-api-service role <username> customer|employee|manager|admin")
+		os.Exit(2)
+	}
+
+	c := customer{Username: args[0], Role: args[1]}
+	if err := validateCustomerRole(c); err != nil {
+		log.Fatal(err)
+	}
+
+	db := openDB()
+	defer db.Close()
+
+	if err := newPostgresStore(db).SetCustomerRole(c.Username, c.Role); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("User %s is now %s\n", c.Username, c.Role)
+}
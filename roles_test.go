@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStoreRoutesRequireAStoreRole(t *testing.T) {
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+
+	if res, b := testRequest(t, "GET", "/v1/orders?customerPhoneNumber=8125984475", employee, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for an employee, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "PUT", "/customer/role", employee, `{"username":"nobody","role":"admin"}`); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for an employee on an admin route, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/customer/lockouts", customer, ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer, got %d %s", res.StatusCode, b)
+	}
+}
+
+// A demoted account must lose its old role right away, not when its token or cached credentials expire
+func TestRoleChangeRevokesTheSessions(t *testing.T) {
+	admin := testToken(t, newTestCustomer(t, roleAdmin))
+	userName := newTestCustomer(t, roleEmployee)
+	bearer := testToken(t, userName)
+
+	// Cache the basic authentication of the employee
+	if res, b := testRequest(t, "GET", "/customer/lockouts", userName, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for an employee, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", userName, ""); res.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("expected the employee to reach the kitchen feed, got %d %s", res.StatusCode, b)
+	}
+
+	body := fmt.Sprintf(`{"username":"%s","role":"%s"}`, userName, roleCustomer)
+	if res, b := testRequest(t, "PUT", "/customer/role", admin, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token issued with the old role to be revoked, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", userName, ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the cached credentials to carry the new role, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", testToken(t, userName), ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a new token to carry the new role, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sender delivers notifications to customers (e.g. password reset tokens).
+// The log and file implementations let the application run without a mail or SMS service.
+type Sender interface {
+	// Delivers a notification to a customer
+	Send(n notification) error
+}
+
+// Create a struct that holds a notification to a customer
+type notification struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Create the sender named by NOTIFICATION_SENDER: 'log' (default) or 'file'
+// The file sender appends to NOTIFICATION_FILE (default 'notifications.log')
+func newSender() Sender {
+	switch getEnv("NOTIFICATION_SENDER", "log") {
+	case "file":
+		return &fileSender{Path: getEnv("NOTIFICATION_FILE", "notifications.log")}
+	case "log":
+		return logSender{}
+	default:
+		log.Fatalf("Unknown NOTIFICATION_SENDER: %s", os.Getenv("NOTIFICATION_SENDER"))
+		return nil
+	}
+}
+
+// Sender that writes the notifications to the application log
+type logSender struct{}
+
+// Writes the notification to the application log
+func (logSender) Send(n notification) error {
+	log.Printf("Notification to %s: %s\n%s\n", n.To, n.Subject, n.Body)
+	return nil
+}
+
+// Sender that appends the notifications to a file, one JSON object per line
+type fileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Appends the notification to the file
+func (s *fileSender) Send(n notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
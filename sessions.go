@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shaj13/go-guardian/auth"
+	"github.com/shaj13/go-guardian/auth/strategies/bearer"
+)
+
+// Lifetime of a refresh token, every refresh issues a new refresh token with a new lifetime
+const refreshTokenLifetime = time.Hour * 24 * 30
+
+// Error returned when a refresh token that was already used is presented again
+var errRefreshTokenReused = errors.New("Refresh token has already been used")
+
+// Create a struct that holds the body of a refresh request
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Generates a random refresh token for a session
+// Returns the token handed to the client and the row to store, which only holds the hash of the token
+func newRefreshToken(sessionID string) (string, refreshToken, error) {
+	token, err := newSecretToken()
+	if err != nil {
+		return "", refreshToken{}, err
+	}
+
+	return token, refreshToken{
+		TokenHash: hashSecretToken(token),
+		SessionID: sessionID,
+		ExpiresAt: time.Now().Add(refreshTokenLifetime),
+	}, nil
+}
+
+// Generates a random opaque token (refresh and password reset tokens)
+func newSecretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Hashes an opaque token using SHA-256, only the hash is stored
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Handler to obtain a new access token given a refresh token
+// The refresh token is rotated, the response carries a new refresh token and the old one can no longer be used.
+// Presenting a refresh token that was already used revokes the whole session, since the token has likely been stolen.
+func (a *App) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil || req.RefreshToken == "" {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	// Mark the refresh token as used
+	t, err := a.Store.UseRefreshToken(hashSecretToken(req.RefreshToken))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusUnauthorized, "Invalid refresh token")
+		case errRefreshTokenReused:
+			log.Printf("Refresh token of session %s reused, the session has been revoked\n", t.SessionID)
+			if err := a.evictCached(r, func(info auth.Info) bool { return userExtension(info, "sid") == t.SessionID }); err != nil {
+				log.Println(err)
+			}
+			responseErrorHandler(w, http.StatusUnauthorized, err.Error())
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+	if time.Now().After(t.ExpiresAt) {
+		responseErrorHandler(w, http.StatusUnauthorized, "Refresh token has expired")
+		return
+	}
+
+	// The session must still be active
+	session, err := a.Store.GetSession(t.SessionID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if session.Revoked {
+		responseErrorHandler(w, http.StatusUnauthorized, "Session has been revoked")
+		return
+	}
+
+	// Fetch the current role, it may have changed since the session started
+	creds, err := a.Store.GetCustomerCredentials(session.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			responseErrorHandler(w, http.StatusUnauthorized, "Invalid refresh token")
+			return
+		}
+		errorHandler(w, err)
+		return
+	}
+
+	// Write the next refresh token of the session to DB
+	refresh, next, err := newRefreshToken(session.SessionID)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.Store.CreateRefreshToken(next); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	issueTokens(w, session, []string{creds.Role}, refresh)
+}
+
+// Handler to log out
+// Revokes the session of the access token, and revokes the access token itself right away.
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	user := auth.User(r)
+
+	// Revoke the session, its refresh tokens can no longer be used
+	if sessionID := userExtension(user, "sid"); sessionID != "" {
+		if err := a.Store.RevokeSession(sessionID); err != nil && err != sql.ErrNoRows {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	// Revoke the access token, and evict it from the authentication cache
+	if err := a.denyAccessToken(user); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if token, err := bearer.Token(r); err == nil {
+		cache.Delete(token, r)
+	}
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Logged out",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to revoke every session of the authenticated user
+// Every refresh token of the user is revoked, as well as the access tokens issued for those sessions.
+func (a *App) revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := auth.User(r)
+	customerID := authenticatedCustomerID(r)
+	if customerID == 0 {
+		responseErrorHandler(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	// Revoke the access token of the request, and every session of the user
+	if err := a.denyAccessToken(user); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.revokeAllSessions(r, customerID, user.UserName()); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s revoked all sessions\n", user.UserName())
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "All sessions have been revoked",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Revokes every session of a customer, and evicts every cached authentication decision of the user
+// The cached access tokens are added to the denylist as well
+func (a *App) revokeAllSessions(r *http.Request, customerID int, userName string) error {
+	if err := a.Store.RevokeCustomerSessions(customerID); err != nil {
+		return err
+	}
+
+	return a.evictCached(r, func(info auth.Info) bool { return info.UserName() == userName })
+}
+
+// Checks that an access token is not on the denylist, and that its session has not been revoked
+func (a *App) checkTokenRevocation(claims *tokenClaims) error {
+	denied, err := a.Store.IsTokenDenied(claims.Id)
+	if err != nil {
+		return err
+	}
+	if denied {
+		return fmt.Errorf("Token has been revoked")
+	}
+
+	if claims.SessionID == "" {
+		return nil
+	}
+	session, err := a.Store.GetSession(claims.SessionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Unknown session: %v", claims.SessionID)
+		}
+		return err
+	}
+	if session.Revoked {
+		return fmt.Errorf("Session has been revoked")
+	}
+
+	return nil
+}
+
+// Adds the access token of an authenticated user to the denylist until the token expires
+// Users authenticated with a username and password carry no token, and nothing is denied
+func (a *App) denyAccessToken(user auth.Info) error {
+	tokenID := userExtension(user, "jti")
+	if tokenID == "" {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(tokenLifetime)
+	if exp, err := strconv.ParseInt(userExtension(user, "exp"), 10, 64); err == nil {
+		expiresAt = time.Unix(exp, 0)
+	}
+	return a.Store.DenyToken(tokenID, expiresAt)
+}
+
+// Evicts the authentication decisions that match from the go-guardian cache
+// The cached access tokens are added to the denylist, so they are rejected when they are verified again
+func (a *App) evictCached(r *http.Request, match func(auth.Info) bool) error {
+	for _, key := range cache.Keys() {
+		v, ok, err := cache.Load(key, r)
+		if err != nil || !ok {
+			continue
+		}
+		info, ok := v.(auth.Info)
+		if !ok || !match(info) {
+			continue
+		}
+
+		if err := a.denyAccessToken(info); err != nil {
+			return err
+		}
+		cache.Delete(key, r)
+	}
+
+	return nil
+}
+
+// Returns the first value of an extension of the authenticated user, empty if it is not set
+func userExtension(user auth.Info, key string) string {
+	if user == nil {
+		return ""
+	}
+	if values := user.Extensions()[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
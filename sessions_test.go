@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/shaj13/go-guardian/auth"
+)
+
+// Starts a login session and returns its access token ("Bearer ...") and refresh token
+func testSession(t *testing.T, userName string) (string, string) {
+	t.Helper()
+
+	res, b := testRequest(t, "POST", "/auth/token", userName, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("token of %s: %d %s", userName, res.StatusCode, b)
+	}
+	return decodeTestTokens(t, b)
+}
+
+// Decodes the access token and the refresh token of a token response
+func decodeTestTokens(t *testing.T, b []byte) (string, string) {
+	t.Helper()
+
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	decodeTestJSON(t, b, &payload)
+	if payload.AccessToken == "" || payload.RefreshToken == "" {
+		t.Fatalf("expected an access and a refresh token, got %s", b)
+	}
+	return "Bearer " + payload.AccessToken, payload.RefreshToken
+}
+
+// Sends a refresh token and returns the response
+func refreshTestSession(t *testing.T, refresh string) (*http.Response, []byte) {
+	t.Helper()
+
+	return testRequest(t, "POST", "/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, refresh))
+}
+
+// Returns the token id (jti) of an access token
+func testTokenID(t *testing.T, bearer string) string {
+	t.Helper()
+
+	claims := &tokenClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(bearer, "Bearer "), claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims.Id
+}
+
+// Checks whether the authentication cache holds a decision about the user
+func cachedTestUser(t *testing.T, userName string) bool {
+	t.Helper()
+
+	for _, key := range cache.Keys() {
+		v, ok, err := cache.Load(key, nil)
+		if err != nil || !ok {
+			continue
+		}
+		if info, ok := v.(auth.Info); ok && info.UserName() == userName {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRotatedRefreshTokenCannotBeReused(t *testing.T) {
+	userName := newTestCustomer(t, roleCustomer)
+	first, refresh := testSession(t, userName)
+
+	res, b := refreshTestSession(t, refresh)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	second, next := decodeTestTokens(t, b)
+	if next == refresh {
+		t.Fatal("expected the refresh token to be rotated")
+	}
+	if res, b := testRequest(t, "GET", "/customer/me", second, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the new access token to work, got %d %s", res.StatusCode, b)
+	}
+
+	// Reusing the rotated token revokes the whole session
+	if res, b := refreshTestSession(t, refresh); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a reused refresh token, got %d %s", res.StatusCode, b)
+	}
+	if res, b := refreshTestSession(t, next); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the latest refresh token to be revoked, got %d %s", res.StatusCode, b)
+	}
+	for _, bearer := range []string{first, second} {
+		if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the access tokens of the session to be revoked, got %d %s", res.StatusCode, b)
+		}
+	}
+
+	// Another session of the same user is left alone
+	other, _ := testSession(t, userName)
+	if res, b := testRequest(t, "GET", "/customer/me", other, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("expected another session to keep working, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestLogoutDeniesTheAccessToken(t *testing.T) {
+	userName := newTestCustomer(t, roleCustomer)
+	bearer, refresh := testSession(t, userName)
+	other, otherRefresh := testSession(t, userName)
+
+	// The token is cached by the first request, logging out must evict it
+	if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "POST", "/auth/logout", bearer, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+
+	if denied, err := testApp.Store.IsTokenDenied(testTokenID(t, bearer)); err != nil || !denied {
+		t.Errorf("expected the jti to be denied, got %v %v", denied, err)
+	}
+	if res, b := testRequest(t, "GET", "/customer/me", bearer, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, got %d %s", res.StatusCode, b)
+	}
+	if res, b := refreshTestSession(t, refresh); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be revoked, got %d %s", res.StatusCode, b)
+	}
+
+	// The other session of the user is left alone
+	if res, b := testRequest(t, "GET", "/customer/me", other, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("expected another session to keep working, got %d %s", res.StatusCode, b)
+	}
+	if res, b := refreshTestSession(t, otherRefresh); res.StatusCode != http.StatusOK {
+		t.Errorf("expected the refresh token of another session to work, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestRevokeAllSessionsEvictsCachedCredentials(t *testing.T) {
+	resetLoginAttempts(t)
+	userName := newTestCustomer(t, roleCustomer)
+	bearer, refresh := testSession(t, userName)
+	other, otherRefresh := testSession(t, userName)
+
+	// Cache the username and password, and both access tokens
+	for _, auth := range []string{userName, bearer, other} {
+		if res, b := testRequest(t, "GET", "/customer/me", auth, ""); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+		}
+	}
+	if !cachedTestUser(t, userName) {
+		t.Fatal("expected the user to be cached")
+	}
+
+	if res, b := testRequest(t, "POST", "/auth/sessions/revoke", bearer, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if cachedTestUser(t, userName) {
+		t.Error("expected every cached decision about the user to be evicted")
+	}
+
+	for _, token := range []string{bearer, other} {
+		if denied, err := testApp.Store.IsTokenDenied(testTokenID(t, token)); err != nil || !denied {
+			t.Errorf("expected the cached access token to be denied, got %v %v", denied, err)
+		}
+		if res, b := testRequest(t, "GET", "/customer/me", token, ""); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the access token to be revoked, got %d %s", res.StatusCode, b)
+		}
+	}
+	for _, token := range []string{refresh, otherRefresh} {
+		if res, b := refreshTestSession(t, token); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the refresh token to be revoked, got %d %s", res.StatusCode, b)
+		}
+	}
+
+	// The password is checked again, and starts a new session
+	if res, b := testRequest(t, "GET", "/customer/me", userName, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("expected the password to be checked again, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"time"
+)
+
+// Store is the persistence layer the App depends on.
+// The Postgres implementation calls the 'PAS_SP_*' stored procedures, and the in-memory
+// implementation mirrors the same semantics so the handlers can run without a database.
+type Store interface {
+	// Creates a new customer with the hashed password and sets the customerId, returns errUsernameTaken when the username is in use
+	CreateCustomer(c *customer, hashedPassword string) error
+
+	// Retrieves the customerId, hashed password, and role given the username
+	GetCustomerCredentials(username string) (credentials, error)
+
+	// Changes the role of a customer given the username
+	SetCustomerRole(username, role string) error
+
+	// Retrieves the profile of a customer given the customerId, closed accounts are flagged with 'Closed'
+	GetCustomer(customerID int) (customer, error)
+
+	// Updates the name, phone number, and username of a customer, returns errUsernameTaken when the username is in use
+	UpdateCustomer(c customer) error
+
+	// Closes the account of a customer, closed accounts can no longer authenticate
+	CloseCustomer(customerID int, closedAt time.Time) error
+
+	// Anonymizes the personal data of a customer and closes the account, the orders are kept without personal data
+	EraseCustomer(customerID int, erasedAt time.Time) error
+
+	// Replaces the hashed password of a customer given the customerId
+	SetCustomerPassword(customerID int, hashedPassword string) error
+
+	// Records a password reset, the earlier password resets of the customer that were not used can no longer be used
+	CreatePasswordReset(p passwordReset) error
+
+	// Marks a password reset as used and returns it, a password reset can only be used once
+	UsePasswordReset(tokenHash string) (passwordReset, error)
+
+	// Retrieves the two-factor authentication settings of a customer
+	GetTwoFactor(customerID int) (twoFactor, error)
+
+	// Stores a new, unconfirmed, secret and the hashed recovery codes of a customer, replacing the earlier ones
+	EnrollTwoFactor(customerID int, secret string, recoveryCodeHashes []string) error
+
+	// Confirms the enrollment of a customer once a first one-time password was checked
+	ConfirmTwoFactor(customerID int) error
+
+	// Removes the secret and the recovery codes of a customer
+	DisableTwoFactor(customerID int) error
+
+	// Requires, or no longer requires, a customer to use two-factor authentication
+	SetTwoFactorRequired(customerID int, required bool) error
+
+	// Records the time step of a one-time password that was used
+	// Reports false when a code of this time step, or a later one, was already used
+	UseTwoFactorStep(customerID int, step int64) (bool, error)
+
+	// Marks a recovery code as used, reports false when the code does not exist or was already used
+	UseRecoveryCode(customerID int, codeHash string) (bool, error)
+
+	// Creates a new API key
+	CreateAPIKey(k apiKey) error
+
+	// Retrieves an API key given the keyId
+	GetAPIKey(keyID string) (apiKey, error)
+
+	// Retrieves the list of API keys, most recent first
+	GetAPIKeys() ([]apiKey, error)
+
+	// Revokes an API key
+	RevokeAPIKey(keyID string, revokedAt time.Time) error
+
+	// Records when an API key was last used
+	TouchAPIKey(keyID string, usedAt time.Time) error
+
+	// Creates a new order with its items for the customer 'o.CustomerID' and sets the orderId
+	// An item of a pizza that is not available fails the order (errPizzaNotAvailable, or a foreign key violation in Postgres)
+	CreateOrder(o *order) error
+
+	// Retrieves the customerId that placed an order, 0 if the order is not linked to a customer
+	GetOrderCustomerID(orderID int) (int, error)
+
+	// Retrieves the items of an order
+	GetOrderItems(orderID int) ([]orderItem, error)
+
+	// Retrieves the order status name given the orderId
+	GetOrderStatus(orderID int) (string, error)
+
+	// Retrieves the list of orders, including their items, by specific phone number
+	// Only orders placed by 'customerID' are returned, unless 'customerID' is 0
+	GetOrders(customerPhoneNumber string, customerID int) ([]order, error)
+
+	// Retrieves the list of orders, including their items, placed by a customer, oldest first
+	GetCustomerOrders(customerID int) ([]order, error)
+
+	// Retrieves the list of available pizzas
+	GetAvailablePizzas() ([]pizza, error)
+
+	// Retrieves the list of status codes
+	GetStatusCodes() ([]status, error)
+
+	// Updates the order status if the order is still in status 'fromStatusID',
+	// records the change made by 'changedBy' (customer 'changedByID') in the status history,
+	// and returns the order status name after the update
+	UpdateOrderStatus(orderID, fromStatusID, toStatusID int, changedBy string, changedByID int) (string, error)
+
+	// Retrieves the status history of an order, oldest change first
+	GetOrderTimeline(orderID int) ([]statusChange, error)
+
+	// Creates a new login session along with its first refresh token
+	CreateSession(s authSession, t refreshToken) error
+
+	// Retrieves a login session given the sessionId
+	GetSession(sessionID string) (authSession, error)
+
+	// Adds a refresh token to an existing session
+	CreateRefreshToken(t refreshToken) error
+
+	// Marks a refresh token as used and returns it, a refresh token can only be used once
+	// Using a refresh token again revokes its whole session and returns 'errRefreshTokenReused' along with the token
+	UseRefreshToken(tokenHash string) (refreshToken, error)
+
+	// Revokes a login session, its refresh tokens can no longer be used
+	RevokeSession(sessionID string) error
+
+	// Revokes every login session of a customer
+	RevokeCustomerSessions(customerID int) error
+
+	// Adds an access token id (jti) to the denylist until the token expires
+	DenyToken(tokenID string, expiresAt time.Time) error
+
+	// Reports whether an access token id (jti) is on the denylist
+	IsTokenDenied(tokenID string) (bool, error)
+
+	// Records an account lockout and sets the lockoutId
+	CreateAccountLockout(l *accountLockout) error
+
+	// Retrieves the lockout of a username that is still in effect
+	GetAccountLockout(username string) (accountLockout, error)
+
+	// Retrieves the lockouts of a username, most recent first
+	// The lockouts of every username are returned, unless 'username' is empty
+	GetAccountLockouts(username string) ([]accountLockout, error)
+
+	// Lifts the lockout of a username that is still in effect, recording who unlocked it
+	UnlockAccount(username, unlockedBy string) error
+
+	// Reserves an idempotency key for a request in progress, and drops the records that have expired
+	// Returns false when the key is held by a record that has not expired
+	ReserveIdempotencyKey(rec idempotencyRecord) (bool, error)
+
+	// Retrieves the record of an idempotency key that has not expired at 'now'
+	GetIdempotencyRecord(scope, key string, now time.Time) (idempotencyRecord, error)
+
+	// Stores the response of the request holding an idempotency key, so it can be replayed
+	CompleteIdempotencyKey(scope, key string, statusCode int, contentType string, body []byte) error
+
+	// Releases an idempotency key, so the request can be retried (e.g. after a server error)
+	ReleaseIdempotencyKey(scope, key string) error
+
+	// Retrieves the current token signing key and the keys retired after 'retiredAfter'
+	GetSigningKeys(retiredAfter time.Time) ([]signingKeyRecord, error)
+
+	// Makes a signing key the current one and retires the previous current key at 'now' in a single transaction
+	// The private keys of the keys retired before 'expiredBefore' are erased, their key ids are kept
+	RotateSigningKey(next signingKeyRecord, now, expiredBefore time.Time) error
+
+	// Checks whether a signing key was ever stored, expired keys included
+	SigningKeyExists(kid string) (bool, error)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of the time-based one-time passwords (RFC 6238), the defaults of the authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+// Number of time steps before and after the current one that are accepted, to allow for clock drift
+const totpSkew = 1
+
+// Number of recovery codes issued on enrollment
+const recoveryCodeCount = 10
+
+// Setup global issuer shown by the authenticator apps
+var totpIssuer = getEnv("TOTP_ISSUER", "pizza-api-service")
+
+// Secrets are base32 encoded without padding, as expected by the authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Clock returns the current time
+// The one-time passwords are checked against the clock of the App, so they can be checked at a given time
+type Clock func() time.Time
+
+// Generates a random 160 bits secret (RFC 4226 recommends the length of the HMAC-SHA1 output)
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// Computes the one-time password of a time step (RFC 4226 HOTP with the time step as the counter)
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// Checks a one-time password against the time steps around 'now'
+// Returns the time step the code belongs to, so a code can be rejected when it is used again
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Builds the URI the authenticator apps read from a QR code
+// (https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+func totpProvisioningURI(userName, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer) + ":" + url.PathEscape(userName)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Generates the recovery codes, each can be used once instead of a one-time password
+// Returns the codes handed to the user and their hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// Hashes a recovery code using SHA-256, ignoring the case and the dash
+func hashRecoveryCode(code string) string {
+	return hashSecretToken(strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1)))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// Stops the clock of the test application at 'now' until the end of the test
+func setTestClock(t *testing.T, now time.Time) {
+	previous := testApp.Clock
+	testApp.Clock = func() time.Time { return now }
+	t.Cleanup(func() { testApp.Clock = previous })
+}
+
+// Returns the one-time password of the time step 'offset' steps away from 'now'
+func testTOTPCode(t *testing.T, secret string, now time.Time, offset int64) string {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, now.Unix()/totpPeriod+offset)
+}
+
+// Test vectors of RFC 6238 appendix B (SHA1), the last six digits of the eight-digit codes
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		now := time.Unix(v.unix, 0)
+		if code := testTOTPCode(t, rfc6238Secret, now, 0); code != v.code {
+			t.Errorf("T=%d: expected %s, got %s", v.unix, v.code, code)
+		}
+		step, ok := verifyTOTP(rfc6238Secret, v.code, now)
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("T=%d: expected the code to verify for step %d, got %d %v", v.unix, v.unix/totpPeriod, step, ok)
+		}
+	}
+}
+
+func TestVerifyTOTPAcceptsOneStepOfClockDrift(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-2); offset <= 2; offset++ {
+		code := testTOTPCode(t, rfc6238Secret, now, offset)
+		step, ok := verifyTOTP(rfc6238Secret, code, now)
+
+		accepted := offset >= -totpSkew && offset <= totpSkew
+		if ok != accepted {
+			t.Errorf("offset %d: expected accepted=%v, got %v", offset, accepted, ok)
+		}
+		if ok && step != current+offset {
+			t.Errorf("offset %d: expected step %d, got %d", offset, current+offset, step)
+		}
+	}
+
+	// A code of the wrong length, or a secret that is not base32, never verifies
+	if _, ok := verifyTOTP(rfc6238Secret, "28708", time.Unix(59, 0)); ok {
+		t.Error("expected a five-digit code to be rejected")
+	}
+	if _, ok := verifyTOTP("not base32!", "287082", time.Unix(59, 0)); ok {
+		t.Error("expected an invalid secret to be rejected")
+	}
+}
+
+func TestTwoFactorStepCannotBeReplayed(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	setTestClock(t, now)
+
+	customerID := 9001
+	if err := testApp.Store.EnrollTwoFactor(customerID, rfc6238Secret, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf := twoFactor{CustomerID: customerID, Secret: rfc6238Secret, Confirmed: true}
+
+	code := testTOTPCode(t, rfc6238Secret, now, 0)
+	if ok, err := testApp.verifySecondFactor(tf, code); err != nil || !ok {
+		t.Fatalf("expected the code to be accepted, got %v %v", ok, err)
+	}
+	if ok, err := testApp.verifySecondFactor(tf, code); err != nil || ok {
+		t.Fatalf("expected the code to be rejected when used again, got %v %v", ok, err)
+	}
+
+	// The code of an earlier step is rejected too, once a later step was used
+	previous := testTOTPCode(t, rfc6238Secret, now, -1)
+	if ok, err := testApp.verifySecondFactor(tf, previous); err != nil || ok {
+		t.Fatalf("expected the code of an earlier step to be rejected, got %v %v", ok, err)
+	}
+
+	next := testTOTPCode(t, rfc6238Secret, now, 1)
+	if ok, err := testApp.verifySecondFactor(tf, next); err != nil || !ok {
+		t.Fatalf("expected the code of the next step to be accepted, got %v %v", ok, err)
+	}
+}
+
+func TestRecoveryCodeIsSingleUse(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	customerID := 9002
+	if err := testApp.Store.EnrollTwoFactor(customerID, rfc6238Secret, hashes); err != nil {
+		t.Fatal(err)
+	}
+	tf := twoFactor{CustomerID: customerID, Secret: rfc6238Secret, Confirmed: true}
+
+	// The case and the dash of a recovery code are ignored
+	if ok, err := testApp.verifySecondFactor(tf, strings.ToUpper(strings.Replace(codes[0], "-", "", 1))); err != nil || !ok {
+		t.Fatalf("expected the recovery code to be accepted, got %v %v", ok, err)
+	}
+	if ok, err := testApp.verifySecondFactor(tf, codes[0]); err != nil || ok {
+		t.Fatalf("expected the recovery code to be rejected when used again, got %v %v", ok, err)
+	}
+	if ok, err := testApp.verifySecondFactor(tf, codes[1]); err != nil || !ok {
+		t.Fatalf("expected another recovery code to be accepted, got %v %v", ok, err)
+	}
+	if ok, err := testApp.verifySecondFactor(tf, "zzzz-zzzz"); err != nil || ok {
+		t.Fatalf("expected an unknown recovery code to be rejected, got %v %v", ok, err)
+	}
+}
+
+// Enrolls an account in two-factor authentication through the API and returns the secret
+func enrollTestTwoFactor(t *testing.T, userName string, now time.Time) string {
+	t.Helper()
+
+	res, b := testRequest(t, "POST", "/customer/totp/enroll", userName, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("enroll: %d %s", res.StatusCode, b)
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	decodeTestJSON(t, b, &enrollment)
+
+	body := fmt.Sprintf(`{"code":"%s"}`, testTOTPCode(t, enrollment.Secret, now, 0))
+	if res, b := testRequest(t, "POST", "/customer/totp/confirm", userName, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: %d %s", res.StatusCode, b)
+	}
+	return enrollment.Secret
+}
+
+func TestTokenRequiresAnUnusedTwoFactorCode(t *testing.T) {
+	t.Cleanup(func() { loginAttempts = newLoginThrottle() })
+	now := time.Unix(1700000000, 0)
+	setTestClock(t, now)
+
+	userName := newTestCustomer(t, roleCustomer)
+	secret := enrollTestTwoFactor(t, userName, now)
+
+	if res, b := testRequest(t, "POST", "/auth/token", userName, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a code, got %d %s", res.StatusCode, b)
+	}
+
+	// The code used to confirm the enrollment cannot obtain a token
+	code := testTOTPCode(t, secret, now, 0)
+	if res, b := testRequest(t, "POST", "/auth/token", userName, "", twoFactorHeader, code); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a used code, got %d %s", res.StatusCode, b)
+	}
+
+	// The code of the next time step does
+	now = now.Add(time.Second * totpPeriod)
+	setTestClock(t, now)
+	code = testTOTPCode(t, secret, now, 0)
+	if res, b := testRequest(t, "POST", "/auth/token", userName, "", twoFactorHeader, code); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a new code, got %d %s", res.StatusCode, b)
+	}
+}
+
+// The correct password sent along with each wrong code must not clear the wrong codes
+func TestWrongTwoFactorCodesAreThrottled(t *testing.T) {
+	t.Cleanup(func() { loginAttempts = newLoginThrottle() })
+	now := time.Unix(1700000000, 0)
+	setTestClock(t, now)
+
+	userName := newTestCustomer(t, roleCustomer)
+	enrollTestTwoFactor(t, userName, now)
+
+	for i := 0; i < userBackoffThreshold; i++ {
+		if res, b := testRequest(t, "POST", "/auth/token", userName, "", twoFactorHeader, "000000"); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d %s", i+1, res.StatusCode, b)
+		}
+	}
+
+	res, b := testRequest(t, "POST", "/auth/token", userName, "", twoFactorHeader, "000000")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after %d wrong codes, got %d %s", userBackoffThreshold, res.StatusCode, b)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// The wrong codes are counted until a code is accepted
+	loginAttempts.PasswordSucceeded(userName)
+	if failures := loginAttempts.FailSecondFactor(userName, "192.0.2.1"); failures != userBackoffThreshold+1 {
+		t.Errorf("expected %d wrong codes, got %d", userBackoffThreshold+1, failures)
+	}
+	loginAttempts.Reset(userName)
+	if failures := loginAttempts.FailSecondFactor(userName, "192.0.2.1"); failures != 1 {
+		t.Errorf("expected the wrong codes to be forgotten after a complete login, got %d", failures)
+	}
+}
+
+// Guessing the code that confirms an enrollment is slowed down like guessing the code that obtains a token
+func TestWrongConfirmationCodesAreThrottled(t *testing.T) {
+	resetLoginAttempts(t)
+	now := time.Unix(1700000000, 0)
+	setTestClock(t, now)
+
+	userName := newTestCustomer(t, roleCustomer)
+	bearer := testToken(t, userName)
+	res, b := testRequest(t, "POST", "/customer/totp/enroll", userName, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("enroll: %d %s", res.StatusCode, b)
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	decodeTestJSON(t, b, &enrollment)
+
+	for i := 0; i < userBackoffThreshold; i++ {
+		if res, b := testRequest(t, "POST", "/customer/totp/confirm", bearer, `{"code":"000000"}`); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("attempt %d: expected 400, got %d %s", i+1, res.StatusCode, b)
+		}
+	}
+
+	// The correct code is delayed as well, with a bearer token and with the password
+	body := fmt.Sprintf(`{"code":"%s"}`, testTOTPCode(t, enrollment.Secret, now, 0))
+	for _, auth := range []string{bearer, userName} {
+		res, b := testRequest(t, "POST", "/customer/totp/confirm", auth, body)
+		if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+			t.Fatalf("expected 429 with Retry-After after %d wrong codes, got %d %s", userBackoffThreshold, res.StatusCode, b)
+		}
+	}
+	if failures := loginAttempts.FailSecondFactor(userName, "192.0.2.1"); failures != userBackoffThreshold+1 {
+		t.Errorf("expected the wrong codes to share the totp counter, got %d", failures)
+	}
+
+	// Once the delay has passed, the correct code confirms the enrollment and clears the wrong codes
+	skipLoginBackoff()
+	if res, b := testRequest(t, "POST", "/customer/totp/confirm", bearer, body); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.StatusCode, b)
+	}
+	if failures := loginAttempts.FailSecondFactor(userName, "192.0.2.1"); failures != 1 {
+		t.Errorf("expected the wrong codes to be forgotten, got %d", failures)
+	}
+}
+
+func TestWrongConfirmationCodesLockTheAccount(t *testing.T) {
+	resetLoginAttempts(t)
+	now := time.Unix(1700000000, 0)
+	setTestClock(t, now)
+
+	userName := newTestCustomer(t, roleCustomer)
+	bearer := testToken(t, userName)
+	if res, b := testRequest(t, "POST", "/customer/totp/enroll", userName, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("enroll: %d %s", res.StatusCode, b)
+	}
+
+	for i := 0; i < lockoutThreshold; i++ {
+		skipLoginBackoff()
+		if res, b := testRequest(t, "POST", "/customer/totp/confirm", bearer, `{"code":"000000"}`); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("attempt %d: expected 400, got %d %s", i+1, res.StatusCode, b)
+		}
+	}
+
+	if _, err := testApp.Store.GetAccountLockout(userName); err != nil {
+		t.Fatalf("expected the account to be locked, got %v", err)
+	}
+	skipLoginBackoff()
+	if status := tokenStatusWithPassword(t, userName, testPassword); status != http.StatusTooManyRequests {
+		t.Errorf("expected the locked account to get 429, got %d", status)
+	}
+}
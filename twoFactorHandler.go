@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/shaj13/go-guardian/auth"
+)
+
+// Header carrying the one-time password, or a recovery code, when obtaining a token
+const twoFactorHeader = "X-TOTP-Code"
+
+// Checks the second factor of an account that uses two-factor authentication when obtaining a token
+// Returns the status code to respond with when the check fails
+func (a *App) checkTwoFactor(r *http.Request, user auth.Info, customerID int) (int, error) {
+	tf, err := a.Store.GetTwoFactor(customerID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !tf.Confirmed {
+		if tf.Required {
+			return http.StatusForbidden, fmt.Errorf("Two-factor authentication is required, enroll at 'POST /customer/totp/enroll'")
+		}
+		return 0, nil
+	}
+
+	code := strings.TrimSpace(r.Header.Get(twoFactorHeader))
+	if code == "" {
+		return http.StatusUnauthorized, fmt.Errorf("Two-factor code required in the '%s' header", twoFactorHeader)
+	}
+
+	ok, err := a.verifySecondFactor(tf, code)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ok {
+		a.failSecondFactor(r, user.UserName())
+		return http.StatusUnauthorized, fmt.Errorf("Invalid two-factor code")
+	}
+
+	loginAttempts.Reset(user.UserName())
+	return 0, nil
+}
+
+// Counts a wrong two-factor code of a username
+// Wrong codes are counted apart from the password failures, which the correct password resets,
+// so guessing codes is slowed down and locked out as well
+func (a *App) failSecondFactor(r *http.Request, userName string) {
+	ip := clientIP(r)
+	if failures := loginAttempts.FailSecondFactor(userName, ip); failures >= lockoutThreshold {
+		a.lockAccount(r, userName, ip, failures)
+	}
+}
+
+// Rejects the request with status code 429 while the username or IP address is backing off after wrong codes
+// Returns false when the request was rejected. A bearer token skips the check made by the basic strategy,
+// so the handlers that take a code check it themselves.
+func secondFactorAllowed(w http.ResponseWriter, r *http.Request, userName string) bool {
+	if delay := loginAttempts.Delay(userName, clientIP(r)); delay > 0 {
+		setRetryAfter(w, delay)
+		responseErrorHandler(w, http.StatusTooManyRequests, "Too many invalid two-factor codes, try again later")
+		return false
+	}
+	return true
+}
+
+// Checks a one-time password, or a recovery code, of a confirmed enrollment
+// A one-time password can only be used once, and so can a recovery code
+func (a *App) verifySecondFactor(tf twoFactor, code string) (bool, error) {
+	if len(code) != totpDigits {
+		return a.Store.UseRecoveryCode(tf.CustomerID, hashRecoveryCode(code))
+	}
+
+	step, ok := verifyTOTP(tf.Secret, code, a.Clock())
+	if !ok {
+		return false, nil
+	}
+	return a.Store.UseTwoFactorStep(tf.CustomerID, step)
+}
+
+// Handler to enroll the authenticated user in two-factor authentication
+// Returns the secret, the provisioning URI to show as a QR code, and the recovery codes.
+// The enrollment only takes effect once it is confirmed with a first one-time password.
+func (a *App) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := auth.User(r)
+	customerID := authenticatedCustomerID(r)
+	if customerID == 0 {
+		responseErrorHandler(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	// A confirmed enrollment must be disabled first, so the password alone cannot replace the secret
+	tf, err := a.Store.GetTwoFactor(customerID)
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	if tf.Confirmed {
+		responseErrorHandler(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Write the secret and the hashed recovery codes to DB
+	if err := a.Store.EnrollTwoFactor(customerID, secret, hashes); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(user.UserName(), secret),
+		"recoveryCodes":   codes,
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to confirm the enrollment of the authenticated user given a first one-time password
+// Every session of the user is revoked, obtaining a token requires a one-time password from now on.
+func (a *App) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	user := auth.User(r)
+	customerID := authenticatedCustomerID(r)
+	tf, err := a.Store.GetTwoFactor(customerID)
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	if tf.Secret == "" {
+		responseErrorHandler(w, http.StatusNotFound, "Two-factor authentication is not enrolled")
+		return
+	}
+	if tf.Confirmed {
+		responseErrorHandler(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if !secondFactorAllowed(w, r, user.UserName()) {
+		return
+	}
+
+	// Only a one-time password confirms the enrollment, it proves the authenticator app holds the secret
+	step, ok := verifyTOTP(tf.Secret, strings.TrimSpace(req.Code), a.Clock())
+	if ok {
+		ok, err = a.Store.UseTwoFactorStep(customerID, step)
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+	if !ok {
+		a.failSecondFactor(r, user.UserName())
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+	loginAttempts.Reset(user.UserName())
+
+	if err := a.Store.ConfirmTwoFactor(customerID); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if err := a.revokeAllSessions(r, customerID, user.UserName()); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	log.Printf("User %s enabled two-factor authentication\n", user.UserName())
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Two-factor authentication enabled, obtain a new token",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to disable two-factor authentication of the authenticated user given a one-time password or a recovery code
+// Accounts that are required to use two-factor authentication cannot disable it.
+func (a *App) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	user := auth.User(r)
+	customerID := authenticatedCustomerID(r)
+	tf, err := a.Store.GetTwoFactor(customerID)
+	if err != nil && err != sql.ErrNoRows {
+		errorHandler(w, err)
+		return
+	}
+	if tf.Required {
+		responseErrorHandler(w, http.StatusForbidden, "Two-factor authentication is required for this account")
+		return
+	}
+	if !tf.Confirmed {
+		responseErrorHandler(w, http.StatusNotFound, "Two-factor authentication is not enabled")
+		return
+	}
+	if !secondFactorAllowed(w, r, user.UserName()) {
+		return
+	}
+
+	ok, err := a.verifySecondFactor(tf, strings.TrimSpace(req.Code))
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if !ok {
+		a.failSecondFactor(r, user.UserName())
+		responseErrorHandler(w, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+	loginAttempts.Reset(user.UserName())
+
+	if err := a.Store.DisableTwoFactor(customerID); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	// The cached username and password carry the two-factor flag, evict them
+	cache.Delete(user.UserName(), r)
+	log.Printf("User %s disabled two-factor authentication\n", user.UserName())
+
+	// Create a HTTP Response payload
+	payload := map[string]string{
+		"message": "Two-factor authentication disabled",
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
+
+// Handler to require, or no longer require, an account to use two-factor authentication (Used by managers and admins)
+// Requiring it revokes every session of the account, so the account has to enroll before obtaining a new token.
+func (a *App) requireTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorRequest
+	decoder := json.NewDecoder(r.Body)
+
+	// Decode the HTTP Body Data
+	if err := decoder.Decode(&req); err != nil || req.Username == "" {
+		responseErrorHandler(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer r.Body.Close()
+
+	creds, err := a.Store.GetCustomerCredentials(req.Username)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			responseErrorHandler(w, http.StatusNotFound, "Customer not found")
+		default:
+			errorHandler(w, err)
+		}
+		return
+	}
+
+	// Update the setting in DB
+	if err := a.Store.SetTwoFactorRequired(creds.CustomerID, req.Required); err != nil {
+		errorHandler(w, err)
+		return
+	}
+	if req.Required {
+		if err := a.revokeAllSessions(r, creds.CustomerID, req.Username); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	} else {
+		cache.Delete(req.Username, r)
+	}
+	log.Printf("User %s set two-factor authentication required to %v for %s\n", authenticatedUserName(r), req.Required, req.Username)
+
+	// Create a HTTP Response payload
+	payload := map[string]interface{}{
+		"username": req.Username,
+		"required": req.Required,
+	}
+
+	// Write HTTP response
+	responseWriter(w, http.StatusOK, payload)
+}
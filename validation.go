@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"unicode"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// Validation rules shared by the request types, the lengths match the columns of the 'CUSTOMERS' table
+var (
+	// Names are made of letters, with spaces, apostrophes, dots, and dashes in between (e.g. "Mary-Jane O'Neil")
+	nameRules = []validation.Rule{
+		validation.Required,
+		validation.Length(1, 50),
+		validation.Match(regexp.MustCompile(`^[\p{L}\p{M}]+([\p{L}\p{M}' .-]*[\p{L}\p{M}.])?$`)).Error("must only contain letters, spaces, apostrophes, dots, and dashes"),
+	}
+
+	// Usernames are plain ASCII so they can be typed anywhere, email addresses are accepted
+	usernameRules = []validation.Rule{
+		validation.Required,
+		validation.Length(3, 62),
+		validation.Match(regexp.MustCompile(`^[A-Za-z0-9._@+-]+$`)).Error("must only contain letters, digits, and . _ @ + -"),
+	}
+
+	// bcrypt only uses the first 72 bytes of a password
+	passwordRules = []validation.Rule{
+		validation.Required,
+		validation.Length(8, 72),
+		validation.By(isStrongPassword),
+	}
+
+	// Phone numbers are checked in the default region, or in the international format
+	phoneNumberRules = []validation.Rule{
+		validation.Required,
+		validation.By(isPhoneNumber),
+	}
+)
+
+// Maximum quantity of a single pizza on an order item
+const maxItemQuantity = 50
+
+// A password needs at least one letter and one digit
+func isStrongPassword(value interface{}) error {
+	password, _ := value.(string)
+	if password == "" {
+		return nil
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	if !letter || !digit {
+		return errors.New("must contain at least one letter and one digit")
+	}
+	return nil
+}
+
+// Validate a new customer, the phone number is normalized to E.164 in place
+func validateSignup(c *customer) error {
+	err := validation.ValidateStruct(c,
+		validation.Field(&c.FirstName, nameRules...),
+		validation.Field(&c.LastName, nameRules...),
+		validation.Field(&c.CustomerPhoneNumber, phoneNumberRules...),
+		validation.Field(&c.Username, usernameRules...),
+		validation.Field(&c.Password, passwordRules...),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.CustomerPhoneNumber, err = normalizePhoneNumber(c.CustomerPhoneNumber, defaultPhoneRegion)
+	return err
+}
+
+// Validate the profile of a customer, the phone number is normalized to E.164 in place
+func validateCustomerProfile(c *customer) error {
+	err := validation.ValidateStruct(c,
+		validation.Field(&c.FirstName, nameRules...),
+		validation.Field(&c.LastName, nameRules...),
+		validation.Field(&c.CustomerPhoneNumber, phoneNumberRules...),
+		validation.Field(&c.Username, usernameRules...),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.CustomerPhoneNumber, err = normalizePhoneNumber(c.CustomerPhoneNumber, defaultPhoneRegion)
+	return err
+}
+
+// CustomerPhoneNumber cannot be empty, and must be a phone number of the default region or in the international format
+// A valid phone number is normalized to E.164 in place, so it is stored and looked up the same way
+func validateCustomerPhoneNumber(o *order) error {
+	err := validation.ValidateStruct(o, validation.Field(&o.CustomerPhoneNumber, phoneNumberRules...))
+	if err != nil {
+		return err
+	}
+
+	o.CustomerPhoneNumber, err = normalizePhoneNumber(o.CustomerPhoneNumber, defaultPhoneRegion)
+	return err
+}
+
+// Validate a new password
+func validatePassword(password string) error {
+	return validation.Errors{"password": validation.Validate(password, passwordRules...)}.Filter()
+}
+
+// Username is required and the role must be one of the known roles
+func validateCustomerRole(c customer) error {
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.Username, validation.Required),
+		validation.Field(&c.Role, validation.Required, validation.In(roles...)),
+	)
+}
+
+// Validate a new order: the phone number, and at least one item of an available pizza
+// The phone number is normalized to E.164 in place
+func (a *App) validateNewOrder(o *order) error {
+	err := validation.ValidateStruct(o,
+		validation.Field(&o.CustomerPhoneNumber, phoneNumberRules...),
+		validation.Field(&o.Items, validation.Required, validation.By(a.isAvailablePizza)),
+	)
+	if err != nil {
+		return err
+	}
+
+	o.CustomerPhoneNumber, err = normalizePhoneNumber(o.CustomerPhoneNumber, defaultPhoneRegion)
+	return err
+}
+
+// Checks that every order item refers to an available pizza, keyed by item index like the other item errors
+func (a *App) isAvailablePizza(value interface{}) error {
+	items, _ := value.([]orderItem)
+
+	pizzas, err := a.Store.GetAvailablePizzas()
+	if err != nil {
+		return validation.NewInternalError(err)
+	}
+	available := map[int]bool{}
+	for _, p := range pizzas {
+		available[p.PizzaID] = true
+	}
+
+	errs := validation.Errors{}
+	for i, item := range items {
+		if item.PizzaID != 0 && !available[item.PizzaID] {
+			errs[strconv.Itoa(i)] = validation.Errors{"pizzaId": errors.New("must be an available pizza")}
+		}
+	}
+	return errs.Filter()
+}
+
+// Each order item needs a pizzaId and a quantity between 1 and maxItemQuantity
+func (i orderItem) Validate() error {
+	return validation.ValidateStruct(&i,
+		validation.Field(&i.PizzaID, validation.Required),
+		validation.Field(&i.Quantity, validation.Required, validation.Min(1), validation.Max(maxItemQuantity)),
+	)
+}
+
+// Validate a new API key: a name, the account the key acts on behalf of, known scopes, and an optional lifetime
+func validateAPIKeyRequest(req apiKeyRequest) error {
+	return validation.ValidateStruct(&req,
+		validation.Field(&req.Name, validation.Required, validation.Length(1, 62)),
+		validation.Field(&req.Username, validation.Required),
+		validation.Field(&req.Scopes, validation.Required, validation.By(isAPIKeyScope)),
+		validation.Field(&req.ExpiresInDays, validation.Min(0), validation.Max(3650)),
+	)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Flattens the field-keyed errors of a 422 response, nested fields are joined with dots (e.g. "items.0.quantity")
+func flattenTestErrors(prefix string, errs map[string]interface{}, flat map[string]string) map[string]string {
+	for field, v := range errs {
+		switch e := v.(type) {
+		case map[string]interface{}:
+			flattenTestErrors(prefix+field+".", e, flat)
+		case string:
+			flat[prefix+field] = e
+		}
+	}
+	return flat
+}
+
+// Sends a request expected to fail validation and returns the field-keyed errors
+func testValidationErrors(t *testing.T, method, path, auth, body string) map[string]string {
+	t.Helper()
+
+	res, b := testRequest(t, method, path, auth, body)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("%s: expected 422, got %d %s", body, res.StatusCode, b)
+	}
+	var problem struct {
+		Code   string                 `json:"code"`
+		Errors map[string]interface{} `json:"errors"`
+	}
+	decodeTestJSON(t, b, &problem)
+	if problem.Code != codeValidationFailed {
+		t.Errorf("%s: expected the %s code, got %s", body, codeValidationFailed, b)
+	}
+	return flattenTestErrors("", problem.Errors, map[string]string{})
+}
+
+// Checks that exactly the expected fields are reported, each with a message holding the expected text
+func checkTestErrors(t *testing.T, name string, got, want map[string]string) {
+	t.Helper()
+
+	for field, text := range want {
+		if !strings.Contains(got[field], text) {
+			t.Errorf("%s: expected %s to be reported with %q, got %v", name, field, text, got)
+		}
+	}
+	for field := range got {
+		if _, ok := want[field]; !ok {
+			t.Errorf("%s: unexpected error on %s: %v", name, field, got)
+		}
+	}
+}
+
+func TestSignupValidationErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     map[string]string
+	}{
+		{"valid", "valid.user", "Passw0rd1", nil},
+		{"email username", "user+tag@example.com", "Passw0rd1", nil},
+		{"username too short", "ab", "Passw0rd1", map[string]string{"username": "length must be between 3 and 62"}},
+		{"username too long", strings.Repeat("u", 63), "Passw0rd1", map[string]string{"username": "length must be between 3 and 62"}},
+		{"username longest", strings.Repeat("u", 62), "Passw0rd1", nil},
+		{"username with a space", "a user", "Passw0rd1", map[string]string{"username": "must only contain letters"}},
+		{"username with a colon", "erased:1", "Passw0rd1", map[string]string{"username": "must only contain letters"}},
+		{"username not ASCII", "usér", "Passw0rd1", map[string]string{"username": "must only contain letters"}},
+		{"username missing", "", "Passw0rd1", map[string]string{"username": "cannot be blank"}},
+		{"password without a digit", "valid.user", "Password", map[string]string{"password": "at least one letter and one digit"}},
+		{"password without a letter", "valid.user", "12345678", map[string]string{"password": "at least one letter and one digit"}},
+		{"password too short", "valid.user", "Passw0r", map[string]string{"password": "length must be between 8 and 72"}},
+		{"password shortest", "valid.user", "Passw0rd", nil},
+		{"password longest", "valid.user", "P4" + strings.Repeat("s", 70), nil},
+		{"password too long", "valid.user", "P4" + strings.Repeat("s", 71), map[string]string{"password": "length must be between 8 and 72"}},
+		{"password missing", "valid.user", "", map[string]string{"password": "cannot be blank"}},
+		{"both", "a b", "short", map[string]string{"username": "must only contain letters", "password": "length must be between 8 and 72"}},
+	}
+
+	for _, tc := range tests {
+		// The valid cases are checked without the API, so no account is created
+		c := customer{FirstName: "Test", LastName: "Customer", CustomerPhoneNumber: "8125984475", Username: tc.username, Password: tc.password}
+		if tc.want == nil {
+			if err := validateSignup(&c); err != nil {
+				t.Errorf("%s: expected no error, got %v", tc.name, err)
+			}
+			continue
+		}
+
+		body := fmt.Sprintf(`{"firstName":"Test","lastName":"Customer","customerPhoneNumber":"8125984475","username":"%s","password":"%s"}`, c.Username, c.Password)
+		for _, path := range []string{"/v1/customers", "/customer/add"} {
+			checkTestErrors(t, tc.name+" "+path, testValidationErrors(t, "POST", path, "", body), tc.want)
+		}
+	}
+}
+
+func TestOrderValidationErrors(t *testing.T) {
+	bearer := testToken(t, newTestCustomer(t, roleCustomer))
+
+	tests := []struct {
+		name  string
+		items string
+		want  map[string]string
+	}{
+		{"no items", `[]`, map[string]string{"items": "cannot be blank"}},
+		{"quantity too large", `[{"pizzaId":1,"quantity":51}]`, map[string]string{"items.0.quantity": "no greater than 50"}},
+		{"quantity zero", `[{"pizzaId":1,"quantity":0}]`, map[string]string{"items.0.quantity": "cannot be blank"}},
+		{"quantity negative", `[{"pizzaId":1,"quantity":-1}]`, map[string]string{"items.0.quantity": "no less than 1"}},
+		{"pizza missing", `[{"quantity":1}]`, map[string]string{"items.0.pizzaId": "cannot be blank"}},
+		{"second item too large", `[{"pizzaId":1,"quantity":50},{"pizzaId":2,"quantity":51}]`, map[string]string{"items.1.quantity": "no greater than 50"}},
+		{"unavailable pizza", `[{"pizzaId":999,"quantity":1}]`, map[string]string{"items.0.pizzaId": "must be an available pizza"}},
+		{"unavailable pizzas by index", `[{"pizzaId":1,"quantity":1},{"pizzaId":998,"quantity":1},{"pizzaId":2,"quantity":1},{"pizzaId":999,"quantity":1}]`,
+			map[string]string{"items.1.pizzaId": "must be an available pizza", "items.3.pizzaId": "must be an available pizza"}},
+	}
+
+	for _, tc := range tests {
+		body := fmt.Sprintf(`{"items":%s,"customerPhoneNumber":"8125984475"}`, tc.items)
+		checkTestErrors(t, tc.name, testValidationErrors(t, "POST", "/v1/orders", bearer, body), tc.want)
+	}
+
+	// The largest quantity is accepted
+	if res, b := testRequest(t, "POST", "/v1/orders", bearer, `{"items":[{"pizzaId":1,"quantity":50}],"customerPhoneNumber":"8125984475"}`); res.StatusCode != http.StatusCreated {
+		t.Errorf("expected 201, got %d %s", res.StatusCode, b)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Server side of the WebSocket protocol (RFC 6455), limited to what the kitchen feed needs:
+// text messages, ping and pong, and the closing handshake. Extensions and subprotocols are not negotiated.
+
+// GUID appended to the 'Sec-WebSocket-Key' to compute the 'Sec-WebSocket-Accept' header
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Status codes of a close frame
+const (
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseNoStatus        = 1005
+	wsCloseInvalidPayload  = 1007
+	wsCloseMessageTooBig   = 1009
+)
+
+// Maximum size of a message received from a client
+const maxWebSocketMessageSize = 1 << 16
+
+// Time allowed to write a frame to a client
+const webSocketWriteTimeout = time.Second * 10
+
+// Returned by ReadMessage once the connection is closed
+var errWebSocketClosed = errors.New("WebSocket connection closed")
+
+// Create a struct that holds an upgraded WebSocket connection
+// Writes are safe for concurrent use, messages must be read by a single goroutine.
+type webSocketConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// Time allowed between two frames from the client (0 means no limit)
+	readTimeout time.Duration
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// Upgrades an HTTP request to a WebSocket connection
+// A request that is not a valid opening handshake results in an *appError, nothing is written to 'w' in that case.
+// Browsers send the 'Origin' header, connections from a page served by another host are refused.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		return nil, &appError{Status: http.StatusUpgradeRequired, Detail: "WebSocket upgrade required"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &appError{Status: http.StatusUpgradeRequired, Detail: "Unsupported WebSocket version"}
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return nil, &appError{Status: http.StatusBadRequest, Detail: "Invalid Sec-WebSocket-Key"}
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return nil, &appError{Status: http.StatusForbidden, Detail: "Cross-origin WebSocket connections are not allowed"}
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, &appError{Status: http.StatusInternalServerError, Detail: "WebSocket is not supported by the response writer"}
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, &appError{Status: http.StatusInternalServerError, Detail: err.Error()}
+	}
+
+	// The server timeouts no longer apply to the hijacked connection
+	conn.SetDeadline(time.Time{})
+
+	accept := sha1.Sum([]byte(key + webSocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+	if requestID := w.Header().Get(requestIDHeader); requestID != "" {
+		response += requestIDHeader + ": " + requestID + "\r\n"
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if _, err := io.WriteString(conn, response+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{conn: conn, br: rw.Reader}, nil
+}
+
+// Reports whether a comma-separated header contains a token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the next text message, answering the pings and reassembling the fragmented messages on the way
+// A close frame from the client is answered and returns errWebSocketClosed. A protocol violation
+// closes the connection with the matching status code and returns the error.
+func (c *webSocketConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame(len(message))
+		if err != nil {
+			var closeErr *webSocketCloseError
+			if errors.As(err, &closeErr) {
+				c.WriteClose(closeErr.Code, closeErr.Reason)
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			// Echo the status code of the client, as the closing handshake requires
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == wsCloseNoStatus {
+				code = wsCloseNormal
+			}
+			c.WriteClose(code, "")
+			return nil, errWebSocketClosed
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) != fragmented {
+				c.WriteClose(wsCloseProtocolError, "Unexpected continuation frame")
+				return nil, errWebSocketClosed
+			}
+			if opcode == wsBinary {
+				c.WriteClose(wsCloseUnsupportedData, "Only text messages are supported")
+				return nil, errWebSocketClosed
+			}
+
+			message = append(message, payload...)
+			fragmented = !fin
+			if fin {
+				if !utf8.Valid(message) {
+					c.WriteClose(wsCloseInvalidPayload, "Text message is not valid UTF-8")
+					return nil, errWebSocketClosed
+				}
+				return message, nil
+			}
+		default:
+			c.WriteClose(wsCloseProtocolError, "Unknown opcode")
+			return nil, errWebSocketClosed
+		}
+	}
+}
+
+// Create a struct that holds a protocol violation and the status code to close the connection with
+type webSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *webSocketCloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with %d: %s", e.Code, e.Reason)
+}
+
+// Reads a single frame and unmasks its payload
+// 'buffered' is the size of the message read so far, a message may not grow over maxWebSocketMessageSize.
+func (c *webSocketConn) readFrame(buffered int) (bool, byte, []byte, error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &webSocketCloseError{Code: wsCloseProtocolError, Reason: "No extension was negotiated"}
+	}
+	if !masked {
+		return false, 0, nil, &webSocketCloseError{Code: wsCloseProtocolError, Reason: "Client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Control frames are never fragmented and carry at most 125 bytes
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, &webSocketCloseError{Code: wsCloseProtocolError, Reason: "Invalid control frame"}
+	}
+	if opcode < wsClose && length > uint64(maxWebSocketMessageSize-buffered) {
+		return false, 0, nil, &webSocketCloseError{Code: wsCloseMessageTooBig, Reason: "Message is too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Writes a value as a JSON text message
+func (c *webSocketConn) WriteJSON(v interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, message)
+}
+
+// Sends a ping, the client answers with a pong
+func (c *webSocketConn) Ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// Starts or completes the closing handshake, only the first close frame is sent
+func (c *webSocketConn) WriteClose(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrameLocked(wsClose, append(payload, reason...))
+}
+
+// Closes the underlying connection
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// Writes a single unmasked frame, server frames are never masked
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *webSocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
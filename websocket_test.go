@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opening handshake key of RFC 6455 section 1.3, along with the expected accept value
+const (
+	rfc6455Key    = "dGhlIHNhbXBsZSBub25jZQ=="
+	rfc6455Accept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// Connects to the kitchen feed as the given user and returns the connection once upgraded
+// The connection is closed at the end of the test.
+func dialTestKitchenFeed(t *testing.T, auth, query string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(testServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	req, err := http.NewRequest("GET", testServer.URL+"/v1/kitchen/feed"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", rfc6455Key)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", res.StatusCode)
+	}
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != rfc6455Accept {
+		t.Fatalf("expected Sec-WebSocket-Accept %s, got %s", rfc6455Accept, accept)
+	}
+	return conn, br
+}
+
+// Writes a frame as a client, client frames are masked unless 'masked' is false
+func writeTestFrame(t *testing.T, conn net.Conn, fin bool, opcode byte, payload []byte, masked bool) {
+	t.Helper()
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+
+	data := append([]byte{}, payload...)
+	if masked {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+
+	if _, err := conn.Write(append(frame, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads a frame sent by the server, server frames are never masked
+func readTestFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("expected a final, unmasked frame, got header %x", header)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// Reads the next JSON message sent by the server
+func readTestMessage(t *testing.T, br *bufio.Reader) map[string]interface{} {
+	t.Helper()
+
+	opcode, payload := readTestFrame(t, br)
+	if opcode != wsText {
+		t.Fatalf("expected a text message, got opcode %x %q", opcode, payload)
+	}
+
+	message := map[string]interface{}{}
+	decodeTestJSON(t, payload, &message)
+	return message
+}
+
+// Sends a JSON message as a client
+func sendTestMessage(t *testing.T, conn net.Conn, v interface{}) {
+	t.Helper()
+
+	message, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFrame(t, conn, true, wsText, message, true)
+}
+
+// Reads a close frame and returns its status code
+func readTestClose(t *testing.T, br *bufio.Reader) int {
+	t.Helper()
+
+	opcode, payload := readTestFrame(t, br)
+	if opcode != wsClose || len(payload) < 2 {
+		t.Fatalf("expected a close frame, got opcode %x %q", opcode, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestKitchenFeedHandshakeErrors(t *testing.T) {
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	upgrade := []string{"Connection", "Upgrade", "Upgrade", "websocket", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", rfc6455Key}
+
+	res, _ := testRequest(t, "GET", "/v1/kitchen/feed", employee, "")
+	if res.StatusCode != http.StatusUpgradeRequired || res.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("expected 426 with an Upgrade header, got %d %v", res.StatusCode, res.Header)
+	}
+
+	header := append([]string{}, upgrade...)
+	header[5] = "8"
+	res, _ = testRequest(t, "GET", "/v1/kitchen/feed", employee, "", header...)
+	if res.StatusCode != http.StatusUpgradeRequired || res.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("expected 426 with the supported version, got %d %v", res.StatusCode, res.Header)
+	}
+
+	header = append([]string{}, upgrade...)
+	header[7] = base64.StdEncoding.EncodeToString([]byte("short"))
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", employee, "", header...); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid key, got %d %s", res.StatusCode, b)
+	}
+
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", employee, "", append(upgrade, "Origin", "https://evil.example")...); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-origin connection, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed", customer, "", upgrade...); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer, got %d %s", res.StatusCode, b)
+	}
+	if res, b := testRequest(t, "GET", "/v1/kitchen/feed?status=99", employee, "", upgrade...); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown status, got %d %s", res.StatusCode, b)
+	}
+}
+
+func TestKitchenFeedPushesOrdersAndUpdatesStatuses(t *testing.T) {
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	conn, br := dialTestKitchenFeed(t, employee, "")
+
+	if m := readTestMessage(t, br); m["type"] != "subscribed" {
+		t.Fatalf("expected the subscription first, got %v", m)
+	}
+
+	// A new order is pushed along with its items
+	orderID := createTestOrder(t, customer)
+	m := readTestMessage(t, br)
+	if m["type"] != orderCreatedEvent || m["orderId"] != float64(orderID) || m["orderStatus"] != statusOrderReceived {
+		t.Fatalf("expected the new order %d, got %v", orderID, m)
+	}
+	if items, ok := m["items"].([]interface{}); !ok || len(items) != 1 {
+		t.Errorf("expected the items of the order, got %v", m["items"])
+	}
+
+	// A status update is acknowledged, and the change is pushed like any other change
+	sendTestMessage(t, conn, map[string]interface{}{"type": "updateStatus", "id": "a1", "orderId": orderID, "orderStatus": 2})
+	replies := map[string]map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		m := readTestMessage(t, br)
+		replies[m["type"].(string)] = m
+	}
+	if ack := replies["statusUpdated"]; ack == nil || ack["id"] != "a1" || ack["orderStatus"] != statusMakingPizza {
+		t.Errorf("expected the update to be acknowledged, got %v", replies)
+	}
+	if change := replies[orderStatusChangedEvent]; change == nil || change["previousStatus"] != statusOrderReceived {
+		t.Errorf("expected the change to be pushed, got %v", replies)
+	}
+
+	// A refused update is answered with the problem details
+	sendTestMessage(t, conn, map[string]interface{}{"type": "updateStatus", "id": "a2", "orderId": orderID, "orderStatus": 4})
+	m = readTestMessage(t, br)
+	problem, _ := m["error"].(map[string]interface{})
+	if m["type"] != "error" || m["id"] != "a2" || problem["status"] != float64(http.StatusConflict) || problem["code"] != codeInvalidStatusTransition {
+		t.Errorf("expected a 409 error, got %v", m)
+	}
+
+	sendTestMessage(t, conn, map[string]interface{}{"type": "unknown", "id": "a3"})
+	if m := readTestMessage(t, br); m["type"] != "error" || m["id"] != "a3" {
+		t.Errorf("expected an error for an unknown message type, got %v", m)
+	}
+}
+
+func TestKitchenFeedStatusFilter(t *testing.T) {
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+	customer := testToken(t, newTestCustomer(t, roleCustomer))
+	conn, br := dialTestKitchenFeed(t, employee, "?status=2")
+
+	m := readTestMessage(t, br)
+	if statuses, _ := m["statuses"].([]interface{}); m["type"] != "subscribed" || len(statuses) != 1 || statuses[0] != statusMakingPizza {
+		t.Fatalf("expected the subscription to %s, got %v", statusMakingPizza, m)
+	}
+
+	// The new order is not pushed, its move to a followed status is
+	orderID := createTestOrder(t, customer)
+	updateTestOrderStatus(t, employee, orderID, 2)
+	if m := readTestMessage(t, br); m["type"] != orderStatusChangedEvent || m["orderStatus"] != statusMakingPizza {
+		t.Fatalf("expected only the change to %s, got %v", statusMakingPizza, m)
+	}
+
+	// Leaving a followed status is pushed too, so the display can take the order off
+	updateTestOrderStatus(t, employee, orderID, 3)
+	if m := readTestMessage(t, br); m["orderStatus"] != statusReadyForPickUp || m["previousStatus"] != statusMakingPizza {
+		t.Fatalf("expected the order to leave %s, got %v", statusMakingPizza, m)
+	}
+
+	// Following every status again
+	sendTestMessage(t, conn, map[string]interface{}{"type": "subscribe", "id": 1, "statuses": []int{}})
+	if m := readTestMessage(t, br); m["type"] != "subscribed" || m["id"] != float64(1) {
+		t.Fatalf("expected the subscription to change, got %v", m)
+	}
+	createTestOrder(t, customer)
+	if m := readTestMessage(t, br); m["type"] != orderCreatedEvent {
+		t.Fatalf("expected the new order to be pushed, got %v", m)
+	}
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	employee := testToken(t, newTestCustomer(t, roleEmployee))
+
+	t.Run("ping", func(t *testing.T) {
+		conn, br := dialTestKitchenFeed(t, employee, "")
+		readTestMessage(t, br)
+
+		writeTestFrame(t, conn, true, wsPing, []byte("hello"), true)
+		if opcode, payload := readTestFrame(t, br); opcode != wsPong || string(payload) != "hello" {
+			t.Fatalf("expected a pong with the ping payload, got opcode %x %q", opcode, payload)
+		}
+	})
+
+	t.Run("fragmented message", func(t *testing.T) {
+		conn, br := dialTestKitchenFeed(t, employee, "")
+		readTestMessage(t, br)
+
+		// A ping may come between the fragments of a message
+		writeTestFrame(t, conn, false, wsText, []byte(`{"type":"subscribe",`), true)
+		writeTestFrame(t, conn, true, wsPing, nil, true)
+		writeTestFrame(t, conn, true, wsContinuation, []byte(`"id":"f1","statuses":[1]}`), true)
+		if opcode, _ := readTestFrame(t, br); opcode != wsPong {
+			t.Fatalf("expected a pong, got opcode %x", opcode)
+		}
+		if m := readTestMessage(t, br); m["type"] != "subscribed" || m["id"] != "f1" {
+			t.Fatalf("expected the reassembled message to be handled, got %v", m)
+		}
+	})
+
+	closes := []struct {
+		name    string
+		fin     bool
+		opcode  byte
+		payload []byte
+		masked  bool
+		code    int
+	}{
+		{"close", true, wsClose, []byte{0x03, 0xe8}, true, wsCloseNormal},
+		{"unmasked frame", true, wsText, []byte(`{}`), false, wsCloseProtocolError},
+		{"binary message", true, wsBinary, []byte{1, 2, 3}, true, wsCloseUnsupportedData},
+		{"invalid UTF-8", true, wsText, []byte{0xff, 0xfe}, true, wsCloseInvalidPayload},
+		{"unexpected continuation", true, wsContinuation, []byte(`{}`), true, wsCloseProtocolError},
+		{"fragmented control frame", false, wsPing, nil, true, wsCloseProtocolError},
+		{"message too big", true, wsText, make([]byte, maxWebSocketMessageSize+1), true, wsCloseMessageTooBig},
+	}
+	for _, tt := range closes {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, br := dialTestKitchenFeed(t, employee, "")
+			readTestMessage(t, br)
+
+			if len(tt.payload) > 0xffff {
+				// Only the header is needed, the frame is refused before its payload is read
+				conn.Write([]byte{0x80 | tt.opcode, 0x80 | 127, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0})
+			} else {
+				writeTestFrame(t, conn, tt.fin, tt.opcode, tt.payload, tt.masked)
+			}
+			if code := readTestClose(t, br); code != tt.code {
+				t.Fatalf("expected close code %d, got %d", tt.code, code)
+			}
+
+			// The server closes the connection after the close frame
+			if _, err := br.ReadByte(); err == nil {
+				t.Fatal("expected the connection to be closed")
+			}
+		})
+	}
+}